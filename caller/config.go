@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Name of the project config file. Found by walking up from the working directory
+const CONFIG_FILE_NAME = ".glenv.toml"
+
+// Prefix of the tables in the config file that define profiles. Ex [profiles.logstash-local]
+const CONFIG_PROFILE_TABLE = "profiles."
+
+// Profile keys that aren't flag names
+const (
+	// Env files, or globs, to read. Relative paths are relative to the config file
+	PROFILE_KEY_ENV = "env"
+	// Other profiles that this one builds on. Later ones win, and this profile wins over all of them
+	PROFILE_KEY_EXTENDS = "extends"
+	// Arguments for the command. Same as giving -a for each of them
+	PROFILE_KEY_ARGS = "args"
+)
+
+// Flags whose values are paths. Relative paths in a profile are relative to the config file.
+// Paths starting with a variable are left alone as they are expanded later. So is a cmd without a directory in it,
+// as it is looked for on the PATH
+var profilePathFlags = map[string]bool{"cwd": true, "limits-file": true, "f": true, "stdin-file": true, "key-file": true, "env-dir": true, "file-base-dir": true, "command-dir": true, "intersect": true, "subtract": true, "merge": true}
+
+// A value from the config file. Single values are kept as a list of one
+type configValue struct {
+	Items  []string
+	IsList bool
+}
+
+// Settings for each profile in the config file, by profile name
+type projectConfig struct {
+	// Path to the config file
+	Path     string
+	Profiles map[string]map[string]configValue
+}
+
+// Finds the config file by walking up from start. Returns an empty path if there isn't one.
+func findConfigFile(start string) (string, error) {
+	dir, err := filepath.Abs(start)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, CONFIG_FILE_NAME)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Reads the config file at path.
+// Only the parts of TOML that profiles need are understood: tables, comments, strings, booleans, numbers and
+// arrays of them.
+func readConfigFile(path string) (*projectConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rTable := regexp.MustCompile(`^\[\s*([A-Za-z0-9_.-]+|"[^"]*"|[A-Za-z0-9_-]+\."[^"]*")\s*\]$`)
+	rKey := regexp.MustCompile(`^([A-Za-z0-9_.-]+)\s*=\s*(.*)$`)
+	config := &projectConfig{Path: path, Profiles: map[string]map[string]configValue{}}
+	var current map[string]configValue
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if len(line) == 0 {
+			continue
+		}
+		if matches := rTable.FindStringSubmatch(line); matches != nil {
+			table := strings.ReplaceAll(matches[1], `"`, "")
+			if !strings.HasPrefix(table, CONFIG_PROFILE_TABLE) {
+				return nil, fmt.Errorf("%s:%d: unknown table '%s'. profiles are defined as [%sname]", path, lineNum, table, CONFIG_PROFILE_TABLE)
+			}
+			name := strings.TrimPrefix(table, CONFIG_PROFILE_TABLE)
+			if _, ok := config.Profiles[name]; ok {
+				return nil, fmt.Errorf("%s:%d: profile '%s' is defined more than once", path, lineNum, name)
+			}
+			current = map[string]configValue{}
+			config.Profiles[name] = current
+			continue
+		}
+
+		matches := rKey.FindStringSubmatch(line)
+		if matches == nil {
+			return nil, fmt.Errorf("%s:%d: expected 'key = value' or a [table]", path, lineNum)
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%s:%d: settings must be inside a [%sname] table", path, lineNum, CONFIG_PROFILE_TABLE)
+		}
+		raw := matches[2]
+		// Arrays may carry on over several lines
+		for strings.HasPrefix(raw, "[") && !arrayClosed(raw) && scanner.Scan() {
+			lineNum++
+			raw += " " + strings.TrimSpace(stripConfigComment(scanner.Text()))
+		}
+		value, err := parseConfigValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, lineNum, matches[1], err)
+		}
+		current[matches[1]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Removes a trailing # comment, unless the # is inside a string
+func stripConfigComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote == '"':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Has the array that raw starts with been closed?
+func arrayClosed(raw string) bool {
+	_, rest, err := readConfigArray(raw)
+	return err == nil && len(strings.TrimSpace(rest)) == 0
+}
+
+// Reads a single value, or an array of them
+func parseConfigValue(raw string) (configValue, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasPrefix(raw, "[") {
+		items, rest, err := readConfigArray(raw)
+		if err != nil {
+			return configValue{}, err
+		}
+		if len(strings.TrimSpace(rest)) > 0 {
+			return configValue{}, fmt.Errorf("unexpected '%s' after array", rest)
+		}
+		return configValue{Items: items, IsList: true}, nil
+	}
+	item, rest, err := readConfigScalar(raw)
+	if err != nil {
+		return configValue{}, err
+	}
+	if len(strings.TrimSpace(rest)) > 0 {
+		return configValue{}, fmt.Errorf("unexpected '%s' after value", rest)
+	}
+	return configValue{Items: []string{item}}, nil
+}
+
+// Reads the array at the start of raw. Returns its items and whatever follows it
+func readConfigArray(raw string) (items []string, rest string, err error) {
+	rest = strings.TrimSpace(strings.TrimPrefix(raw, "["))
+	items = []string{}
+	for {
+		if strings.HasPrefix(rest, "]") {
+			return items, rest[1:], nil
+		}
+		if len(rest) == 0 {
+			return nil, "", errors.New("array isn't closed")
+		}
+		var item string
+		if item, rest, err = readConfigScalar(rest); err != nil {
+			return nil, "", err
+		}
+		items = append(items, item)
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, "", errors.New("expected ',' or ']' in array")
+		}
+	}
+}
+
+// Reads the string, boolean or number at the start of raw. Returns it as text and whatever follows it
+func readConfigScalar(raw string) (item string, rest string, err error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		sb := strings.Builder{}
+		escaped := false
+		for i, r := range raw[1:] {
+			switch {
+			case escaped:
+				switch r {
+				case 'n':
+					sb.WriteRune('\n')
+				case 't':
+					sb.WriteRune('\t')
+				case '"', '\\':
+					sb.WriteRune(r)
+				default:
+					return "", "", fmt.Errorf("unsupported escape '\\%c'", r)
+				}
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				return sb.String(), raw[i+2:], nil
+			default:
+				sb.WriteRune(r)
+			}
+		}
+		return "", "", errors.New("string isn't closed")
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", "", errors.New("string isn't closed")
+		}
+		return raw[1 : end+1], raw[end+2:], nil
+	}
+
+	end := strings.IndexAny(raw, ",] \t")
+	if end < 0 {
+		end = len(raw)
+	}
+	word := raw[:end]
+	if word == "true" || word == "false" {
+		return word, raw[end:], nil
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(word, "_", ""), 64); err == nil {
+		return strings.ReplaceAll(word, "_", ""), raw[end:], nil
+	}
+	return "", "", fmt.Errorf("unexpected value '%s'. strings need quotes", word)
+}
+
+// Provides the settings for the named profile, with any profiles it extends folded in
+func (pc *projectConfig) Resolve(name string) (map[string]configValue, error) {
+	return pc.resolve(name, nil)
+}
+
+// chain holds the profiles that led to this one, in the order they were extended
+func (pc *projectConfig) resolve(name string, chain []string) (map[string]configValue, error) {
+	profile, ok := pc.Profiles[name]
+	if !ok {
+		known := make([]string, 0, len(pc.Profiles))
+		for n := range pc.Profiles {
+			known = append(known, n)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("%s: no profile named '%s'. found: %s", pc.Path, name, strings.Join(known, ", "))
+	}
+	for i, n := range chain {
+		if n == name {
+			loop := append(append([]string{}, chain[i:]...), name)
+			return nil, fmt.Errorf("%s: profiles extend each other in a loop: %s", pc.Path, strings.Join(loop, " -> "))
+		}
+	}
+	chain = append(chain, name)
+
+	resolved := map[string]configValue{}
+	for _, parent := range profile[PROFILE_KEY_EXTENDS].Items {
+		settings, err := pc.resolve(parent, chain)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range settings {
+			resolved[k] = v
+		}
+	}
+	for k, v := range profile {
+		if k != PROFILE_KEY_EXTENDS {
+			resolved[k] = v
+		}
+	}
+	return resolved, nil
+}
+
+// Options for choosing a profile from the project config
+func addProfileOptions(targetFlag *flag.FlagSet) {
+	targetFlag.StringVar(&_opts.ProfileName, "p", "", fmt.Sprintf("Name of the profile to use from the nearest %s. Flags given alongside it win over the profile's settings", CONFIG_FILE_NAME))
+	targetFlag.StringVar(&_opts.ConfigPath, "config", "", fmt.Sprintf("Path to the project config. Defaults to the nearest %s in this directory or any above it", CONFIG_FILE_NAME))
+}
+
+// Collects the names of the flags of each of the subcommands, which are the keys a profile may hold
+func profileKeys(flagSets ...*flag.FlagSet) map[string]bool {
+	known := map[string]bool{}
+	for _, fs := range flagSets {
+		fs.VisitAll(func(f *flag.Flag) { known[f.Name] = true })
+	}
+	return known
+}
+
+// Fills in any flags that weren't given on the command line from the chosen profile.
+// Profile keys are flag names, apart from 'env', 'args' and 'extends'. Env files from the profile are only used
+// if none were given on the command line. Keys that are options of other subcommands in known are skipped,
+// so one profile can be used by all of them.
+func applyProfile(targetFlag *flag.FlagSet, opts *OperationOptions, known map[string]bool) error {
+	if len(opts.ProfileName) == 0 {
+		return nil
+	}
+	path := opts.ConfigPath
+	if len(path) == 0 {
+		var err error
+		if path, err = findConfigFile("."); err != nil {
+			return err
+		}
+		if len(path) == 0 {
+			return fmt.Errorf("-p was given but no %s was found in this directory or any above it", CONFIG_FILE_NAME)
+		}
+	}
+	config, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	settings, err := config.Resolve(opts.ProfileName)
+	if err != nil {
+		return err
+	}
+
+	given := map[string]bool{}
+	targetFlag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	configDir := filepath.Dir(path)
+
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := settings[key]
+		if key == PROFILE_KEY_ENV {
+			if len(opts.Globs) == 0 {
+				for _, g := range value.Items {
+					opts.Globs = append(opts.Globs, profilePath(configDir, g))
+				}
+			}
+			continue
+		}
+		name := key
+		if key == PROFILE_KEY_ARGS {
+			name = "a"
+		}
+		if !known[name] || name == "p" || name == "config" {
+			return fmt.Errorf("%s: profile '%s' has '%s', which isn't an option of any subcommand", path, opts.ProfileName, key)
+		}
+		if targetFlag.Lookup(name) == nil {
+			if opts.DoLogDebug {
+				fmt.Printf("Profile '%s': '%s' isn't an option of '%s'. Skipping\n", opts.ProfileName, key, opts.Type)
+			}
+			continue
+		}
+		if given[name] {
+			continue
+		}
+		for _, item := range value.Items {
+			if profilePathFlags[name] || (name == "cmd" && strings.ContainsAny(item, `/\`)) {
+				item = profilePath(configDir, item)
+			}
+			if err := targetFlag.Set(name, item); err != nil {
+				return fmt.Errorf("%s: profile '%s': %s: %w", path, opts.ProfileName, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Makes a relative path from a profile relative to the config file's directory.
+// Paths that start with a variable are left as they are
+func profilePath(configDir string, path string) string {
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "$") || strings.HasPrefix(path, "~") {
+		return path
+	}
+	return filepath.Join(configDir, path)
+}
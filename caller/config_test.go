@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want configValue
+	}{
+		{`"plain"`, configValue{Items: []string{"plain"}}},
+		{`"tab\tnew\nquote\" slash\\"`, configValue{Items: []string{"tab\tnew\nquote\" slash\\"}}},
+		{`'literal \n $HOME'`, configValue{Items: []string{`literal \n $HOME`}}},
+		{`""`, configValue{Items: []string{""}}},
+		{`true`, configValue{Items: []string{"true"}}},
+		{`1_000`, configValue{Items: []string{"1000"}}},
+		{`-2.5`, configValue{Items: []string{"-2.5"}}},
+		{`[]`, configValue{Items: []string{}, IsList: true}},
+		{`["a", 'b', 3, false]`, configValue{Items: []string{"a", "b", "3", "false"}, IsList: true}},
+		{`[ "a" , "b", ]`, configValue{Items: []string{"a", "b"}, IsList: true}},
+		{`["a,b", "c]"]`, configValue{Items: []string{"a,b", "c]"}, IsList: true}},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigValue(tt.raw)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: want %+v, got %+v %v", tt.raw, tt.want, got, err)
+		}
+	}
+
+	for _, raw := range []string{`bare`, `"open`, `'open`, `"bad \q escape"`, `["a" "b"]`, `["a"`, `"a" "b"`, `["a"] x`, `yes`} {
+		if _, err := parseConfigValue(raw); err == nil {
+			t.Fatalf("%s: want an error", raw)
+		}
+	}
+}
+
+func TestStripConfigComment(t *testing.T) {
+	for line, want := range map[string]string{
+		`key = "value" # comment`:       `key = "value" `,
+		`# whole line`:                  ``,
+		`key = "a # b" # comment`:       `key = "a # b" `,
+		`key = 'a # b'`:                 `key = 'a # b'`,
+		`key = "quote \" # still in"`:   `key = "quote \" # still in"`,
+		`key = ['#', "#"] # after list`: `key = ['#', "#"] `,
+	} {
+		if got := stripConfigComment(line); got != want {
+			t.Fatalf("%s: want '%s', got '%s'", line, want, got)
+		}
+	}
+}
+
+// Writes contents to a config file in a new directory. Returns its path
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), CONFIG_FILE_NAME)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := writeConfig(t, `# Project profiles
+
+[profiles.local]
+env = ["base.env", "local.env"]   # loaded in order
+cwd = "./app"
+test = true
+
+[ profiles."logstash.local" ]
+extends = ["local"]
+env = [
+  "logstash.env", # the main one
+  'overrides.env',
+]
+a = "--verbose"
+`)
+	config, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]configValue{
+		"local": {
+			"env":  {Items: []string{"base.env", "local.env"}, IsList: true},
+			"cwd":  {Items: []string{"./app"}},
+			"test": {Items: []string{"true"}},
+		},
+		"logstash.local": {
+			"extends": {Items: []string{"local"}, IsList: true},
+			"env":     {Items: []string{"logstash.env", "overrides.env"}, IsList: true},
+			"a":       {Items: []string{"--verbose"}},
+		},
+	}
+	if !reflect.DeepEqual(config.Profiles, want) {
+		t.Fatalf("want %+v, got %+v", want, config.Profiles)
+	}
+
+	for contents, wantErr := range map[string]string{
+		"[settings]\n":                          ":1: unknown table 'settings'",
+		"[profiles.a]\n[profiles.a]\n":          ":2: profile 'a' is defined more than once",
+		"cwd = \"x\"\n":                         ":1: settings must be inside a [profiles.name] table",
+		"[profiles.a]\njust words\n":            ":2: expected 'key = value' or a [table]",
+		"[profiles.a]\ncwd = x\n":               ":2: cwd: unexpected value 'x'. strings need quotes",
+		"[profiles.a]\nenv = [\"a\",\n\"b\",\n": ":3: env: array isn't closed",
+		"[profiles.a]\nenv = [\"a\"\n\"b\"]\n":  ":3: env: expected ',' or ']' in array",
+		"[profiles.a]\n\n\ncwd = \"x\" \"y\"\n": ":4: cwd: unexpected ' \"y\"' after value",
+	} {
+		path := writeConfig(t, contents)
+		if _, err := readConfigFile(path); err == nil || !strings.Contains(err.Error(), path+wantErr) {
+			t.Fatalf("%q: want an error containing '%s', got %v", contents, wantErr, err)
+		}
+	}
+}
+
+func TestProfileExtends(t *testing.T) {
+	config, err := readConfigFile(writeConfig(t, `
+[profiles.base]
+cwd = "base"
+timeout = "1m"
+[profiles.other]
+cwd = "other"
+label = "other"
+[profiles.child]
+extends = ["base", "other"]
+label = "child"
+[profiles.loop-a]
+extends = ["loop-b"]
+[profiles.loop-b]
+extends = ["loop-a"]
+[profiles.self]
+extends = ["self"]
+[profiles.diamond]
+extends = ["child", "base"]
+[profiles.orphan]
+extends = ["missing"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Later parents win over earlier ones, and the profile wins over them all
+	settings, err := config.Resolve("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"cwd": "other", "timeout": "1m", "label": "child"} {
+		if got := settings[key].Items[0]; got != want {
+			t.Fatalf("%s: want '%s', got '%s'", key, want, got)
+		}
+	}
+	if _, ok := settings[PROFILE_KEY_EXTENDS]; ok {
+		t.Fatal("want extends left out of the resolved settings")
+	}
+
+	// Reaching the same profile twice by different routes isn't a cycle
+	if settings, err := config.Resolve("diamond"); err != nil || settings["cwd"].Items[0] != "base" {
+		t.Fatalf("want base's cwd last, got %v %v", settings, err)
+	}
+
+	for name, wantErr := range map[string]string{
+		"loop-a":  "profiles extend each other in a loop: loop-a -> loop-b -> loop-a",
+		"self":    "profiles extend each other in a loop: self -> self",
+		"orphan":  "no profile named 'missing'",
+		"nothing": "no profile named 'nothing'. found: base, child",
+	} {
+		if _, err := config.Resolve(name); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("%s: want an error containing '%s', got %v", name, wantErr, err)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	path := writeConfig(t, `
+[profiles.dev]
+env = ["dev.env", "$HOME/secrets.env"]
+cwd = "app"
+label = "dev"
+args = ["--port", "80"]
+stdout = "discard"
+[profiles.typo]
+lable = "dev"
+`)
+	// stdout belongs to another subcommand
+	known := map[string]bool{"cwd": true, "label": true, "a": true, "p": true, "config": true, "stdout": true}
+	configDir := filepath.Dir(path)
+	newFlags := func(opts *OperationOptions) *flag.FlagSet {
+		fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+		fs.StringVar(&opts.WorkingDir, "cwd", "", "")
+		fs.StringVar(&opts.OutputLabel, "label", "", "")
+		fs.Var(&opts.CommandArgsRaw, "a", "")
+		fs.StringVar(&opts.ProfileName, "p", "", "")
+		fs.StringVar(&opts.ConfigPath, "config", "", "")
+		return fs
+	}
+
+	opts := OperationOptions{Type: "exec"}
+	fs := newFlags(&opts)
+	fs.Parse([]string{"-p", "dev", "-config", path, "-label", "mine"})
+	if err := applyProfile(fs, &opts, known); err != nil {
+		t.Fatal(err)
+	}
+	// Flags on the command line win, and relative paths are relative to the config file
+	if opts.OutputLabel != "mine" || opts.WorkingDir != filepath.Join(configDir, "app") {
+		t.Fatalf("got label '%s', cwd '%s'", opts.OutputLabel, opts.WorkingDir)
+	}
+	if want := []string{filepath.Join(configDir, "dev.env"), "$HOME/secrets.env"}; !reflect.DeepEqual(opts.Globs, want) {
+		t.Fatalf("want env files %v, got %v", want, opts.Globs)
+	}
+	if want := []string{"--port", "80"}; !reflect.DeepEqual([]string(opts.CommandArgsRaw), want) {
+		t.Fatalf("want args %v, got %v", want, opts.CommandArgsRaw)
+	}
+
+	// Env files given on the command line replace the profile's
+	opts = OperationOptions{Type: "exec", Globs: []string{"mine.env"}}
+	fs = newFlags(&opts)
+	fs.Parse([]string{"-p", "dev", "-config", path})
+	applyProfile(fs, &opts, known)
+	if !reflect.DeepEqual(opts.Globs, []string{"mine.env"}) {
+		t.Fatalf("got %v", opts.Globs)
+	}
+
+	// Keys that aren't options of any subcommand are an error rather than being ignored
+	opts = OperationOptions{Type: "exec"}
+	fs = newFlags(&opts)
+	fs.Parse([]string{"-p", "typo", "-config", path})
+	if err := applyProfile(fs, &opts, known); err == nil || !strings.Contains(err.Error(), "has 'lable', which isn't an option of any subcommand") {
+		t.Fatalf("want an error for the unknown key, got %v", err)
+	}
+}
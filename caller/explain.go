@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// Shows where each variable's value came from. Every definition is listed, the one in effect first, along with the
+// branches of any conditional blocks that were reached. Only the variables named with -n are shown if any are given.
+func explainAction() {
+	envProcessed, err := readEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	provenance := _opts.Provenance
+
+	names := provenance.Names()
+	if len(_opts.ExplainNames) > 0 {
+		names = _opts.ExplainNames
+	} else if branches := provenance.Branches(); len(branches) > 0 {
+		fmt.Println("Branches:")
+		for _, b := range branches {
+			state := "skipped"
+			if b.Taken {
+				state = "taken"
+			}
+			fmt.Printf("  %s: %s (%s)\n", b.Origin, b, state)
+		}
+	}
+
+	if len(_opts.ExplainNames) == 0 {
+		printCommandRuns()
+	}
+
+	fmt.Println("Variables:")
+	for _, name := range names {
+		if value, ok := envProcessed.Lookup(name); ok {
+			fmt.Printf("  %s=%s\n", name, displayValue(name, value))
+		} else if _opts.Unset[name] {
+			fmt.Printf("  %s is unset\n", name)
+		} else {
+			fmt.Printf("  %s isn't defined by the env files\n", name)
+		}
+
+		origins := provenance.Origins(name)
+		for i := len(origins) - 1; i >= 0; i-- {
+			fmt.Printf("      %s\n", describeOrigin(origins[i], i < len(origins)-1))
+		}
+	}
+}
+
+// Ex 'set at finances.mac.env:4' or 'was unset at common.env:7, included from finances.mac.env:1'
+func describeOrigin(origin environment.Origin, overridden bool) string {
+	action := "set"
+	if origin.Unset {
+		action = "unset"
+	}
+	if overridden {
+		action = "was " + action
+	}
+	return fmt.Sprintf("%s at %s", action, origin)
+}
+
+// Lists the commands that were run for values, if -commands was given
+func printCommandRuns() {
+	if _opts.CommandRuns == nil {
+		return
+	}
+	runs := _opts.CommandRuns.Runs()
+	if len(runs) == 0 {
+		fmt.Println("Commands: none")
+		return
+	}
+	fmt.Println("Commands:")
+	for _, r := range runs {
+		took := fmt.Sprintf("took %s", r.Duration.Round(time.Millisecond))
+		if r.Cached {
+			took = "cached"
+		}
+		fmt.Printf("  $(%s) for %s in %s (%s)\n", maskSecretsIn(r.Command), r.Name, r.Dir, took)
+	}
+}
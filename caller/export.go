@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// Works out which shell to write commands for. The -shell flag wins, then $SHELL.
+// PowerShell is assumed on Windows when neither is available, and a POSIX shell everywhere else.
+func exportShell(opts *OperationOptions) string {
+	if len(opts.ShellPath) > 0 {
+		return opts.ShellPath
+	}
+	if shell := os.Getenv("SHELL"); len(shell) > 0 {
+		return shell
+	}
+	if runtime.GOOS == "windows" {
+		return environment.SHELL_POWERSHELL
+	}
+	return environment.SHELL_POSIX
+}
+
+// Writes the commands that load the environment into the current shell to Standard Out, and nothing else.
+// Ex eval "$(glenv export local.env)". With -unset the commands remove the same variables again instead.
+func exportAction() {
+	shell := exportShell(&_opts)
+	var builder *environment.DefinitionBuilder
+	var err error
+	if _opts.ExportUnset {
+		builder, err = environment.NewShellUnsetBuilder(shell)
+	} else {
+		builder, err = environment.NewShellDefinitionBuilder(shell)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	envProcessed, err := readEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	vars := *envProcessed.ToVariables()
+	if !_opts.ExportUnset {
+		// Variables the env files unset are removed from the shell too
+		vars = append(vars, _opts.Unset.ToVariables()...)
+	}
+	for _, v := range vars {
+		if !environment.IsShellName(v.Name) {
+			log.Printf("skipping '%s' as it isn't a valid shell variable name", v.Name)
+		}
+	}
+	if _opts.SortVars {
+		sort.SliceStable(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	}
+	fmt.Print(builder.BuildString(vars))
+}
@@ -3,6 +3,12 @@
 //
 // #read command
 // Reads in a source string and transforms Environment Variables that are found in it into their values from any provided Environment Files.
+//
+// #run command
+// Runs every process listed in a Procfile, with the same Environment Files applied to all of them. Output from each is labelled with its name.
+//
+// #encrypt, #decrypt and #rotate-key commands
+// Encrypt, decrypt or re-encrypt the values of individual variables inside Environment Files. All other lines are left as they were.
 
 package main
 
@@ -17,13 +23,24 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Kynreuten/go-llama-utils/environment"
 )
 
 var _opts OperationOptions
 
+const (
+	// Variables from the env files are layered on top of glenv's own environment
+	INJECT_OVERRIDE = "override"
+	// glenv's own environment wins over variables from the env files
+	INJECT_KEEP = "keep"
+	// The command only gets the variables from the env files
+	INJECT_ONLY = "only"
+)
+
 // func initOriginal() {
 // 	_opts = CreateDefaultOperationOptions()
 // 	//TODO: Consider subcommands using NewFlagSet if we want multiple approaches?
@@ -43,59 +60,310 @@ var _opts OperationOptions
 // }
 
 const (
-	TYPE_EXEC = "exec"
-	TYPE_READ = "read"
+	TYPE_EXEC       = "exec"
+	TYPE_READ       = "read"
+	TYPE_ENCRYPT    = "encrypt"
+	TYPE_DECRYPT    = "decrypt"
+	TYPE_ROTATE_KEY = "rotate-key"
+	TYPE_RUN        = "run"
+	TYPE_SHELL      = "shell"
+	TYPE_EXPORT     = "export"
+	TYPE_HOOK       = "hook"
+	TYPE_HOOK_ENV   = "hook-env"
+	TYPE_ALLOW      = "allow"
+	TYPE_DENY       = "deny"
+	TYPE_EXPLAIN    = "explain"
+	// Hidden subcommand that glenv starts itself with to apply resource limits before running the real command
+	TYPE_APPLY_LIMITS = "apply-limits"
 )
 
-func init() {
+// Works out the subcommand and its options from the program's arguments.
+// Done from main rather than init so tests can run without arguments
+func parseArgs() {
 	_opts = CreateDefaultOperationOptions()
 
 	execFlags := flag.NewFlagSet(TYPE_EXEC, flag.ExitOnError)
 	execFlags.StringVar(&_opts.CommandPath, "cmd", "", "Command to execute. Must be a valid path. Can be relative or absolute.")
+	execFlags.StringVar(&_opts.StdoutTarget, "stdout", "", "Where the command's Standard Out should go. One of 'terminal', 'discard', or a path prefixed with 'file:', 'append:', 'tee:' or 'tee-append:'. Ex 'tee:/tmp/out.log'")
+	execFlags.StringVar(&_opts.StderrTarget, "stderr", "", "Where the command's Standard Error should go. Accepts the same targets as -stdout")
+	execFlags.BoolVar(&_opts.MergeStdErr, "merge-stderr", false, "True if the command's Standard Error should be sent to the same place as its Standard Out")
+	execFlags.Var(&_opts.RotateSize, "rotate-size", "Rotate files written by -stdout or -stderr once they reach this size. Ex '100M'. 0 disables size based rotation")
+	execFlags.DurationVar(&_opts.RotateEvery, "rotate-every", 0, "Rotate files written by -stdout or -stderr on boundaries of this interval. Ex '24h' rotates at midnight UTC. 0 disables time based rotation")
+	execFlags.IntVar(&_opts.RotateKeep, "rotate-keep", 5, "Number of rotated files to keep")
+	execFlags.BoolVar(&_opts.RotateCompress, "rotate-compress", false, "True if rotated files should be gzipped")
+	addRestartOptions(execFlags)
+	execFlags.BoolVar(&_opts.Watch, "watch", false, "True if the env files should be watched for changes. The command is restarted, or signaled, when they change")
+	execFlags.DurationVar(&_opts.WatchInterval, "watch-interval", time.Second, "How often the env files are checked for changes")
+	execFlags.DurationVar(&_opts.WatchDebounce, "watch-debounce", 500*time.Millisecond, "How long the env files must stay unchanged before acting on a change")
+	execFlags.StringVar(&_opts.WatchAction, "watch-action", WATCH_RESTART, fmt.Sprintf("What to do when the env files change. Either '%s' or '%s'", WATCH_RESTART, WATCH_SIGNAL))
+	execFlags.StringVar(&_opts.WatchSignal, "watch-signal", "HUP", "Signal sent to the command when -watch-action is 'signal'")
+	execFlags.BoolVar(&_opts.PassStdin, "stdin", false, "True if this terminal's Standard Input should be passed on to the command")
+	execFlags.StringVar(&_opts.StdinPath, "stdin-file", "", "Path to a file to use as the command's Standard Input. May refer to Environment Variables")
+	execFlags.BoolVar(&_opts.TTY, "tty", false, "True if the command should be run on a pseudo-terminal so it can use color and prompts. Standard Error is merged into Standard Out. Linux only")
+	addInjectOptions(execFlags)
+	addProfileOptions(execFlags)
+	addLaunchOptions(execFlags)
+	execFlags.StringVar(&_opts.OutputLabel, "label", "", "Label to put at the start of each line of the command's output")
+	addOutputLineOptions(execFlags)
 	execFlags.Var(&_opts.CommandArgsRaw, "a", "Arguments for the command itself. You may supply multiple of these. Should include flag and value together with an equals sign between them. No equals if it has no value. \nEx 'loglevel=debug' or 'something=nope'")
 	addStandardOptions(execFlags)
 
 	readFlags := flag.NewFlagSet(TYPE_READ, flag.ExitOnError)
 	readFlags.StringVar(&_opts.TargetInPath, "i", "", "Path to the file to read as our input string. Must be a valid path. Can be relative or absolute. If not provided then standard input is assumed.")
 	readFlags.StringVar(&_opts.TargetOutPath, "o", "", "Path to the file to write the converted string to. If not provided then standard input is assumed. Must be a valid path. Can be relative or absolute. Sent to Standard Out if not specified")
+	addProfileOptions(readFlags)
 	addStandardOptions(readFlags)
 
+	runFlags := flag.NewFlagSet(TYPE_RUN, flag.ExitOnError)
+	runFlags.StringVar(&_opts.ProcfilePath, "f", "Procfile", "Path to the Procfile listing the processes to run")
+	runFlags.StringVar(&_opts.OnExit, "on-exit", ON_EXIT_STOP, fmt.Sprintf("What happens when a process exits for good. '%s' stops all of the others, '%s' keeps them running", ON_EXIT_STOP, ON_EXIT_CONTINUE))
+	runFlags.BoolVar(&_opts.NoColor, "no-color", false, "True if process labels shouldn't be colored")
+	addInjectOptions(runFlags)
+	addProfileOptions(runFlags)
+	addRestartOptions(runFlags)
+	addLaunchOptions(runFlags)
+	addOutputLineOptions(runFlags)
+	addStandardOptions(runFlags)
+
+	shellFlags := flag.NewFlagSet(TYPE_SHELL, flag.ExitOnError)
+	shellFlags.StringVar(&_opts.ShellPath, "shell", "", "Shell to start. Defaults to $SHELL")
+	shellFlags.StringVar(&_opts.ShellLabel, "label", "", "Label shown in the shell's prompt. Defaults to the names of the env files. Ex 'local' for finances.local.env")
+	shellFlags.Var(&_opts.ShellInit, "init", "Command to run once the shell has started, after its own startup files. You may supply multiple of these.")
+	addInjectOptions(shellFlags)
+	addProfileOptions(shellFlags)
+	addStandardOptions(shellFlags)
+
+	exportFlags := flag.NewFlagSet(TYPE_EXPORT, flag.ExitOnError)
+	exportFlags.StringVar(&_opts.ShellPath, "shell", "", fmt.Sprintf("Shell to write the commands for. One of '%s' (bash, zsh, sh...), '%s' or '%s'. Defaults to $SHELL", environment.SHELL_POSIX, environment.SHELL_FISH, environment.SHELL_POWERSHELL))
+	exportFlags.BoolVar(&_opts.ExportUnset, "unset", false, "True to write the commands that remove the variables again instead")
+	exportFlags.BoolVar(&_opts.SortVars, "sort", false, "True if the commands should be sorted by name instead of in the order the variables were defined")
+	exportFlags.Var(&_opts.SecretVars, "secret", "Name of a variable that should always be treated as secret. You may supply multiple of these.")
+	addKeyOptions(exportFlags)
+	addStageOptions(exportFlags)
+	addFileRefOptions(exportFlags)
+	addCommandOptions(exportFlags)
+	addTransformOptions(exportFlags)
+	addProfileOptions(exportFlags)
+
+	encryptFlags := flag.NewFlagSet(TYPE_ENCRYPT, flag.ExitOnError)
+	addSecretEditOptions(encryptFlags)
+	encryptFlags.BoolVar(&_opts.GenerateKey, "generate-key", false, "True if a new key should be written to the -key-file path when it doesn't exist yet")
+
+	decryptFlags := flag.NewFlagSet(TYPE_DECRYPT, flag.ExitOnError)
+	addSecretEditOptions(decryptFlags)
+
+	rotateFlags := flag.NewFlagSet(TYPE_ROTATE_KEY, flag.ExitOnError)
+	addSecretEditOptions(rotateFlags)
+	rotateFlags.StringVar(&_opts.NewKeyPath, "new-key-file", "", "Path to the key file that values should be re-encrypted with. A new key is generated here if the file doesn't exist.")
+
+	explainFlags := flag.NewFlagSet(TYPE_EXPLAIN, flag.ExitOnError)
+	explainFlags.Var(&_opts.ExplainNames, "n", "Name of a variable to explain. You may supply multiple of these. All of them are explained if none are given")
+	addProfileOptions(explainFlags)
+	addStandardOptions(explainFlags)
+
+	hookFlags := flag.NewFlagSet(TYPE_HOOK, flag.ExitOnError)
+
+	hookEnvFlags := flag.NewFlagSet(TYPE_HOOK_ENV, flag.ExitOnError)
+	hookEnvFlags.StringVar(&_opts.ShellPath, "shell", "", "Shell to write the commands for. Defaults to $SHELL")
+	addKeyOptions(hookEnvFlags)
+
+	allowFlags := flag.NewFlagSet(TYPE_ALLOW, flag.ExitOnError)
+	denyFlags := flag.NewFlagSet(TYPE_DENY, flag.ExitOnError)
+
+	limitFlags := flag.NewFlagSet(TYPE_APPLY_LIMITS, flag.ExitOnError)
+	addLimitOptions(limitFlags, &_opts.Limits)
+
+	profiled := profileKeys(execFlags, readFlags, runFlags, shellFlags, exportFlags, explainFlags)
+
 	if len(os.Args) < 2 {
-		fmt.Println("Expected a subcommand of 'exec', or 'read")
+		fmt.Fprintf(os.Stderr, "Expected a subcommand of %s\n", describeSubcommands())
 		os.Exit(1)
 	}
 
 	_opts.Type = os.Args[1]
 	switch _opts.Type {
 	case TYPE_EXEC:
-		fmt.Println("Exec Subcommand chosen.")
-		execFlags.Parse(os.Args[2:])
-		_opts.Globs = execFlags.Args()
+		fmt.Fprintln(os.Stderr, "Exec Subcommand chosen.")
+		parseWithProfile(execFlags, profiled)
 	case TYPE_READ:
-		fmt.Println("Read Subcommand chosen.")
-		readFlags.Parse(os.Args[2:])
-		_opts.Globs = readFlags.Args()
+		fmt.Fprintln(os.Stderr, "Read Subcommand chosen.")
+		parseWithProfile(readFlags, profiled)
+	case TYPE_RUN:
+		fmt.Fprintln(os.Stderr, "Run Subcommand chosen.")
+		parseWithProfile(runFlags, profiled)
+	case TYPE_SHELL:
+		fmt.Fprintln(os.Stderr, "Shell Subcommand chosen.")
+		parseWithProfile(shellFlags, profiled)
+	case TYPE_EXPORT:
+		// Nothing but the commands may go to Standard Out, and nothing extra to Standard Error
+		parseWithProfile(exportFlags, profiled)
+		_opts.QuietEnv = true
+	case TYPE_EXPLAIN:
+		// The explanation lists the variables itself
+		parseWithProfile(explainFlags, profiled)
+		_opts.QuietEnv = true
+	case TYPE_HOOK:
+		hookFlags.Parse(os.Args[2:])
+		_opts.Globs = hookFlags.Args()
+	case TYPE_HOOK_ENV:
+		hookEnvFlags.Parse(os.Args[2:])
+		_opts.QuietEnv = true
+	case TYPE_ALLOW:
+		allowFlags.Parse(os.Args[2:])
+		_opts.Globs = allowFlags.Args()
+	case TYPE_DENY:
+		denyFlags.Parse(os.Args[2:])
+		_opts.Globs = denyFlags.Args()
+	case TYPE_APPLY_LIMITS:
+		limitFlags.Parse(os.Args[2:])
+		_opts.Globs = limitFlags.Args()
+	case TYPE_ENCRYPT:
+		encryptFlags.Parse(os.Args[2:])
+		_opts.Globs = encryptFlags.Args()
+	case TYPE_DECRYPT:
+		decryptFlags.Parse(os.Args[2:])
+		_opts.Globs = decryptFlags.Args()
+	case TYPE_ROTATE_KEY:
+		rotateFlags.Parse(os.Args[2:])
+		_opts.Globs = rotateFlags.Args()
 	default:
-		fmt.Printf("Unknown subcommand '%s'. Expecting '%s', or '%s", _opts.Type, TYPE_EXEC, TYPE_READ)
-		fmt.Println(os.Args)
+		fmt.Fprintf(os.Stderr, "Unknown subcommand '%s'. Expecting %s\n", _opts.Type, describeSubcommands())
+		fmt.Fprintln(os.Stderr, os.Args)
 		os.Exit(1)
 	}
 }
 
+// Parses the subcommand's flags, then fills in anything they didn't give from the chosen profile.
+// known holds the options of every subcommand that takes a profile
+func parseWithProfile(targetFlag *flag.FlagSet, known map[string]bool) {
+	targetFlag.Parse(os.Args[2:])
+	_opts.Globs = targetFlag.Args()
+	if err := applyProfile(targetFlag, &_opts, known); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Lists the subcommands that can be chosen. Ex "'exec', 'read' or 'run'"
+func describeSubcommands() string {
+	names := []string{TYPE_EXEC, TYPE_READ, TYPE_RUN, TYPE_SHELL, TYPE_EXPORT, TYPE_EXPLAIN, TYPE_HOOK, TYPE_ALLOW, TYPE_DENY, TYPE_ENCRYPT, TYPE_DECRYPT, TYPE_ROTATE_KEY}
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = fmt.Sprintf("'%s'", n)
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
+
 func addStandardOptions(targetFlag *flag.FlagSet) {
 	targetFlag.BoolVar(&_opts.UseStdOut, "useStdOut", true, "True if you want Standard Output to be shown in this terminal")
 	targetFlag.BoolVar(&_opts.UseStdErr, "useStdErr", true, "True if you want Standard Error to be shown in this terminal")
 	targetFlag.BoolVar(&_opts.DoLogDebug, "debug.main", false, "True if you want most debug info displayed")
 	targetFlag.BoolVar(&_opts.DoLogEnv, "debug.env", false, "True if you want to log all Environment data")
 	targetFlag.BoolVar(&_opts.IsTest, "test", false, "True if you want to only show what would be done and exit")
+	targetFlag.BoolVar(&_opts.ShowSecrets, "show-secrets", false, "True if secret values should be shown instead of masked in all output. Only intended for local debugging")
+	targetFlag.Var(&_opts.SecretVars, "secret", "Name of a variable that should always be treated as secret. You may supply multiple of these.")
+	targetFlag.BoolVar(&_opts.SortVars, "sort", false, "True if variables should be listed and passed on sorted by name instead of in the order they were defined")
+	addKeyOptions(targetFlag)
+	addStageOptions(targetFlag)
+	addFileRefOptions(targetFlag)
+	addCommandOptions(targetFlag)
+	addTransformOptions(targetFlag)
+}
+
+// Options for running the commands in values. Ex 'VERSION=$(git rev-parse HEAD)'
+func addCommandOptions(targetFlag *flag.FlagSet) {
+	targetFlag.BoolVar(&_opts.Commands, "commands", false, "True if commands in values, such as '$(git rev-parse HEAD)', should be run and replaced with their output. They're kept as they are written otherwise")
+	targetFlag.StringVar(&_opts.CommandShell, "command-shell", "", "Shell, and its arguments, that -commands runs them with. Ex 'bash -c'. Defaults to 'sh -c', or 'cmd /C' on Windows. Not used with -command-allow")
+	targetFlag.DurationVar(&_opts.CommandTimeout, "command-timeout", environment.COMMAND_TIMEOUT, "Longest each command run by -commands may take. 0 means there is no limit")
+	targetFlag.StringVar(&_opts.CommandDir, "command-dir", "", "Directory that -commands runs them in. Defaults to the directory of the env file they're in")
+	targetFlag.Var(&_opts.CommandAllow, "command-allow", "Executable that commands run by -commands may use. Ex 'git'. You may supply multiple of these. Commands are then run without a shell, so only simple commands and pipelines can be used. Any may be used if none are given")
+	targetFlag.Var(&_opts.CommandEnv, "command-env", fmt.Sprintf("Name of a variable from this environment that commands run by -commands get, on top of %s and the variables defined before them. You may supply multiple of these.", strings.Join(environment.DefaultCommandEnvNames, ", ")))
+}
+
+// Options for values read from files, such as mounted Docker and Kubernetes secrets
+func addFileRefOptions(targetFlag *flag.FlagSet) {
+	targetFlag.BoolVar(&_opts.FileRefs, "file-refs", false, fmt.Sprintf("True if values should be read from files. Ex 'KEY=%s/run/secrets/key'. With -file-suffix '%s', 'KEY%s=/run/secrets/key' sets KEY as well. Values read are treated as secret", environment.FILE_REF_PREFIX, environment.FILE_REF_SUFFIX, environment.FILE_REF_SUFFIX))
+	targetFlag.StringVar(&_opts.FileRefSuffix, "file-suffix", "", fmt.Sprintf("Suffix of the variables that -file-refs reads into the variable without it. Ex '%s'. Off unless given", environment.FILE_REF_SUFFIX))
+	targetFlag.Var(&_opts.FileRefMaxSize, "file-max-size", "Largest file -file-refs may read. Ex '64K'. 0 means there is no limit")
+	targetFlag.StringVar(&_opts.FileRefBaseDir, "file-base-dir", "", "Directory that all files read by -file-refs must be in. Any file may be read if not provided")
+	targetFlag.BoolVar(&_opts.FileRefKeepNewline, "file-keep-newline", false, "True if a trailing newline in files read by -file-refs should be kept")
+}
+
+// Options for loading the cascade of env files for a stage
+func addStageOptions(targetFlag *flag.FlagSet) {
+	targetFlag.StringVar(&_opts.Stage, "stage", "", "Stage to load env files for. Loads .env, .env.<stage>, .env.local then .env.<stage>.local from -env-dir, before any files given as arguments. The .local files are skipped for 'test'")
+	targetFlag.StringVar(&_opts.EnvDir, "env-dir", "", "Directory the files for -stage are in. Defaults to the current directory. Giving it without -stage loads .env and .env.local")
+}
+
+// Options for how variables are given to commands
+func addInjectOptions(targetFlag *flag.FlagSet) {
+	targetFlag.StringVar(&_opts.InjectMode, "inject", INJECT_OVERRIDE, fmt.Sprintf("How variables from the env files are given to the command. '%s' layers them over this environment, '%s' lets this environment win and '%s' gives the command nothing else", INJECT_OVERRIDE, INJECT_KEEP, INJECT_ONLY))
+	targetFlag.Var(&_opts.UnsetVars, "u", "Name of a variable to remove, the same as an 'unset NAME' line after all of the env files. It's also removed from this environment before the command gets it. You may supply multiple of these.")
+}
+
+// Options for where commands run and the limits they run with
+func addLaunchOptions(targetFlag *flag.FlagSet) {
+	targetFlag.StringVar(&_opts.WorkingDir, "cwd", "", "Working directory for the command. May refer to Environment Variables. Ex '${APP_ROOT}/config'")
+	targetFlag.DurationVar(&_opts.Timeout, "timeout", 0, "Stop the command if it runs longer than this. It is asked to stop, then killed after -stop-grace. 0 means no limit")
+	targetFlag.StringVar(&_opts.Umask, "umask", "", "File mode creation mask for the command, in octal. Ex '027'. Left as it is if not provided")
+	addLimitOptions(targetFlag, &_opts.Limits)
+	targetFlag.StringVar(&_opts.LimitsPath, "limits-file", "", "Path to a file of resource limits for the command, in env file format. Keys are the limit flag names. Ex 'LIMIT_NOFILE=1024'. Flags take priority")
+}
+
+// Options for restarting commands after they exit
+func addRestartOptions(targetFlag *flag.FlagSet) {
+	targetFlag.StringVar(&_opts.RestartMode, "restart", RESTART_NO, fmt.Sprintf("When the command should be restarted after it exits. One of '%s', '%s' or '%s'", RESTART_NO, RESTART_ON_FAILURE, RESTART_ALWAYS))
+	targetFlag.DurationVar(&_opts.RestartDelay, "restart-delay", time.Second, "Delay before restarting the command. Doubles after each run shorter than -min-uptime")
+	targetFlag.DurationVar(&_opts.RestartMaxDelay, "restart-max-delay", time.Minute, "Longest the delay before restarting the command can grow to")
+	targetFlag.IntVar(&_opts.MaxRestarts, "max-restarts", 0, "Most restarts allowed within -restart-window before giving up. 0 means there is no limit")
+	targetFlag.DurationVar(&_opts.RestartWindow, "restart-window", 10*time.Minute, "Period of time that -max-restarts applies to")
+	targetFlag.DurationVar(&_opts.MinUptime, "min-uptime", 10*time.Second, "Runs at least this long are considered healthy and reset the restart delay")
+	targetFlag.StringVar(&_opts.OnCrash, "on-crash", "", "Shell command to run whenever the command fails. Details are given to it through GLENV_EXIT_CODE, GLENV_UPTIME and GLENV_RESTARTS")
+	targetFlag.DurationVar(&_opts.StopGrace, "stop-grace", 10*time.Second, "How long the command gets to exit after being asked to stop before it is killed. 0 waits for it forever")
+}
+
+// Options for how each line of a command's output is written
+func addOutputLineOptions(targetFlag *flag.FlagSet) {
+	targetFlag.BoolVar(&_opts.OutputTimestamps, "timestamps", false, "True if each line of the command's output should start with a timestamp")
+	targetFlag.StringVar(&_opts.TimestampFormat, "timestamp-format", time.RFC3339, "Go time layout used for -timestamps")
+	targetFlag.BoolVar(&_opts.RedactOutput, "redact", false, fmt.Sprintf("True if the values of secret variables should be replaced with **** in the command's Standard Out and Standard Error. Values shorter than %d characters aren't replaced, and each one is warned about", MIN_MASKED_VALUE_LENGTH))
+}
+
+func addKeyOptions(targetFlag *flag.FlagSet) {
+	targetFlag.StringVar(&_opts.KeyPath, "key-file", "", "Path to the key file used for encrypted values. If not provided then the variable named by -key-env is used.")
+	targetFlag.StringVar(&_opts.KeyEnvName, "key-env", environment.ENCRYPTION_KEY_ENV, "Name of the Environment Variable holding the key for encrypted values. Used when -key-file isn't provided.")
 }
 
 func main() {
+	parseArgs()
 	switch _opts.Type {
 	case TYPE_EXEC:
 		executeCmdAction()
 	case TYPE_READ:
 		transformAction()
+	case TYPE_RUN:
+		runProcfileAction()
+	case TYPE_SHELL:
+		startShellAction()
+	case TYPE_EXPORT:
+		exportAction()
+	case TYPE_EXPLAIN:
+		explainAction()
+	case TYPE_HOOK:
+		hookAction()
+	case TYPE_HOOK_ENV:
+		hookEnvAction()
+	case TYPE_ALLOW:
+		allowAction(true)
+	case TYPE_DENY:
+		allowAction(false)
+	case TYPE_APPLY_LIMITS:
+		applyLimitsAction(&_opts.Limits, _opts.Globs)
+	case TYPE_ENCRYPT:
+		encryptAction()
+	case TYPE_DECRYPT:
+		decryptAction()
+	case TYPE_ROTATE_KEY:
+		rotateKeyAction()
 	}
 }
 
@@ -126,62 +394,144 @@ func transformAction() {
 	}
 }
 
+// Everything a single read of the env files produced. Kept together so a read that fails can fall back to all of the
+// last good one, rather than a mix of the two
+type loadedEnv struct {
+	// Variables that were read, after any transforms
+	Vars *environment.VariableMap
+	// Where each variable was defined
+	Provenance *environment.Provenance
+	// Names of the variables that were unset, which are removed from inherited ones as well
+	Unset environment.UnsetNames
+	// Commands that were run for values. nil if commands weren't allowed
+	CommandRuns *environment.CommandSubstitution
+	// Values of the variables that are secret. Longest first
+	SecretValues []string
+}
+
 // Attempts to read and process environment variables in the files referenced in _opts.EnvPaths
 // Returns a pointer to a map of environment variable keys to values as strings that were read in.
-func readEnv() (*map[string]string, error) {
+// The unset names, provenance and secret values from the read are made the current ones as well.
+func readEnv() (*environment.VariableMap, error) {
+	loaded, err := loadEnv()
+	if err != nil {
+		return nil, err
+	}
+	return useEnv(loaded), nil
+}
+
+// Makes loaded the current environment. Everything that reports on the environment, or masks its secrets, uses it
+// from then on. Returns its variables.
+func useEnv(loaded *loadedEnv) *environment.VariableMap {
+	if loaded.Provenance == _opts.Provenance {
+		// Already current
+		return loaded.Vars
+	}
+	_opts.Provenance = loaded.Provenance
+	_opts.Unset = loaded.Unset
+	_opts.CommandRuns = loaded.CommandRuns
+	_secretValues = loaded.SecretValues
+
+	// Sent to Standard Error so it doesn't mix with anything glenv outputs
+	if !_opts.QuietEnv {
+		fmt.Fprintln(os.Stderr, "Environment:")
+		loaded.Vars.Range(func(k, v string) bool {
+			fmt.Fprintf(os.Stderr, "`%s=%s`\n", k, displayValue(k, v))
+			return true
+		})
+	}
+	return loaded.Vars
+}
+
+// Reads and processes the env files the same as readEnv, without making the result the current environment
+func loadEnv() (*loadedEnv, error) {
 
 	if err := processEnvGlobs(&_opts); err != nil {
 		return nil, err
 	}
 	if _opts.DoLogDebug {
-		fmt.Println("Env Paths: ")
-		fmt.Println(_opts.EnvPaths)
+		fmt.Fprintln(os.Stderr, "Env Paths: ")
+		fmt.Fprintln(os.Stderr, _opts.EnvPaths)
+	}
+
+	key, err := loadKey(&_opts)
+	if err != nil {
+		return nil, err
+	}
+	_secrets.Mark(_opts.SecretVars...)
+	loaded := &loadedEnv{Provenance: environment.NewProvenance(), Unset: environment.UnsetNames{}}
+	processOpts := environment.ProcessOptions{DoPrint: _opts.DoLogEnv, Key: key, Secrets: _secrets, ShowSecrets: _opts.ShowSecrets, Provenance: loaded.Provenance, Unset: loaded.Unset}
+	if _opts.FileRefs {
+		processOpts.FileRefs = &environment.FileRefOptions{
+			Suffix:      _opts.FileRefSuffix,
+			KeepNewline: _opts.FileRefKeepNewline,
+			MaxSize:     int64(_opts.FileRefMaxSize),
+			BaseDir:     _opts.FileRefBaseDir,
+			MarkSecret:  true,
+		}
+	}
+	if _opts.Commands {
+		commands := environment.NewCommandSubstitution()
+		if len(_opts.CommandShell) > 0 {
+			commands.Shell = strings.Fields(_opts.CommandShell)
+		}
+		commands.Timeout = _opts.CommandTimeout
+		commands.Dir = _opts.CommandDir
+		commands.Allow = _opts.CommandAllow
+		commands.Env = append(commands.Env, environment.CommandEnv(_opts.CommandEnv...)...)
+		processOpts.Commands = commands
+		loaded.CommandRuns = commands
 	}
 
 	// Environment variables that have been completely processed
-	envProcessed := make(map[string]string)
-	// Attempt to read in the contents of each environment file
-	for _, p := range _opts.EnvPaths {
-		environment.ProcessEnvironmentFile(p, &envProcessed, _opts.DoLogEnv)
+	envProcessed := environment.NewVariableMap()
+	// Attempt to read in the contents of each source. Later ones win
+	for _, s := range _opts.Sources {
+		if err := s.Load(envProcessed, processOpts); err != nil {
+			return nil, err
+		}
 
 		if _opts.DoLogEnv {
 			fmt.Println("####----------------####")
 		}
 	}
-
-	envEntries := make([]string, len(envProcessed))
-	fmt.Println("Environment:")
-	if len(envProcessed) > 0 {
-		i := 0
-		for k, v := range envProcessed {
-			envEntries[i] = fmt.Sprintf("%s=%s", k, v)
-			fmt.Printf("`%s`\n", envEntries[i])
-			i++
+	for _, name := range _opts.UnsetVars {
+		environment.UnsetVariable(name, envProcessed, processOpts)
+	}
+	if len(_opts.Transforms) > 0 {
+		if envProcessed, err = applyTransforms(envProcessed, processOpts); err != nil {
+			return nil, err
 		}
-	} else {
+	}
+	// Variables are kept in the order they were defined unless asked otherwise
+	if _opts.SortVars {
+		envProcessed.Sort()
+	}
+	if envProcessed.Len() == 0 && len(loaded.Unset) == 0 {
 		return nil, errors.New("no environment variables found")
 	}
 
-	return &envProcessed, nil
+	loaded.Vars = envProcessed
+	loaded.SecretValues = secretValuesOf(envProcessed)
+	return loaded, nil
 }
 
 // Puts together a list of the given envProcessed entries. If doPrint is true then these will be printed out while assembling the array of values
 // Returns a pointer to an array of all entries from envProcessed
-func listEnv(envProcessed map[string]string, doPrint bool) (*[]string, error) {
+func listEnv(envProcessed *environment.VariableMap, doPrint bool) (*[]string, error) {
 
-	envEntries := make([]string, len(envProcessed))
+	envEntries := make([]string, 0, envProcessed.Len())
 	if doPrint {
 		fmt.Println("Environment:")
 	}
-	if len(envProcessed) > 0 {
-		i := 0
-		for k, v := range envProcessed {
-			envEntries[i] = fmt.Sprintf("%s=%s", k, v)
+	if envProcessed.Len() > 0 {
+		envProcessed.Range(func(k, v string) bool {
+			envEntries = append(envEntries, fmt.Sprintf("%s=%s", k, v))
 			if doPrint {
-				fmt.Printf("`%s`\n", envEntries[i])
+				fmt.Printf("`%s=%s`\n", k, displayValue(k, v))
 			}
-			i++
-		}
+			return true
+		})
 		return &envEntries, nil
 	} else {
 		return nil, errors.New("no environment variables found")
@@ -195,48 +545,208 @@ func executeCmdAction() {
 	if err != nil { // errors.Is(err, os.ErrNotExist) {
 		log.Fatalf("Failure looking at command: \"%s\"\n%s", targetCmd, err.Error())
 	}
+	// Relative paths would otherwise be looked for from within -cwd
+	if targetCmd, err = filepath.Abs(targetCmd); err != nil {
+		log.Fatal(err)
+	}
 	if err := processCommandArgs(&_opts); err != nil {
 		log.Fatal(err.Error())
 	}
+	if err := loadLimits(&_opts); err != nil {
+		log.Fatal(err)
+	}
+	if _opts.TTY && len(_opts.StdinPath) > 0 {
+		log.Fatal("-tty and -stdin-file can't be used together. input comes from this terminal")
+	}
+	if _opts.TTY && (_opts.Limits.NewProcessGroup || _opts.Limits.NewSession) {
+		log.Fatal("-tty always starts the command in a new session. -new-pgroup and -new-session can't be used with it")
+	}
 
 	fmt.Println("Passed Command: ", targetCmd)
 	if _opts.DoLogDebug {
 		fmt.Println("Command Arguments: ")
-		fmt.Println(_opts.CommandArgs)
+		fmt.Println(maskSecretsIn(strings.Join(_opts.CommandArgs, " ")))
 	}
 
-	// Environment variables that have been completely processed
-	var envProcessed, readErr = readEnv()
-	if readErr != nil {
-		log.Fatal(readErr)
+	if _opts.IsTest {
+		// Environment variables that have been completely processed
+		var envProcessed, readErr = readEnv()
+		if readErr != nil {
+			log.Fatal(readErr)
+		}
+		cmd, err := buildCommand(targetCmd, _opts.CommandArgs, envProcessed, _opts.Unset)
+		if err != nil {
+			log.Fatal(err)
+		}
+		launch, err := resolveLaunchSettings(&_opts, envProcessed)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("####--------++--------####")
+		fmt.Println("Command to run:")
+		fmt.Println(maskSecretsIn(cmd.String()))
+		fmt.Printf("Args: %+q\n", maskSecretsIn(strings.Join(cmd.Args, ",")))
+		fmt.Printf("Env:\n%+q\n", strings.Join(displayEntries(cmd.Environ()), ","))
+		fmt.Printf("Inject: %s\n", _opts.InjectMode)
+		if len(_opts.Stage) > 0 {
+			fmt.Printf("Stage: %s\n", _opts.Stage)
+		}
+		fmt.Printf("Env files: %s\n", strings.Join(_opts.EnvPaths, ", "))
+		printCommandRuns()
+		if len(_opts.Transforms) > 0 {
+			transforms := make([]string, len(_opts.Transforms))
+			for i, t := range _opts.Transforms {
+				transforms[i] = t.String()
+			}
+			fmt.Printf("Transforms: %s\n", strings.Join(transforms, " "))
+		}
+		if len(_opts.Unset) > 0 {
+			unset := _opts.Unset.ToVariables()
+			names := make([]string, len(unset))
+			for i, v := range unset {
+				names[i] = v.Name
+			}
+			sort.Strings(names)
+			fmt.Printf("Unset: %s\n", strings.Join(names, ", "))
+		}
+		stdoutTarget, stderrTarget, err := resolveOutputTargets(&_opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Stdout: %s\n", stdoutTarget)
+		fmt.Printf("Stderr: %s\n", stderrTarget)
+		if _opts.TTY {
+			fmt.Println("TTY: pseudo-terminal. Stderr is merged into Stdout and input comes from this terminal")
+		} else {
+			fmt.Println("TTY: none")
+		}
+		fmt.Printf("Rotation: %s\n", _opts.rotationPolicy())
+		fmt.Printf("Restart: %s\n", _opts.restartPolicy())
+		fmt.Printf("Watch: %s\n", _opts.watchPolicy())
+		fmt.Println(launch)
+		if _opts.Timeout > 0 {
+			fmt.Printf("Timeout: %s, then killed after %s\n", _opts.Timeout, _opts.StopGrace)
+		} else {
+			fmt.Println("Timeout: none")
+		}
+		fmt.Println(&_opts.Limits)
+		return
 	}
 
-	// Start making the actual command to run. We assume that all text before a space is the path to the command. Anything else is space-delimited arguments for it
-	cmd := exec.Command(targetCmd, _opts.CommandArgs...)
+	policy := _opts.restartPolicy()
+	if err := policy.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	output, err := openChildOutput(&_opts, _secretValues)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	listEnv(*envProcessed, _opts.DoLogEnv)
+	preparer := &commandPreparer{path: targetCmd, args: _opts.CommandArgs, output: output}
+	prepare := func() (*exec.Cmd, error) {
+		cmd, err := preparer.prepare()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("####--------++--------####")
+		if _opts.DoLogDebug {
+			fmt.Printf("Running Command:\n%s\n", maskSecretsIn(cmd.String()))
+		}
+		return cmd, nil
+	}
 
-	//TODO: Support alternative places to put it? Maybe to a file?
-	if _opts.UseStdOut {
-		cmd.Stdout = os.Stdout
+	sup, err := newCommandSupervisor(filepath.Base(targetCmd), policy, prepare, &_opts)
+	if err != nil {
+		log.Fatal(err)
 	}
-	//TODO: Support alternative places to put it? Maybe to a file?
-	if _opts.UseStdErr {
-		cmd.Stderr = os.Stderr
+	if _opts.Watch {
+		watching := _opts.watchPolicy()
+		if err := watching.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		stopWatching := make(chan struct{})
+		defer close(stopWatching)
+		sup.changes = startWatching(_opts.watchedGlobs, watching, stopWatching)
+		if watching.Action == WATCH_SIGNAL {
+			sup.changeSignal, _ = parseSignal(watching.Signal)
+		}
+		// Only checks the files can be read. The running command's environment stays current until it restarts
+		sup.validate = func() error {
+			prepareLock.Lock()
+			defer prepareLock.Unlock()
+			loaded, err := loadEnv()
+			if err == nil && sup.changeSignal == nil {
+				// Used by the restart that follows rather than reading the files, and running their commands, again
+				preparer.next = loaded
+			}
+			return err
+		}
 	}
 
-	fmt.Println("####--------++--------####")
-	if _opts.IsTest {
-		fmt.Println("Command to run:")
-		fmt.Println(cmd.String())
-		fmt.Printf("Args: %+q\n", strings.Join(cmd.Args, ","))
-		fmt.Printf("Env:\n%+q\n", strings.Join(cmd.Environ(), ","))
-	} else {
-		if _opts.DoLogDebug {
-			fmt.Printf("Running Command:\n%s\n", cmd.String())
+	if _opts.TTY {
+		// Done last as our terminal stays in raw mode until it is closed
+		if preparer.tty, err = newTTYSession(output.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		sup.started = preparer.tty.Started
+		sup.finished = preparer.tty.Finished
+	}
+
+	exitCode, runErr := sup.Run()
+	if preparer.tty != nil {
+		if err := preparer.tty.Close(); err != nil {
+			log.Println(err)
 		}
-		cmd.Run()
 	}
+	preparer.Close()
+	if err := output.Close(); err != nil {
+		log.Println(err)
+	}
+	if runErr != nil {
+		log.Fatal(runErr)
+	}
+	os.Exit(exitCode)
+}
+
+// Puts together the command to run. The processed Environment variables are layered on top of our own environment,
+// without the variables named in unset.
+func buildCommand(targetCmd string, args []string, envProcessed *environment.VariableMap, unset environment.UnsetNames) (*exec.Cmd, error) {
+	// Start making the actual command to run. We assume that all text before a space is the path to the command. Anything else is space-delimited arguments for it
+	cmd := exec.Command(targetCmd, args...)
+
+	envEntries, err := listEnv(envProcessed, _opts.DoLogEnv)
+	if err != nil {
+		return nil, err
+	}
+	switch _opts.InjectMode {
+	case INJECT_OVERRIDE, INJECT_KEEP, INJECT_ONLY:
+	default:
+		return nil, fmt.Errorf("unknown -inject mode '%s'. expecting '%s', '%s' or '%s'", _opts.InjectMode, INJECT_OVERRIDE, INJECT_KEEP, INJECT_ONLY)
+	}
+	inherited := withoutUnset(os.Environ(), unset)
+	switch _opts.InjectMode {
+	case INJECT_ONLY:
+		cmd.Env = *envEntries
+	case INJECT_KEEP:
+		// Our own environment wins over the provided variables
+		cmd.Env = append(*envEntries, inherited...)
+	default:
+		// Provided variables are layered on top of what we were given by our own environment
+		cmd.Env = append(inherited, *envEntries...)
+	}
+	return cmd, nil
+}
+
+// Provides the NAME=value entries that aren't for one of the unset variables
+func withoutUnset(entries []string, unset environment.UnsetNames) []string {
+	kept := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if name, _, _ := strings.Cut(e, "="); !unset[name] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
 }
 
 // func check(e error) {
@@ -250,11 +760,13 @@ func processEnvGlobs(opts *OperationOptions) error {
 
 	// Track our other flags
 	if opts.DoLogDebug {
-		fmt.Println("Globs:")
-		fmt.Println(strings.Join(allGlobs, ", "))
+		fmt.Fprintln(os.Stderr, "Globs:")
+		fmt.Fprintln(os.Stderr, strings.Join(allGlobs, ", "))
 	}
 
-	fmt.Println("Command: ", opts.CommandPath)
+	if !opts.QuietEnv {
+		fmt.Fprintln(os.Stderr, "Command: ", opts.CommandPath)
+	}
 	//fmt.Println("Environment files Glob: ", *envGlobPtr)
 	// fmt.Println("Extra flags: ", flag.Args())
 
@@ -262,7 +774,7 @@ func processEnvGlobs(opts *OperationOptions) error {
 	allPaths := []string{}
 	for _, p := range allGlobs {
 		if opts.DoLogDebug {
-			fmt.Printf("Checking glob: %s\n", p)
+			fmt.Fprintf(os.Stderr, "Checking glob: %s\n", p)
 		}
 		matches, err := filepath.Glob(p)
 		if err != nil {
@@ -279,17 +791,58 @@ func processEnvGlobs(opts *OperationOptions) error {
 				}
 			}
 			if opts.DoLogDebug {
-				fmt.Printf("Found count: %d\n", len(matches))
+				fmt.Fprintf(os.Stderr, "Found count: %d\n", len(matches))
 			}
 		}
 		allPaths = append(allPaths, matches...)
 	}
 
 	// _opts.Globs = allGlobs
-	opts.EnvPaths = allPaths
+	opts.Sources = []environment.Source{}
+	opts.EnvPaths = []string{}
+	if stage := opts.stageLoader(); stage != nil {
+		opts.Sources = append(opts.Sources, stage)
+		opts.EnvPaths = append(opts.EnvPaths, stage.Paths()...)
+	}
+	for _, p := range allPaths {
+		opts.Sources = append(opts.Sources, environment.FileSource{Path: p})
+	}
+	opts.EnvPaths = append(opts.EnvPaths, allPaths...)
 	return nil
 }
 
+// Provides the loader for the stage's cascade of env files. nil if neither -stage nor -env-dir were given
+func (opts *OperationOptions) stageLoader() *environment.StageLoader {
+	if len(opts.Stage) == 0 && len(opts.EnvDir) == 0 {
+		return nil
+	}
+	dir := opts.EnvDir
+	if len(dir) == 0 {
+		dir = "."
+	}
+	return environment.NewStageLoader(dir, opts.Stage)
+}
+
+// Provides the globs for every env file that can affect the Environment, including ones in the stage's cascade
+// that don't exist yet and any files the env files include
+func (opts *OperationOptions) watchedGlobs() []string {
+	globs := []string{}
+	if stage := opts.stageLoader(); stage != nil {
+		globs = append(globs, stage.Candidates()...)
+	}
+	globs = append(globs, opts.Globs...)
+
+	found := []string{}
+	for _, g := range globs {
+		matches, _ := filepath.Glob(g)
+		found = append(found, matches...)
+	}
+	if included, err := environment.IncludedFiles(found...); err == nil {
+		globs = append(globs, included...)
+	}
+	return globs
+}
+
 func processCommandArgs(opts *OperationOptions) error {
 	opts.CommandArgs = make([]string, len(opts.CommandArgsRaw))
 	rEntry := regexp.MustCompile(`^(?:([A-Za-z]{1}[A-Za-z0-9_\-\.]*)[=:]?)?([^\r\n]+)?$`)
@@ -346,6 +899,42 @@ type OperationOptions struct {
 	Globs []string
 	// Paths to the actual Environment files to process
 	EnvPaths []string
+	// Stage whose cascade of env files is loaded before any given by Globs. Ex 'production'
+	Stage string
+	// Directory the stage's env files are in
+	EnvDir string
+	// Where the Environment is loaded from, in order. Built from Stage, EnvDir and Globs
+	Sources []environment.Source
+	// Where each variable was defined the last time the Environment was read
+	Provenance *environment.Provenance
+	// Names of variables to unset after reading the env files
+	UnsetVars CommandArguments
+	// Names of variables that were unset the last time the Environment was read, and are removed from inherited ones
+	Unset environment.UnsetNames
+	// Should values be read from files? See environment.FileRefOptions
+	FileRefs bool
+	// Suffix of variables that hold the path to another variable's value
+	FileRefSuffix string
+	// Largest file that may be read for a value. 0 for no limit
+	FileRefMaxSize byteSize
+	// Directory that files read for values must be in. Any if empty
+	FileRefBaseDir string
+	// Should a trailing newline be kept in values read from files?
+	FileRefKeepNewline bool
+	// Should commands in values be run? Ex '$(git rev-parse HEAD)'
+	Commands bool
+	// Shell and arguments that commands are run with
+	CommandShell string
+	// Longest each command may run
+	CommandTimeout time.Duration
+	// Directory commands run in. The env file's directory if empty
+	CommandDir string
+	// Executables commands may use. Any if empty
+	CommandAllow CommandArguments
+	// Names of the variables from our environment that commands get
+	CommandEnv CommandArguments
+	// Commands that were run the last time the Environment was read. nil if commands weren't allowed
+	CommandRuns *environment.CommandSubstitution
 
 	// Path to the command to execute
 	CommandPath string
@@ -365,6 +954,21 @@ type OperationOptions struct {
 
 	//TODO: Track the Input and Output streams to use. May allow removing some other args?
 
+	// Path to the key file used to decrypt, or encrypt, values
+	KeyPath string
+	// Name of the Environment Variable to read the key from when KeyPath isn't given
+	KeyEnvName string
+	// Path to the key file that values should be re-encrypted with when rotating keys
+	NewKeyPath string
+	// Should a new key be generated at KeyPath if it doesn't exist yet?
+	GenerateKey bool
+	// Names of the variables that should be encrypted or decrypted
+	SecretNames CommandArguments
+	// Names of variables that should always be treated as secret
+	SecretVars CommandArguments
+	// Should secret values be shown instead of masked?
+	ShowSecrets bool
+
 	// Is this just a test run?
 	// If true then the operation requested won't be performed, but all elements of it will be logged as if it were
 	IsTest bool
@@ -376,16 +980,173 @@ type OperationOptions struct {
 	UseStdOut bool
 	// Should the calling shell's Standard Error be used as Standard Error for the called process?
 	UseStdErr bool
+	// Should secret values be redacted from the called process's Standard Out and Standard Error?
+	RedactOutput bool
+	// Where the called process's Standard Out should go. See parseOutputTarget
+	StdoutTarget string
+	// Where the called process's Standard Error should go. See parseOutputTarget
+	StderrTarget string
+	// Should Standard Error be sent to the same place as Standard Out?
+	MergeStdErr bool
+	// Label put at the start of each line of output from the called process
+	OutputLabel string
+	// ANSI color code for OutputLabel. Empty for no color
+	OutputColor string
+	// Shared by processes that run at the same time so their output is written a whole line at a time. nil if there is
+	// only the one process
+	OutputLines *lineSerializer
+	// Should each line of output from the called process start with a timestamp?
+	OutputTimestamps bool
+	// Go time layout for the timestamps
+	TimestampFormat string
+	// Size, in bytes, at which output files are rotated
+	RotateSize byteSize
+	// Interval on which output files are rotated
+	RotateEvery time.Duration
+	// Number of rotated output files to keep
+	RotateKeep int
+	// Should rotated output files be gzipped?
+	RotateCompress bool
+
+	// When the called process should be restarted. See restartPolicy
+	RestartMode string
+	// Delay before the first restart
+	RestartDelay time.Duration
+	// Longest the delay between restarts can grow to
+	RestartMaxDelay time.Duration
+	// Most restarts allowed within RestartWindow
+	MaxRestarts int
+	// Period of time that MaxRestarts applies to
+	RestartWindow time.Duration
+	// Runs at least this long reset the restart delay
+	MinUptime time.Duration
+	// Shell command to run when the called process fails
+	OnCrash string
+	// How long the called process gets to exit after being asked to stop before it is killed
+	StopGrace time.Duration
+
+	// Working directory for the called process. May refer to Environment Variables
+	WorkingDir string
+	// Should our Standard Input be passed on to the called process?
+	PassStdin bool
+	// Path to a file to use as the called process's Standard Input
+	StdinPath string
+	// Longest the called process may run for each time it is started. 0 means no limit
+	Timeout time.Duration
+	// File mode creation mask for the called process, in octal. Empty to leave it as it is
+	Umask string
+
+	// Should the called process be run on a pseudo-terminal?
+	TTY bool
+	// Resource limits and scheduling settings for the called process
+	Limits resourceLimits
+	// Path to a file that provides any Limits not given by flags
+	LimitsPath string
+
+	// Should the env files be watched for changes?
+	Watch bool
+	// How often the env files are checked for changes
+	WatchInterval time.Duration
+	// How long the env files must stay unchanged before acting on a change
+	WatchDebounce time.Duration
+	// What to do when the env files change. See watchPolicy
+	WatchAction string
+	// Signal to send when WatchAction is WATCH_SIGNAL
+	WatchSignal string
+
+	// Path to the Procfile listing the processes to run
+	ProcfilePath string
+	// What happens when one of the Procfile's processes exits. ON_EXIT_STOP or ON_EXIT_CONTINUE
+	OnExit string
+	// Should process labels be left uncolored?
+	NoColor bool
+
+	// Shell to start, or write commands for. Defaults to $SHELL
+	ShellPath string
+	// Label shown in the shell's prompt
+	ShellLabel string
+	// Commands to run once the shell has started
+	ShellInit CommandArguments
+	// How variables from the env files are given to commands. INJECT_OVERRIDE, INJECT_KEEP or INJECT_ONLY
+	InjectMode string
+	// Name of the profile to use from the project config
+	ProfileName string
+	// Path to the project config. Found automatically if empty
+	ConfigPath string
+	// Should export write the commands that remove the variables instead?
+	ExportUnset bool
+	// Names of the variables to explain. All of them if empty
+	ExplainNames CommandArguments
+	// Should the processed environment be left out of the output?
+	QuietEnv bool
+	// Should variables be sorted by name? They're in the order they were defined otherwise
+	SortVars bool
+	// Changes made to the environment once it's read, in the order they're applied. Ex '-only LOGSTASH_*'
+	Transforms []envTransform
+	// What -merge does with conflicting values. One of the environment.MERGE_* strategies
+	MergeConflict string
+}
+
+// Provides the policy for watching the env files
+func (opts *OperationOptions) watchPolicy() watchPolicy {
+	return watchPolicy{
+		Enabled:  opts.Watch,
+		Interval: opts.WatchInterval,
+		Debounce: opts.WatchDebounce,
+		Action:   opts.WatchAction,
+		Signal:   opts.WatchSignal,
+	}
+}
+
+// Provides the restart policy for the called process
+func (opts *OperationOptions) restartPolicy() restartPolicy {
+	return restartPolicy{
+		Mode:        opts.RestartMode,
+		Delay:       opts.RestartDelay,
+		MaxDelay:    opts.RestartMaxDelay,
+		MaxRestarts: opts.MaxRestarts,
+		Window:      opts.RestartWindow,
+		MinUptime:   opts.MinUptime,
+		OnCrash:     opts.OnCrash,
+	}
+}
+
+// Provides the rotation policy for output files
+func (opts *OperationOptions) rotationPolicy() rotationPolicy {
+	return rotationPolicy{
+		MaxSize:  int64(opts.RotateSize),
+		Interval: opts.RotateEvery,
+		Keep:     opts.RotateKeep,
+		Compress: opts.RotateCompress,
+	}
 }
 
 func CreateDefaultOperationOptions() OperationOptions {
 	opts := OperationOptions{
-		CommandPath: "",
-		IsTest:      false,
-		DoLogDebug:  false,
-		DoLogEnv:    false,
-		UseStdOut:   true,
-		UseStdErr:   true,
+		CommandPath:     "",
+		CommandTimeout:  environment.COMMAND_TIMEOUT,
+		KeyEnvName:      environment.ENCRYPTION_KEY_ENV,
+		IsTest:          false,
+		DoLogDebug:      false,
+		DoLogEnv:        false,
+		UseStdOut:       true,
+		UseStdErr:       true,
+		TimestampFormat: time.RFC3339,
+		RotateKeep:      5,
+		FileRefMaxSize:  environment.FILE_REF_MAX_SIZE,
+		RestartMode:     RESTART_NO,
+		RestartDelay:    time.Second,
+		RestartMaxDelay: time.Minute,
+		RestartWindow:   10 * time.Minute,
+		MinUptime:       10 * time.Second,
+		StopGrace:       10 * time.Second,
+		WatchInterval:   time.Second,
+		WatchDebounce:   500 * time.Millisecond,
+		WatchAction:     WATCH_RESTART,
+		WatchSignal:     "HUP",
+		ProcfilePath:    "Procfile",
+		OnExit:          ON_EXIT_STOP,
+		InjectMode:      INJECT_OVERRIDE,
 	}
 	return opts
 }
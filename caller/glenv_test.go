@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFailedReadKeepsCurrentEnv(t *testing.T) {
+	_opts = CreateDefaultOperationOptions()
+	_opts.QuietEnv = true
+	t.Cleanup(func() { _opts = CreateDefaultOperationOptions() })
+	t.Setenv("GLENV_TEST_INHERITED", "from outside")
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app.env": "A=1\nunset GLENV_TEST_INHERITED\n"})
+	_opts.Globs = []string{filepath.Join(dir, "app.env")}
+	lastEnv, err := loadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	useEnv(lastEnv)
+
+	// A read that fails part of the way through changes nothing
+	writeFiles(t, dir, map[string]string{"app.env": "B=2\nC=$MISSING\n"})
+	if _, err := loadEnv(); err == nil {
+		t.Fatal("want the read to fail")
+	}
+	if !_opts.Unset["GLENV_TEST_INHERITED"] || _opts.Provenance != lastEnv.Provenance {
+		t.Fatalf("want the last good read still current, got unset %v", _opts.Unset)
+	}
+
+	cmd, err := buildCommand("true", nil, lastEnv.Vars, lastEnv.Unset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range cmd.Env {
+		if strings.HasPrefix(e, "GLENV_TEST_INHERITED=") {
+			t.Fatal("want the variable the env file unset kept out of the command")
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+const (
+	// Holds what the hook loaded into the shell, so it can be unloaded again
+	HOOK_STATE_ENV = "GLENV_HOOK_STATE"
+	// Holds the directory and hash that the hook last refused to load, so the shell is only told about it once
+	HOOK_BLOCKED_ENV = "GLENV_HOOK_BLOCKED"
+)
+
+// Names of the env files that are discovered, in the order they are loaded
+var discoveredFileNames = []string{".env", ".glenv"}
+
+// Finds the nearest directory, starting at start and walking up, that has any of the discoveredFileNames in it.
+// Returns the directory and the env files in it. dir is empty if none was found.
+func discoverEnvFiles(start string) (dir string, files []string, err error) {
+	dir, err = filepath.Abs(start)
+	if err != nil {
+		return "", nil, err
+	}
+	for {
+		for _, name := range discoveredFileNames {
+			path := filepath.Join(dir, name)
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				files = append(files, path)
+			}
+		}
+		if len(files) > 0 {
+			return dir, files, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Hashes the paths and contents of the files, and any files they include. Any change to them gives a different hash
+func hashEnvFiles(files []string) (string, error) {
+	files, err := environment.IncludedFiles(files...)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Path to the list of directories whose env files have been reviewed and may be loaded by the hook
+func allowListPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "glenv", "allow"), nil
+}
+
+// Reads the allow list. Each line is "<hash> <directory>". Returns the hash allowed for each directory
+func readAllowList() (map[string]string, error) {
+	path, err := allowListPath()
+	if err != nil {
+		return nil, err
+	}
+	allowed := map[string]string{}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return allowed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if hash, dir, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " "); ok {
+			allowed[dir] = hash
+		}
+	}
+	return allowed, scanner.Err()
+}
+
+func writeAllowList(allowed map[string]string) error {
+	path, err := allowListPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	dirs := make([]string, 0, len(allowed))
+	for d := range allowed {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	sb := strings.Builder{}
+	for _, d := range dirs {
+		sb.WriteString(fmt.Sprintf("%s %s\n", allowed[d], d))
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0600)
+}
+
+// Trusts, or stops trusting, the env files that are discovered from the directory given on the command line.
+// Defaults to the current directory. Files are only trusted as they are now. Any later edit needs allowing again.
+func allowAction(allow bool) {
+	start := "."
+	if len(_opts.Globs) > 0 {
+		start = _opts.Globs[0]
+	}
+	dir, files, err := discoverEnvFiles(start)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(dir) == 0 {
+		log.Fatalf("no %s files found in %s or any directory above it", strings.Join(discoveredFileNames, " or "), start)
+	}
+	allowed, err := readAllowList()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if allow {
+		hash, err := hashEnvFiles(files)
+		if err != nil {
+			log.Fatal(err)
+		}
+		allowed[dir] = hash
+		fmt.Fprintf(os.Stderr, "allowed %s\n", strings.Join(files, ", "))
+	} else {
+		delete(allowed, dir)
+		fmt.Fprintf(os.Stderr, "denied %s\n", dir)
+	}
+	if err := writeAllowList(allowed); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// What the hook has loaded into a shell
+type hookState struct {
+	// Directory the env files were found in
+	Dir string
+	// Hash of the env files as they were loaded
+	Hash string
+	// Value each loaded variable had before it was loaded. nil if it wasn't set
+	Previous map[string]*string
+}
+
+func (hs *hookState) encode() (string, error) {
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Reads the state from HOOK_STATE_ENV. Returns nil if nothing has been loaded
+func currentHookState() *hookState {
+	encoded := os.Getenv(HOOK_STATE_ENV)
+	if len(encoded) == 0 {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	var hs hookState
+	if err := json.Unmarshal(data, &hs); err != nil {
+		return nil
+	}
+	return &hs
+}
+
+// Shell commands that set and unset variables. The last change made to each variable wins
+type shellChanges struct {
+	set   environment.VariableMap
+	unset map[string]bool
+}
+
+func (sc *shellChanges) Set(name string, value string) {
+	sc.set.Set(name, value)
+	delete(sc.unset, name)
+}
+
+func (sc *shellChanges) Unset(name string) {
+	if sc.unset == nil {
+		sc.unset = map[string]bool{}
+	}
+	sc.unset[name] = true
+	sc.set.Unset(name)
+}
+
+// Writes the commands for shell to w
+func (sc *shellChanges) Write(w io.Writer, shell string) error {
+	setBuilder, err := environment.NewShellDefinitionBuilder(shell)
+	if err != nil {
+		return err
+	}
+	unsetBuilder, err := environment.NewShellUnsetBuilder(shell)
+	if err != nil {
+		return err
+	}
+	unset := environment.Variables{}
+	for name := range sc.unset {
+		unset = append(unset, environment.Variable{Name: name})
+	}
+	set := *sc.set.ToVariables()
+	sort.Slice(unset, func(i, j int) bool { return unset[i].Name < unset[j].Name })
+	sort.Slice(set, func(i, j int) bool { return set[i].Name < set[j].Name })
+	_, err = fmt.Fprint(w, unsetBuilder.BuildString(unset), setBuilder.BuildString(set))
+	return err
+}
+
+// Run by the shell hook before each prompt. Writes the commands that bring the shell's environment in line with the
+// env files discovered from the current directory. Nothing is written if nothing has changed.
+// Variables loaded for a directory are put back the way they were once the shell leaves it.
+func hookEnvAction() {
+	shell := exportShell(&_opts)
+	changes := shellChanges{}
+	// Environment as it would be without anything the hook loaded
+	base := map[string]*string{}
+	for _, e := range os.Environ() {
+		if k, v, ok := strings.Cut(e, "="); ok {
+			value := v
+			base[k] = &value
+		}
+	}
+
+	dir, files, err := discoverEnvFiles(".")
+	if err != nil {
+		log.Fatal(err)
+	}
+	hash := ""
+	if len(dir) > 0 {
+		if hash, err = hashEnvFiles(files); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	state := currentHookState()
+	if state != nil && state.Dir == dir && state.Hash == hash {
+		// Already loaded
+		return
+	}
+	if state != nil {
+		for name, previous := range state.Previous {
+			if previous == nil {
+				changes.Unset(name)
+			} else {
+				changes.Set(name, *previous)
+			}
+			base[name] = previous
+		}
+		changes.Unset(HOOK_STATE_ENV)
+		fmt.Fprintf(os.Stderr, "glenv: unloaded %s\n", state.Dir)
+	}
+
+	// Directory and hash that can't be loaded right now. Empty if there isn't one
+	blocked := ""
+	if len(dir) > 0 {
+		loaded, err := loadDiscovered(dir, hash, files)
+		if err != nil {
+			blocked = dir + ":" + hash
+			if os.Getenv(HOOK_BLOCKED_ENV) != blocked {
+				fmt.Fprintf(os.Stderr, "glenv: %s\n", err)
+				changes.Set(HOOK_BLOCKED_ENV, blocked)
+			}
+		} else {
+			next := hookState{Dir: dir, Hash: hash, Previous: map[string]*string{}}
+			loaded.Range(func(name, value string) bool {
+				next.Previous[name] = base[name]
+				changes.Set(name, value)
+				return true
+			})
+			for name := range _opts.Unset {
+				next.Previous[name] = base[name]
+				changes.Unset(name)
+			}
+			encoded, err := next.encode()
+			if err != nil {
+				log.Fatal(err)
+			}
+			changes.Set(HOOK_STATE_ENV, encoded)
+			fmt.Fprintf(os.Stderr, "glenv: loaded %s\n", strings.Join(files, ", "))
+		}
+	}
+
+	if _, wasBlocked := os.LookupEnv(HOOK_BLOCKED_ENV); wasBlocked && len(blocked) == 0 {
+		// Warn again next time
+		changes.Unset(HOOK_BLOCKED_ENV)
+	}
+
+	if err := changes.Write(os.Stdout, shell); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Reads the discovered env files, as long as they have been allowed as they are now
+func loadDiscovered(dir string, hash string, files []string) (*environment.VariableMap, error) {
+	allowed, err := readAllowList()
+	if err != nil {
+		return nil, err
+	}
+	if allowedHash, ok := allowed[dir]; !ok {
+		return nil, fmt.Errorf("%s isn't allowed yet. review it, then run 'glenv allow %s'", strings.Join(files, ", "), dir)
+	} else if allowedHash != hash {
+		return nil, fmt.Errorf("%s changed since it was allowed. review it, then run 'glenv allow %s'", strings.Join(files, ", "), dir)
+	}
+	_opts.Globs = files
+	return readEnv()
+}
+
+// Provides the script that installs the hook in shell. Evaluating it in the shell's startup file turns it on.
+// Ex eval "$(glenv hook bash)"
+func hookScript(shell string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	switch strings.TrimSuffix(filepath.Base(shell), ".exe") {
+	case "bash":
+		return fmt.Sprintf(`_glenv_hook() {
+  local previous_exit_status=$?
+  eval "$(%s hook-env -shell bash)"
+  return $previous_exit_status
+}
+if [[ ";${PROMPT_COMMAND[*]:-};" != *";_glenv_hook;"* ]]; then
+  PROMPT_COMMAND="_glenv_hook${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+fi
+`, environment.QuotePosix(self)), nil
+	case "zsh":
+		return fmt.Sprintf(`_glenv_hook() {
+  eval "$(%s hook-env -shell zsh)"
+}
+typeset -ag precmd_functions
+if (( ! ${precmd_functions[(I)_glenv_hook]} )); then
+  precmd_functions=(_glenv_hook $precmd_functions)
+fi
+typeset -ag chpwd_functions
+if (( ! ${chpwd_functions[(I)_glenv_hook]} )); then
+  chpwd_functions=(_glenv_hook $chpwd_functions)
+fi
+`, environment.QuotePosix(self)), nil
+	case "fish":
+		return fmt.Sprintf(`function __glenv_hook --on-event fish_prompt
+    %s hook-env -shell fish | source
+end
+`, environment.QuoteFish(self)), nil
+	}
+	return "", fmt.Errorf("unsupported shell '%s' for hook. expecting 'bash', 'zsh' or 'fish'", shell)
+}
+
+// Writes the hook script for the shell named on the command line
+func hookAction() {
+	if len(_opts.Globs) != 1 {
+		log.Fatal("expected the shell to hook into. Ex 'glenv hook bash'")
+	}
+	script, err := hookScript(_opts.Globs[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(script)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHookStateRoundTrip(t *testing.T) {
+	previous := "old value"
+	state := &hookState{Dir: "/work/project", Hash: "abc123", Previous: map[string]*string{"HOST": &previous, "NEW": nil}}
+	encoded, err := state.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(HOOK_STATE_ENV, encoded)
+	if got := currentHookState(); !reflect.DeepEqual(got, state) {
+		t.Fatalf("want %+v, got %+v", state, got)
+	}
+
+	// Missing or mangled state is treated as nothing having been loaded
+	for _, encoded := range []string{"", "not base64!", "bm90IGpzb24="} {
+		t.Setenv(HOOK_STATE_ENV, encoded)
+		if got := currentHookState(); got != nil {
+			t.Fatalf("'%s': want no state, got %+v", encoded, got)
+		}
+	}
+}
+
+// Creates each of the files under dir, along with the directories they are in
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiscoverEnvFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".env":              "A=root\n",
+		"app/.glenv":        "A=app\n",
+		"app/.env":          "B=app\n",
+		"app/src/deep/keep": "",
+		"other/.env/keep":   "",
+	})
+
+	tests := []struct {
+		start string
+		dir   string
+		files []string
+	}{
+		// The nearest directory wins, with its files in load order
+		{"app/src/deep", "app", []string{"app/.env", "app/.glenv"}},
+		{"app", "app", []string{"app/.env", "app/.glenv"}},
+		{".", ".", []string{".env"}},
+		// Only regular files count, so other's .env directory is walked past
+		{"other", ".", []string{".env"}},
+	}
+	for _, tt := range tests {
+		dir, files, err := discoverEnvFiles(filepath.Join(root, tt.start))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantFiles := []string{}
+		for _, f := range tt.files {
+			wantFiles = append(wantFiles, filepath.Join(root, f))
+		}
+		if dir != filepath.Join(root, tt.dir) || !reflect.DeepEqual(files, wantFiles) {
+			t.Fatalf("%s: want %s %v, got %s %v", tt.start, tt.dir, wantFiles, dir, files)
+		}
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	// Keep the allow list away from the real one
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("HOME", config)
+	t.Setenv("AppData", config)
+	savedOpts := _opts
+	t.Cleanup(func() { _opts = savedOpts })
+	_opts = CreateDefaultOperationOptions()
+	// The same as hook-env
+	_opts.QuietEnv = true
+
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"app/.env":       "# @include ../shared.env\nA=app\n",
+		"shared.env":     "B=shared\n",
+		"app/sub/ignore": "",
+	})
+	dir, files, _ := discoverEnvFiles(filepath.Join(root, "app", "sub"))
+	hash, err := hashEnvFiles(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDiscovered(dir, hash, files); err == nil || !strings.Contains(err.Error(), "isn't allowed yet") {
+		t.Fatalf("want files refused until allowed, got %v", err)
+	}
+
+	// Allowing from anywhere below the directory allows the directory
+	_opts.Globs = []string{filepath.Join(root, "app", "sub")}
+	allowAction(true)
+	allowed, err := readAllowList()
+	if err != nil || allowed[dir] != hash {
+		t.Fatalf("want %s allowed with hash %s, got %v %v", dir, hash, allowed, err)
+	}
+	loaded, err := loadDiscovered(dir, hash, files)
+	if err != nil || loaded.Get("A") != "app" || loaded.Get("B") != "shared" {
+		t.Fatalf("want the files loaded once allowed, got %v %v", loaded, err)
+	}
+
+	// Editing an included file gives a new hash, which needs allowing again
+	writeFiles(t, root, map[string]string{"shared.env": "B=edited\n"})
+	changed, _ := hashEnvFiles(files)
+	if changed == hash {
+		t.Fatal("want a different hash once an included file changes")
+	}
+	if _, err := loadDiscovered(dir, changed, files); err == nil || !strings.Contains(err.Error(), "changed since it was allowed") {
+		t.Fatalf("want changed files refused, got %v", err)
+	}
+
+	_opts.Globs = []string{dir}
+	allowAction(false)
+	if allowed, _ := readAllowList(); len(allowed) != 0 {
+		t.Fatalf("want nothing allowed once denied, got %v", allowed)
+	}
+}
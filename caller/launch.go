@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// Settings for how the called process is started, beyond its command line and environment
+type launchSettings struct {
+	// Working directory for the process. Empty to use glenv's own
+	Dir string
+	// Should glenv's Standard Input be passed through to the process?
+	PassStdin bool
+	// File to use as the process's Standard Input. Empty if there isn't one
+	StdinPath string
+	// File mode creation mask for the process. Negative to leave it as it is
+	Umask int
+}
+
+// Works out the launch settings from opts. Paths may refer to Environment Variables, which are expanded using env
+// along with glenv's own environment.
+func resolveLaunchSettings(opts *OperationOptions, env *environment.VariableMap) (settings launchSettings, err error) {
+	if settings.Umask, err = parseUmask(opts.Umask); err != nil {
+		return settings, err
+	}
+
+	if len(opts.WorkingDir) > 0 {
+		if settings.Dir, err = expandWithOSEnv(opts.WorkingDir, env); err != nil {
+			return settings, fmt.Errorf("-cwd: %w", err)
+		}
+		if info, err := os.Stat(settings.Dir); err != nil {
+			return settings, fmt.Errorf("-cwd: %w", err)
+		} else if !info.IsDir() {
+			return settings, fmt.Errorf("-cwd: '%s' is not a directory", settings.Dir)
+		}
+	}
+
+	if opts.PassStdin && len(opts.StdinPath) > 0 {
+		return settings, errors.New("-stdin and -stdin-file can't be used together")
+	}
+	settings.PassStdin = opts.PassStdin
+	if len(opts.StdinPath) > 0 {
+		if settings.StdinPath, err = expandWithOSEnv(opts.StdinPath, env); err != nil {
+			return settings, fmt.Errorf("-stdin-file: %w", err)
+		}
+	}
+	return settings, nil
+}
+
+// The file mode creation mask belongs to the whole process, so setting it for a command also changes it for the rest of
+// glenv until it is put back. Taken for writing while a command is started with its own mask, so starts don't overlap.
+// Taken for reading while glenv creates files, such as output files being rotated, so they never get the command's mask.
+var umaskLock sync.RWMutex
+
+// Reads an octal file mode creation mask. Ex '022'. Empty text gives -1, meaning the mask is left as it is.
+func parseUmask(text string) (int, error) {
+	if len(text) == 0 {
+		return -1, nil
+	}
+	mask, err := strconv.ParseUint(text, 8, 32)
+	if err != nil || mask > 0777 {
+		return -1, fmt.Errorf("invalid umask '%s'. expecting an octal value such as 022", text)
+	}
+	return int(mask), nil
+}
+
+// Expands any variables in value using env, falling back on glenv's own environment for anything env doesn't have
+func expandWithOSEnv(value string, env *environment.VariableMap) (string, error) {
+	lookup := environment.NewVariableMap()
+	for _, e := range os.Environ() {
+		if k, v, ok := strings.Cut(e, "="); ok {
+			lookup.Set(k, v)
+		}
+	}
+	env.Range(func(k, v string) bool {
+		lookup.Set(k, v)
+		return true
+	})
+	expanded, done, missing := environment.ExpandVarString(value, lookup)
+	if !done {
+		return "", fmt.Errorf("'%s' refers to unknown variables: %v", value, missing)
+	}
+	return expanded, nil
+}
+
+// Applies the settings to cmd. Returns anything that needs to be closed once the command has finished.
+func (ls launchSettings) apply(cmd *exec.Cmd) (io.Closer, error) {
+	cmd.Dir = ls.Dir
+	if ls.PassStdin {
+		cmd.Stdin = os.Stdin
+	}
+	if len(ls.StdinPath) > 0 {
+		f, err := os.Open(ls.StdinPath)
+		if err != nil {
+			return nil, fmt.Errorf("-stdin-file: %w", err)
+		}
+		cmd.Stdin = f
+		return f, nil
+	}
+	return nil, nil
+}
+
+// Describes the settings in a human readable way, one per line
+func (ls launchSettings) String() string {
+	sb := strings.Builder{}
+	dir := ls.Dir
+	if len(dir) == 0 {
+		dir, _ = os.Getwd()
+		dir += " (current)"
+	}
+	sb.WriteString(fmt.Sprintf("Working directory: %s\n", dir))
+	switch {
+	case ls.PassStdin:
+		sb.WriteString("Stdin: terminal\n")
+	case len(ls.StdinPath) > 0:
+		sb.WriteString(fmt.Sprintf("Stdin: file %s\n", ls.StdinPath))
+	default:
+		sb.WriteString("Stdin: none\n")
+	}
+	if ls.Umask >= 0 {
+		sb.WriteString(fmt.Sprintf("Umask: %03o", ls.Umask))
+	} else {
+		sb.WriteString("Umask: inherited")
+	}
+	return sb.String()
+}
+
+// Reading the env files changes what glenv reports on and masks, so only one command is prepared at a time
+var prepareLock sync.Mutex
+
+// Builds each run of a command for a supervisor. The env files are read again for every run so restarts pick up any
+// changes, falling back on the last environment that could be read. Used by exec, and by run for each of its processes
+type commandPreparer struct {
+	// Path to the command and its arguments
+	path string
+	args []string
+	// Where the command's output goes
+	output *childOutput
+	// Changes the environment just for this command. nil to use it as it is. Ex a Procfile entry's overrides
+	adjust func(env *environment.VariableMap) (*environment.VariableMap, error)
+	// Pseudo-terminal the command runs on. nil unless -tty was given
+	tty *ttySession
+
+	// Environment to use for the next run rather than reading the files again. Ex one read while checking a change
+	next *loadedEnv
+	// Environment from the last time the files were read successfully
+	last *loadedEnv
+	// Stdin file given to the last run of the command
+	stdin io.Closer
+}
+
+// Provides the command for the next run, with the current environment, launch settings, limits and output
+func (cp *commandPreparer) prepare() (*exec.Cmd, error) {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+
+	loaded := cp.next
+	cp.next = nil
+	var err error
+	if loaded == nil {
+		loaded, err = loadEnv()
+	}
+	if err != nil {
+		if cp.last == nil {
+			return nil, err
+		}
+		log.Printf("failed to read environment, keeping the previous one: %s", err)
+		loaded = cp.last
+	}
+	cp.last = loaded
+	env := useEnv(loaded)
+	if cp.adjust != nil {
+		if env, err = cp.adjust(env); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd, err := buildCommand(cp.path, cp.args, env, loaded.Unset)
+	if err != nil {
+		return nil, err
+	}
+	launch, err := resolveLaunchSettings(&_opts, env)
+	if err != nil {
+		return nil, err
+	}
+	cp.Close()
+	if cp.stdin, err = launch.apply(cmd); err != nil {
+		return nil, err
+	}
+	if err := _opts.Limits.Apply(cmd); err != nil {
+		return nil, err
+	}
+	cp.output.UpdateSecrets(_secretValues)
+	cmd.Stdout = cp.output.Stdout
+	cmd.Stderr = cp.output.Stderr
+	if cp.tty != nil {
+		// Output is copied from the terminal to the same place
+		if err := cp.tty.Prepare(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+// Closes the Standard Input file given to the last run, if there was one
+func (cp *commandPreparer) Close() {
+	if cp.stdin != nil {
+		cp.stdin.Close()
+		cp.stdin = nil
+	}
+}
+
+// Creates a supervisor for a command with the timeout, umask and stop grace given by opts
+func newCommandSupervisor(name string, policy restartPolicy, prepare func() (*exec.Cmd, error), opts *OperationOptions) (*supervisor, error) {
+	sup := newSupervisor(name, policy, prepare)
+	sup.stopGrace = opts.StopGrace
+	sup.timeout = opts.Timeout
+	var err error
+	if sup.umask, err = parseUmask(opts.Umask); err != nil {
+		return nil, err
+	}
+	return sup, nil
+}
+
+// Reads any limits from opts.LimitsPath that weren't given by flags, then makes sure they can be used
+func loadLimits(opts *OperationOptions) error {
+	if len(opts.LimitsPath) > 0 {
+		if err := opts.Limits.ReadFile(opts.LimitsPath); err != nil {
+			return err
+		}
+	}
+	return opts.Limits.Validate()
+}
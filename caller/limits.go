@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// Resource limit that means there is no limit
+const LIMIT_UNLIMITED = ^uint64(0)
+
+// A resource limit given through a flag or limits file. Only applied if it has been Given
+type limitValue struct {
+	Value uint64
+	Given bool
+	// Is the value a size in bytes? Sizes may use suffixes. Ex '512M'
+	Size bool
+}
+
+func (l *limitValue) String() string {
+	if l == nil || !l.Given {
+		return ""
+	}
+	if l.Value == LIMIT_UNLIMITED {
+		return "unlimited"
+	}
+	return strconv.FormatUint(l.Value, 10)
+}
+
+func (l *limitValue) Set(value string) error {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.EqualFold(value, "unlimited") || strings.EqualFold(value, "infinity"):
+		l.Value = LIMIT_UNLIMITED
+	case l.Size:
+		size, err := parseByteSize(value)
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			return fmt.Errorf("invalid limit '%s'", value)
+		}
+		l.Value = uint64(size)
+	default:
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit '%s'. expecting a whole number or 'unlimited'", value)
+		}
+		l.Value = n
+	}
+	l.Given = true
+	return nil
+}
+
+// An int given through a flag or limits file. Only applied if it has been Given
+type optionalInt struct {
+	Value int
+	Given bool
+}
+
+func (o *optionalInt) String() string {
+	if o == nil || !o.Given {
+		return ""
+	}
+	return strconv.Itoa(o.Value)
+}
+
+func (o *optionalInt) Set(value string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("invalid number '%s'", value)
+	}
+	o.Value = n
+	o.Given = true
+	return nil
+}
+
+// Limits and scheduling settings that contain the called process
+type resourceLimits struct {
+	// Largest the process's virtual memory may grow to, in bytes
+	AddressSpace limitValue
+	// CPU time the process may use, in seconds
+	CPUSeconds limitValue
+	// Most files the process may have open at once
+	OpenFiles limitValue
+	// Largest core dump the process may write, in bytes. 0 turns them off
+	CoreSize limitValue
+	// Most processes the user may have running at once
+	Processes limitValue
+	// Scheduling priority, from -20 (highest) to 19 (lowest)
+	Nice optionalInt
+	// IO scheduling class and level. Ex 'idle' or 'best-effort:7'
+	IOPriority string
+	// Should the process be started in its own process group?
+	NewProcessGroup bool
+	// Should the process be started in its own session?
+	NewSession bool
+}
+
+// Options for containing the called process. Used by exec and the hidden subcommand that applies them.
+func addLimitOptions(targetFlag *flag.FlagSet, limits *resourceLimits) {
+	limits.AddressSpace.Size = true
+	limits.CoreSize.Size = true
+	targetFlag.Var(&limits.AddressSpace, "limit-as", "Largest the command's virtual memory may grow to. Ex '2G'. Linux only")
+	targetFlag.Var(&limits.CPUSeconds, "limit-cpu", "Seconds of CPU time the command may use before it is killed. Linux only")
+	targetFlag.Var(&limits.OpenFiles, "limit-nofile", "Most files the command may have open at once. Linux only")
+	targetFlag.Var(&limits.CoreSize, "limit-core", "Largest core dump the command may write. 0 turns them off. Linux only")
+	targetFlag.Var(&limits.Processes, "limit-nproc", "Most processes the command's user may have running at once. Linux only")
+	targetFlag.Var(&limits.Nice, "nice", "Scheduling priority for the command, from -20 (highest) to 19 (lowest). Linux only")
+	targetFlag.StringVar(&limits.IOPriority, "ionice", "", "IO scheduling class for the command, with an optional level from 0 to 7. One of 'realtime', 'best-effort' or 'idle'. Ex 'best-effort:7'. Linux only")
+	targetFlag.BoolVar(&limits.NewProcessGroup, "new-pgroup", false, "True if the command should be started in its own process group")
+	targetFlag.BoolVar(&limits.NewSession, "new-session", false, "True if the command should be started in its own session")
+}
+
+// Fills in anything that wasn't given by a flag from the limits file at path.
+// The file uses the same format as env files, with the flag names as keys. Ex 'LIMIT_NOFILE=1024' or 'NEW_PGROUP=true'
+func (rl *resourceLimits) ReadFile(path string) error {
+	values := environment.NewVariableMap()
+	if err := environment.ProcessEnvironmentFileWith(path, values, environment.ProcessOptions{}); err != nil {
+		return err
+	}
+
+	for _, k := range values.SortedNames() {
+		v := values.Get(k)
+		var err error
+		switch k {
+		case "LIMIT_AS":
+			err = setUnlessGiven(&rl.AddressSpace, v)
+		case "LIMIT_CPU":
+			err = setUnlessGiven(&rl.CPUSeconds, v)
+		case "LIMIT_NOFILE":
+			err = setUnlessGiven(&rl.OpenFiles, v)
+		case "LIMIT_CORE":
+			err = setUnlessGiven(&rl.CoreSize, v)
+		case "LIMIT_NPROC":
+			err = setUnlessGiven(&rl.Processes, v)
+		case "NICE":
+			if !rl.Nice.Given {
+				err = rl.Nice.Set(v)
+			}
+		case "IONICE":
+			if len(rl.IOPriority) == 0 {
+				rl.IOPriority = v
+			}
+		case "NEW_PGROUP":
+			var b bool
+			b, err = strconv.ParseBool(v)
+			rl.NewProcessGroup = rl.NewProcessGroup || b
+		case "NEW_SESSION":
+			var b bool
+			b, err = strconv.ParseBool(v)
+			rl.NewSession = rl.NewSession || b
+		default:
+			err = errors.New("unknown setting")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, k, err)
+		}
+	}
+	return nil
+}
+
+func setUnlessGiven(l *limitValue, value string) error {
+	if l.Given {
+		return nil
+	}
+	return l.Set(value)
+}
+
+// Makes sure the settings are usable
+func (rl *resourceLimits) Validate() error {
+	if rl.Nice.Given && (rl.Nice.Value < -20 || rl.Nice.Value > 19) {
+		return fmt.Errorf("nice must be between -20 and 19, not %d", rl.Nice.Value)
+	}
+	if len(rl.IOPriority) > 0 {
+		if _, _, err := parseIOPriority(rl.IOPriority); err != nil {
+			return err
+		}
+	}
+	if rl.NewProcessGroup && rl.NewSession {
+		return errors.New("-new-pgroup and -new-session can't be used together. a new session is always a new process group")
+	}
+	if rl.needsShim() {
+		return limitsSupported()
+	}
+	return nil
+}
+
+// Do any settings need to be applied from within the called process before it starts?
+func (rl *resourceLimits) needsShim() bool {
+	return rl.AddressSpace.Given || rl.CPUSeconds.Given || rl.OpenFiles.Given || rl.CoreSize.Given || rl.Processes.Given ||
+		rl.Nice.Given || len(rl.IOPriority) > 0
+}
+
+// IO scheduling classes by name
+var ioPriorityClasses = map[string]int{"realtime": 1, "rt": 1, "best-effort": 2, "be": 2, "idle": 3}
+
+// Reads an IO priority such as 'best-effort:7'. The level defaults to 4, and is ignored for 'idle'
+func parseIOPriority(text string) (class int, level int, err error) {
+	name, levelText, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(text)), ":")
+	class, ok := ioPriorityClasses[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown ionice class '%s'. expecting 'realtime', 'best-effort' or 'idle'", name)
+	}
+	level = 4
+	if hasLevel {
+		if level, err = strconv.Atoi(levelText); err != nil || level < 0 || level > 7 {
+			return 0, 0, fmt.Errorf("ionice level must be between 0 and 7, not '%s'", levelText)
+		}
+	}
+	if class == 3 {
+		level = 0
+	}
+	return class, level, nil
+}
+
+// Describes the settings in a human readable way, one per line
+func (rl *resourceLimits) String() string {
+	describe := func(l limitValue, unit string) string {
+		if !l.Given {
+			return "inherited"
+		}
+		if l.Value == LIMIT_UNLIMITED {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d%s", l.Value, unit)
+	}
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("Limit address space: %s\n", describe(rl.AddressSpace, " bytes")))
+	sb.WriteString(fmt.Sprintf("Limit CPU: %s\n", describe(rl.CPUSeconds, "s")))
+	sb.WriteString(fmt.Sprintf("Limit open files: %s\n", describe(rl.OpenFiles, "")))
+	sb.WriteString(fmt.Sprintf("Limit core size: %s\n", describe(rl.CoreSize, " bytes")))
+	sb.WriteString(fmt.Sprintf("Limit processes: %s\n", describe(rl.Processes, "")))
+	if rl.Nice.Given {
+		sb.WriteString(fmt.Sprintf("Nice: %d\n", rl.Nice.Value))
+	} else {
+		sb.WriteString("Nice: inherited\n")
+	}
+	if len(rl.IOPriority) > 0 {
+		sb.WriteString(fmt.Sprintf("IO priority: %s\n", rl.IOPriority))
+	} else {
+		sb.WriteString("IO priority: inherited\n")
+	}
+	switch {
+	case rl.NewSession:
+		sb.WriteString("Process group: new session")
+	case rl.NewProcessGroup:
+		sb.WriteString("Process group: new group")
+	default:
+		sb.WriteString("Process group: shared with glenv")
+	}
+	return sb.String()
+}
+
+// Arranges for cmd to run with the limits applied.
+// Limits that have to be set from within the new process are applied by starting glenv again, through the hidden
+// TYPE_APPLY_LIMITS subcommand, which then replaces itself with the real command.
+func (rl *resourceLimits) Apply(cmd *exec.Cmd) error {
+	if err := setProcessGroup(cmd, rl.NewProcessGroup, rl.NewSession); err != nil {
+		return err
+	}
+	if !rl.needsShim() {
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find glenv to apply limits with: %w", err)
+	}
+	args := []string{self, TYPE_APPLY_LIMITS}
+	for _, setting := range []struct {
+		name  string
+		value flag.Value
+	}{
+		{"limit-as", &rl.AddressSpace},
+		{"limit-cpu", &rl.CPUSeconds},
+		{"limit-nofile", &rl.OpenFiles},
+		{"limit-core", &rl.CoreSize},
+		{"limit-nproc", &rl.Processes},
+		{"nice", &rl.Nice},
+	} {
+		if value := setting.value.String(); len(value) > 0 {
+			args = append(args, fmt.Sprintf("-%s=%s", setting.name, value))
+		}
+	}
+	if len(rl.IOPriority) > 0 {
+		args = append(args, fmt.Sprintf("-ionice=%s", rl.IOPriority))
+	}
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+// Applies the limits given to the hidden TYPE_APPLY_LIMITS subcommand and replaces glenv with the real command.
+// Arguments after the flags are the path to the command followed by its full argument list.
+func applyLimitsAction(limits *resourceLimits, args []string) {
+	if len(args) < 2 {
+		log.Fatalf("%s expects a command path and its arguments", TYPE_APPLY_LIMITS)
+	}
+	if err := applyLimitsAndExec(limits, args[0], args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+const (
+	// Resource number for the process count limit. syscall doesn't provide it
+	RLIMIT_NPROC = 0x6
+	// ioprio_set target type for a single thread or process
+	IOPRIO_WHO_PROCESS = 1
+	// Bits the IO scheduling class is shifted by within an IO priority
+	IOPRIO_CLASS_SHIFT = 13
+)
+
+// Resource limits can be applied here
+func limitsSupported() error {
+	return nil
+}
+
+// Applies the limits and scheduling settings to this process, then replaces it with the command at path.
+// Never returns unless something went wrong.
+func applyLimitsAndExec(limits *resourceLimits, path string, argv []string) error {
+	// Priorities are set per thread, so the thread that sets them has to be the one that execs
+	runtime.LockOSThread()
+
+	for _, l := range []struct {
+		name     string
+		resource int
+		value    limitValue
+	}{
+		{"address space", syscall.RLIMIT_AS, limits.AddressSpace},
+		{"cpu", syscall.RLIMIT_CPU, limits.CPUSeconds},
+		{"open files", syscall.RLIMIT_NOFILE, limits.OpenFiles},
+		{"core size", syscall.RLIMIT_CORE, limits.CoreSize},
+		{"processes", RLIMIT_NPROC, limits.Processes},
+	} {
+		if !l.value.Given {
+			continue
+		}
+		limit := syscall.Rlimit{Cur: l.value.Value, Max: l.value.Value}
+		if err := syscall.Setrlimit(l.resource, &limit); err != nil {
+			return fmt.Errorf("failed to limit %s to %s: %w", l.name, l.value.String(), err)
+		}
+	}
+
+	if limits.Nice.Given {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, limits.Nice.Value); err != nil {
+			return fmt.Errorf("failed to set nice to %d: %w", limits.Nice.Value, err)
+		}
+	}
+	if len(limits.IOPriority) > 0 {
+		class, level, err := parseIOPriority(limits.IOPriority)
+		if err != nil {
+			return err
+		}
+		priority := class<<IOPRIO_CLASS_SHIFT | level
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, 0, uintptr(priority)); errno != 0 {
+			return fmt.Errorf("failed to set ionice to %s: %w", limits.IOPriority, errno)
+		}
+	}
+
+	return syscall.Exec(path, argv, os.Environ())
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Resource limits, nice and ionice are only applied on Linux
+func limitsSupported() error {
+	return errors.New("resource limits, -nice and -ionice are only supported on linux, not " + runtime.GOOS)
+}
+
+func applyLimitsAndExec(limits *resourceLimits, path string, argv []string) error {
+	return limitsSupported()
+}
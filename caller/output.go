@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Output goes to the same stream of the terminal glenv is running in
+	OUTPUT_TERMINAL = "terminal"
+	// Output is thrown away
+	OUTPUT_DISCARD = "discard"
+	// Output is written to a file, which is emptied first. Ex 'file:/tmp/out.log'
+	OUTPUT_FILE = "file:"
+	// Output is added to the end of a file. Ex 'append:/tmp/out.log'
+	OUTPUT_APPEND = "append:"
+	// Output goes to both the terminal and a file, which is emptied first. Ex 'tee:/tmp/out.log'
+	OUTPUT_TEE = "tee:"
+	// Output goes to both the terminal and the end of a file. Ex 'tee-append:/tmp/out.log'
+	OUTPUT_TEE_APPEND = "tee-append:"
+)
+
+// Describes where one of the command's output streams should be sent
+type outputTarget struct {
+	// Should the output be shown in the terminal?
+	Terminal bool
+	// Path of a file to write the output to. Empty if there isn't one
+	FilePath string
+	// Should the output be added to the end of FilePath instead of replacing its contents?
+	Append bool
+}
+
+// Parses a target given to -stdout or -stderr.
+// An empty spec is treated as OUTPUT_TERMINAL.
+func parseOutputTarget(spec string) (outputTarget, error) {
+	switch {
+	case spec == "" || spec == OUTPUT_TERMINAL:
+		return outputTarget{Terminal: true}, nil
+	case spec == OUTPUT_DISCARD:
+		return outputTarget{}, nil
+	case strings.HasPrefix(spec, OUTPUT_FILE):
+		return outputFileTarget(spec, OUTPUT_FILE, false, false)
+	case strings.HasPrefix(spec, OUTPUT_APPEND):
+		return outputFileTarget(spec, OUTPUT_APPEND, false, true)
+	case strings.HasPrefix(spec, OUTPUT_TEE):
+		return outputFileTarget(spec, OUTPUT_TEE, true, false)
+	case strings.HasPrefix(spec, OUTPUT_TEE_APPEND):
+		return outputFileTarget(spec, OUTPUT_TEE_APPEND, true, true)
+	}
+	return outputTarget{}, fmt.Errorf("unknown output target '%s'. expecting '%s', '%s', or a path prefixed with '%s', '%s', '%s' or '%s'",
+		spec, OUTPUT_TERMINAL, OUTPUT_DISCARD, OUTPUT_FILE, OUTPUT_APPEND, OUTPUT_TEE, OUTPUT_TEE_APPEND)
+}
+
+func outputFileTarget(spec string, prefix string, terminal bool, append bool) (outputTarget, error) {
+	path := strings.TrimPrefix(spec, prefix)
+	if len(path) == 0 {
+		return outputTarget{}, fmt.Errorf("output target '%s' is missing a file path", spec)
+	}
+	return outputTarget{Terminal: terminal, FilePath: path, Append: append}, nil
+}
+
+// Describes the target in a human readable way
+func (ot outputTarget) String() string {
+	mode := "truncate"
+	if ot.Append {
+		mode = "append"
+	}
+	switch {
+	case ot.Terminal && len(ot.FilePath) > 0:
+		return fmt.Sprintf("terminal and file %s (%s)", ot.FilePath, mode)
+	case ot.Terminal:
+		return OUTPUT_TERMINAL
+	case len(ot.FilePath) > 0:
+		return fmt.Sprintf("file %s (%s)", ot.FilePath, mode)
+	}
+	return OUTPUT_DISCARD
+}
+
+// Provides the targets for the command's Standard Out and Standard Error based on the given options
+func resolveOutputTargets(opts *OperationOptions) (stdout outputTarget, stderr outputTarget, err error) {
+	stdoutSpec, stderrSpec := opts.StdoutTarget, opts.StderrTarget
+	// The older on/off flags still work when a target wasn't given
+	if len(stdoutSpec) == 0 && !opts.UseStdOut {
+		stdoutSpec = OUTPUT_DISCARD
+	}
+	if len(stderrSpec) == 0 && !opts.UseStdErr {
+		stderrSpec = OUTPUT_DISCARD
+	}
+
+	if stdout, err = parseOutputTarget(stdoutSpec); err != nil {
+		return stdout, stderr, err
+	}
+	if opts.MergeStdErr {
+		if len(opts.StderrTarget) > 0 {
+			return stdout, stderr, errors.New("-stderr can't be used together with -merge-stderr")
+		}
+		return stdout, stdout, nil
+	}
+	stderr, err = parseOutputTarget(stderrSpec)
+	return stdout, stderr, err
+}
+
+// The writers for a command's output, along with everything that needs to be flushed or closed once it has finished
+type childOutput struct {
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Run in order by Close
+	closers []func() error
+	// Files that have been opened, by path. Lets both streams share a single file
+	files map[string]*rotatingFile
+	// Redacting writers in use. Kept so their secrets can be updated
+	redactors []*redactingWriter
+}
+
+// Sets up the writers for the command's output based on the given options.
+// secrets are redacted from the output when opts.RedactOutput is true.
+// Close must be called once the command has finished.
+func openChildOutput(opts *OperationOptions, secrets []string) (co *childOutput, err error) {
+	stdoutTarget, stderrTarget, err := resolveOutputTargets(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	co = &childOutput{files: make(map[string]*rotatingFile)}
+	if co.Stdout, err = co.openStream(opts, stdoutTarget, os.Stdout, secrets); err != nil {
+		co.Close()
+		return nil, err
+	}
+	if opts.MergeStdErr {
+		// Using the very same writer means only one stream is written at a time
+		co.Stderr = co.Stdout
+	} else if co.Stderr, err = co.openStream(opts, stderrTarget, os.Stderr, secrets); err != nil {
+		co.Close()
+		return nil, err
+	}
+
+	if len(co.files) > 0 {
+		files := make([]*rotatingFile, 0, len(co.files))
+		for _, f := range co.files {
+			files = append(files, f)
+		}
+		// Stop reopening before anything gets closed
+		co.closers = append([]func() error{reopenOnHangup(files)}, co.closers...)
+	}
+	return co, nil
+}
+
+// Puts together the writer for a single output stream.
+// Data written to it passes through redaction, then any line prefixes, and then on to the target(s).
+func (co *childOutput) openStream(opts *OperationOptions, target outputTarget, terminal *os.File, secrets []string) (io.Writer, error) {
+	outputs := []io.Writer{}
+	if target.Terminal {
+		outputs = append(outputs, terminal)
+	}
+	if len(target.FilePath) > 0 {
+		f, err := co.openFile(target, opts.rotationPolicy())
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, f)
+	}
+
+	var w io.Writer
+	switch len(outputs) {
+	case 0:
+		// Nothing to write to. Let the command's output go nowhere
+		return nil, nil
+	case 1:
+		w = outputs[0]
+	default:
+		w = io.MultiWriter(outputs...)
+	}
+	if opts.OutputLines != nil {
+		lw := opts.OutputLines.Writer(w)
+		// Flushed after redaction, and before the files are closed
+		co.closers = append([]func() error{lw.Flush}, co.closers...)
+		w = lw
+	}
+
+	if len(opts.OutputLabel) > 0 || opts.OutputTimestamps {
+		w = newLinePrefixWriter(w, makeLinePrefixer(opts.OutputLabel, opts.OutputColor, opts.OutputTimestamps, opts.TimestampFormat))
+	}
+	if opts.RedactOutput {
+		rw := newRedactingWriter(w, secrets)
+		co.redactors = append(co.redactors, rw)
+		// Flush before anything else is closed
+		co.closers = append([]func() error{rw.Flush}, co.closers...)
+		w = rw
+	}
+	return w, nil
+}
+
+// Opens the file for target, rotating it according to policy. A file that was already opened for the other stream is reused.
+func (co *childOutput) openFile(target outputTarget, policy rotationPolicy) (io.Writer, error) {
+	if f, ok := co.files[target.FilePath]; ok {
+		return f, nil
+	}
+	f, err := openRotatingFile(target.FilePath, target.Append, policy)
+	if err != nil {
+		return nil, err
+	}
+	co.files[target.FilePath] = f
+	co.closers = append(co.closers, f.Close)
+	return f, nil
+}
+
+// Replaces the secrets that are redacted from the output. Used when the Environment variables have been read again.
+func (co *childOutput) UpdateSecrets(secrets []string) {
+	for _, rw := range co.redactors {
+		rw.SetSecrets(secrets)
+	}
+}
+
+// Flushes and closes everything that was opened for the command's output.
+// Everything is closed even if there are failures. The first failure is returned.
+func (co *childOutput) Close() (err error) {
+	for _, c := range co.closers {
+		if cErr := c(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	co.closers = nil
+	return err
+}
+
+// Makes a function that provides the prefix to put at the start of each line of output.
+// color is an ANSI color code, such as "36" for cyan, used for the label. Leave empty for no color.
+func makeLinePrefixer(label string, color string, timestamps bool, timestampFormat string) func() string {
+	if len(timestampFormat) == 0 {
+		timestampFormat = time.RFC3339
+	}
+	return func() string {
+		sb := strings.Builder{}
+		if timestamps {
+			sb.WriteString(time.Now().Format(timestampFormat))
+			sb.WriteRune(' ')
+		}
+		if len(label) > 0 && len(color) > 0 {
+			sb.WriteString(fmt.Sprintf("\x1b[%sm[%s]\x1b[0m ", color, label))
+		} else if len(label) > 0 {
+			sb.WriteString(fmt.Sprintf("[%s] ", label))
+		}
+		return sb.String()
+	}
+}
+
+// Writer that puts a prefix at the start of every line written through it.
+// Partial lines are passed on right away rather than waiting for the rest of the line.
+type linePrefixWriter struct {
+	out    io.Writer
+	prefix func() string
+
+	mu sync.Mutex
+	// Is the next byte written the first of a new line?
+	atLineStart bool
+}
+
+func newLinePrefixWriter(out io.Writer, prefix func() string) *linePrefixWriter {
+	return &linePrefixWriter{out: out, prefix: prefix, atLineStart: true}
+}
+
+func (lw *linePrefixWriter) Write(p []byte) (n int, err error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	buf := make([]byte, 0, len(p)+32)
+	for len(p) > 0 {
+		if lw.atLineStart {
+			buf = append(buf, lw.prefix()...)
+			lw.atLineStart = false
+		}
+		end := len(p)
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			end = i + 1
+			lw.atLineStart = true
+		}
+		buf = append(buf, p[:end]...)
+		n += end
+		p = p[end:]
+	}
+
+	if _, err := lw.out.Write(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Lets several writers share their outputs without their lines getting mixed together.
+// Each writer holds on to a partial line until the rest of it arrives, then writes whole lines while no other writer
+// can write.
+type lineSerializer struct {
+	mu sync.Mutex
+}
+
+// Longest partial line held on to before it is written anyway. Stops output without line breaks, such as progress
+// bars, from being held back forever
+const MAX_PENDING_LINE = 64 * 1024
+
+// Creates a writer, sharing ls with the others, that passes whole lines on to out
+func (ls *lineSerializer) Writer(out io.Writer) *serializedLineWriter {
+	return &serializedLineWriter{ls: ls, out: out}
+}
+
+type serializedLineWriter struct {
+	ls  *lineSerializer
+	out io.Writer
+
+	mu sync.Mutex
+	// Partial line waiting for the rest of it
+	pending []byte
+}
+
+func (sw *serializedLineWriter) Write(p []byte) (n int, err error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	sw.pending = append(sw.pending, p...)
+	end := bytes.LastIndexByte(sw.pending, '\n') + 1
+	if end == 0 && len(sw.pending) < MAX_PENDING_LINE {
+		return len(p), nil
+	} else if end == 0 {
+		end = len(sw.pending)
+	}
+	if err := sw.write(sw.pending[:end]); err != nil {
+		return 0, err
+	}
+	sw.pending = append(sw.pending[:0], sw.pending[end:]...)
+	return len(p), nil
+}
+
+// Writes out the partial line being held on to, if there is one
+func (sw *serializedLineWriter) Flush() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if len(sw.pending) == 0 {
+		return nil
+	}
+	err := sw.write(sw.pending)
+	sw.pending = nil
+	return err
+}
+
+func (sw *serializedLineWriter) write(data []byte) error {
+	sw.ls.mu.Lock()
+	defer sw.ls.mu.Unlock()
+	_, err := sw.out.Write(data)
+	return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseOutputTarget(t *testing.T) {
+	tests := []struct {
+		spec string
+		want outputTarget
+	}{
+		{"", outputTarget{Terminal: true}},
+		{"terminal", outputTarget{Terminal: true}},
+		{"discard", outputTarget{}},
+		{"file:/tmp/out.log", outputTarget{FilePath: "/tmp/out.log"}},
+		{"append:logs/out.log", outputTarget{FilePath: "logs/out.log", Append: true}},
+		{"tee:out.log", outputTarget{Terminal: true, FilePath: "out.log"}},
+		{"tee-append:out.log", outputTarget{Terminal: true, FilePath: "out.log", Append: true}},
+		// Only the prefix is taken off. The rest is the path, colons and all
+		{"file:C:/logs/out.log", outputTarget{FilePath: "C:/logs/out.log"}},
+	}
+	for _, tt := range tests {
+		got, err := parseOutputTarget(tt.spec)
+		if err != nil {
+			t.Fatalf("'%s': %v", tt.spec, err)
+		}
+		if got != tt.want {
+			t.Fatalf("'%s': want %+v, got %+v", tt.spec, tt.want, got)
+		}
+	}
+
+	for _, spec := range []string{"file:", "tee-append:", "stdout", "files:/tmp/x"} {
+		if _, err := parseOutputTarget(spec); err == nil {
+			t.Fatalf("'%s': want an error", spec)
+		}
+	}
+}
+
+func TestResolveOutputTargets(t *testing.T) {
+	stdout, stderr, err := resolveOutputTargets(&OperationOptions{UseStdOut: false, UseStdErr: true})
+	if err != nil || stdout.String() != OUTPUT_DISCARD || stderr.String() != OUTPUT_TERMINAL {
+		t.Fatalf("want the old flags to still work, got %s, %s, %v", stdout, stderr, err)
+	}
+
+	stdout, stderr, err = resolveOutputTargets(&OperationOptions{StdoutTarget: "tee:out.log", MergeStdErr: true})
+	if err != nil || stdout != stderr || stderr.FilePath != "out.log" {
+		t.Fatalf("want Standard Error to go wherever Standard Out goes, got %s, %s, %v", stdout, stderr, err)
+	}
+
+	if _, _, err := resolveOutputTargets(&OperationOptions{StderrTarget: "discard", MergeStdErr: true}); err == nil {
+		t.Fatal("want an error for -stderr with -merge-stderr")
+	}
+}
+
+func TestChildOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	truncated := filepath.Join(dir, "truncated.log")
+	appended := filepath.Join(dir, "appended.log")
+	os.WriteFile(truncated, []byte("old\n"), 0644)
+	os.WriteFile(appended, []byte("old\n"), 0644)
+
+	co, err := openChildOutput(&OperationOptions{StdoutTarget: "file:" + truncated, StderrTarget: "append:" + appended}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co.Stdout.Write([]byte("out\n"))
+	co.Stderr.Write([]byte("err\n"))
+	if err := co.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(truncated); string(data) != "out\n" {
+		t.Fatalf("want the file emptied first, got '%s'", data)
+	}
+	if data, _ := os.ReadFile(appended); string(data) != "old\nerr\n" {
+		t.Fatalf("want the output added to the end, got '%s'", data)
+	}
+
+	// Merged streams share one writer, with the label and redaction applied once
+	merged := filepath.Join(dir, "merged.log")
+	opts := &OperationOptions{StdoutTarget: "file:" + merged, MergeStdErr: true, OutputLabel: "web", RedactOutput: true}
+	co, err = openChildOutput(opts, []string{"hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co.Stdout != co.Stderr {
+		t.Fatal("want one writer for both streams")
+	}
+	co.Stdout.Write([]byte("password is hunt"))
+	co.Stderr.Write([]byte("er2\nbye\n"))
+	co.Close()
+	if data, _ := os.ReadFile(merged); string(data) != "[web] password is ****\n[web] bye\n" {
+		t.Fatalf("got '%s'", data)
+	}
+
+	co, err = openChildOutput(&OperationOptions{StdoutTarget: "discard", StderrTarget: "discard"}, nil)
+	if err != nil || co.Stdout != nil || co.Stderr != nil {
+		t.Fatalf("want no writers when discarding, got %v, %v, %v", co.Stdout, co.Stderr, err)
+	}
+}
+
+func TestLinePrefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	lines := 0
+	lw := newLinePrefixWriter(out, func() string {
+		lines++
+		return "> "
+	})
+	for _, chunk := range []string{"one", " still one\ntwo\n", "", "three\nfo", "ur"} {
+		if n, err := lw.Write([]byte(chunk)); err != nil || n != len(chunk) {
+			t.Fatalf("write '%s': wrote %d, %v", chunk, n, err)
+		}
+	}
+	if want := "> one still one\n> two\n> three\n> four"; out.String() != want {
+		t.Fatalf("want '%s', got '%s'", want, out.String())
+	}
+	// The prefix is only worked out when a line starts
+	if lines != 4 {
+		t.Fatalf("want 4 prefixes, got %d", lines)
+	}
+}
+
+func TestMakeLinePrefixer(t *testing.T) {
+	if got := makeLinePrefixer("web", "", false, "")(); got != "[web] " {
+		t.Fatalf("got '%s'", got)
+	}
+	if got := makeLinePrefixer("web", "36", false, "")(); got != "\x1b[36m[web]\x1b[0m " {
+		t.Fatalf("got '%q'", got)
+	}
+	got := makeLinePrefixer("", "", true, "2006")()
+	if len(got) != 5 || !strings.HasSuffix(got, " ") {
+		t.Fatalf("want a year then a space, got '%s'", got)
+	}
+}
+
+func TestLineSerializer(t *testing.T) {
+	out := &bytes.Buffer{}
+	ls := &lineSerializer{}
+	a, b := ls.Writer(out), ls.Writer(out)
+	a.Write([]byte("a1 "))
+	b.Write([]byte("b1\nb2 "))
+	a.Write([]byte("still a1\na2"))
+	b.Write([]byte("still b2\n"))
+	if want := "b1\na1 still a1\nb2 still b2\n"; out.String() != want {
+		t.Fatalf("want whole lines only, got '%s'", out.String())
+	}
+	a.Flush()
+	b.Flush()
+	if !strings.HasSuffix(out.String(), "\na2") {
+		t.Fatalf("want the partial line written when flushed, got '%s'", out.String())
+	}
+
+	// Really long partial lines aren't held back forever
+	out.Reset()
+	a.Write(bytes.Repeat([]byte("x"), MAX_PENDING_LINE))
+	if out.Len() != MAX_PENDING_LINE {
+		t.Fatalf("want the partial line written once too long, got %d bytes", out.Len())
+	}
+
+	// Lines from many writers at once are never split
+	out.Reset()
+	done := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func(w *serializedLineWriter) {
+			for j := 0; j < 200; j++ {
+				w.Write([]byte("first half "))
+				w.Write([]byte("second half\n"))
+			}
+			done <- struct{}{}
+		}(ls.Writer(out))
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if line != "first half second half" {
+			t.Fatalf("want whole lines, got '%s'", line)
+		}
+	}
+}
+
+func TestChildOutputSharedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.log")
+	lines := &lineSerializer{}
+	opts := &OperationOptions{StdoutTarget: "file:" + path, MergeStdErr: true, OutputLabel: "web", OutputLines: lines}
+	co, err := openChildOutput(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	co.Stdout.Write([]byte("partial"))
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Fatalf("want the partial line held back, got '%s'", data)
+	}
+	co.Close()
+	if data, _ := os.ReadFile(path); string(data) != "[web] partial" {
+		t.Fatalf("want the partial line written on close, got '%s'", data)
+	}
+}
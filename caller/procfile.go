@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+const (
+	// Stop every process once any of them exits
+	ON_EXIT_STOP = "stop"
+	// Keep the remaining processes running when one exits
+	ON_EXIT_CONTINUE = "continue"
+)
+
+// ANSI colors given to each process's label, in order
+var processColors = []string{"36", "33", "32", "35", "34", "31", "96", "93", "92", "95"}
+
+// A single named process from a Procfile
+type procfileEntry struct {
+	// Name of the process. Used to label its output
+	Name string
+	// Variables set just for this process. Given as NAME=value before the command
+	Overrides environment.Variables
+	// Command line to run through the shell
+	Command string
+}
+
+// Reads in the processes defined in the Procfile at path.
+// Each line is "name: command". Blank lines and lines starting with # are ignored.
+// The command may start with NAME=value assignments that only apply to that process, the same as in a shell.
+func readProcfile(path string) ([]procfileEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rLine := regexp.MustCompile(`^([A-Za-z0-9_-]+):[ \t]*(.+)$`)
+	entries := []procfileEntry{}
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		matches := rLine.FindStringSubmatch(line)
+		if matches == nil {
+			return nil, fmt.Errorf("%s:%d: expected 'name: command'", path, lineNum)
+		}
+		if names[matches[1]] {
+			return nil, fmt.Errorf("%s:%d: process '%s' is defined more than once", path, lineNum, matches[1])
+		}
+		names[matches[1]] = true
+
+		overrides, command, err := splitLeadingAssignments(matches[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		if len(command) == 0 {
+			return nil, fmt.Errorf("%s:%d: process '%s' has no command", path, lineNum, matches[1])
+		}
+		entries = append(entries, procfileEntry{Name: matches[1], Overrides: overrides, Command: command})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no processes defined", path)
+	}
+	return entries, nil
+}
+
+// Separates any NAME=value words at the start of a command line from the rest of it.
+// Values may be wrapped in single or double quotes.
+func splitLeadingAssignments(commandLine string) (assignments environment.Variables, rest string, err error) {
+	rName := regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+	rest = strings.TrimLeftFunc(commandLine, unicode.IsSpace)
+	for {
+		prefix := rName.FindString(rest)
+		if len(prefix) == 0 {
+			return assignments, rest, nil
+		}
+		value, remaining, err := readShellWord(rest[len(prefix):])
+		if err != nil {
+			return nil, "", err
+		}
+		assignments = append(assignments, environment.Variable{Name: strings.TrimSuffix(prefix, "="), Value: value})
+		rest = strings.TrimLeftFunc(remaining, unicode.IsSpace)
+	}
+}
+
+// Reads a single word from the start of text, removing quotes and escapes the way a shell would.
+// Returns the word and whatever follows it.
+func readShellWord(text string) (word string, rest string, err error) {
+	sb := strings.Builder{}
+	var quote rune
+	escaped := false
+	for i, r := range text {
+		switch {
+		case escaped:
+			sb.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && unicode.IsSpace(r):
+			return sb.String(), text[i:], nil
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return "", "", fmt.Errorf("unterminated %c quote", quote)
+	}
+	return sb.String(), "", nil
+}
+
+// Provides the environment for a single process. The process's overrides are layered on top of the shared environment.
+// Overrides may refer to shared variables, or earlier overrides, the same as in an env file.
+func processEnvironment(shared *environment.VariableMap, entry procfileEntry) (*environment.VariableMap, error) {
+	env := shared.Clone()
+	for _, o := range entry.Overrides {
+		expanded, done, missing := environment.ExpandVarString(o.Value, env)
+		if !done {
+			return nil, fmt.Errorf("process '%s' override '%s' refers to unknown variables: %v", entry.Name, o.Name, missing)
+		}
+		env.Set(o.Name, expanded)
+	}
+	return env, nil
+}
+
+// Result of a single process that has finished for good
+type processResult struct {
+	name     string
+	exitCode int
+	err      error
+}
+
+// Starts every process in the Procfile with the shared environment and waits for them to finish.
+// Each process's output is labelled with its name. What happens when one exits depends on -on-exit.
+// Processes are run the same way as exec's command, so restarts pick up changes to the env files.
+func runProcfileAction() {
+	entries, err := readProcfile(_opts.ProcfilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _opts.OnExit != ON_EXIT_STOP && _opts.OnExit != ON_EXIT_CONTINUE {
+		log.Fatalf("unknown -on-exit policy '%s'. expecting '%s' or '%s'", _opts.OnExit, ON_EXIT_STOP, ON_EXIT_CONTINUE)
+	}
+	policy := _opts.restartPolicy()
+	if err := policy.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadLimits(&_opts); err != nil {
+		log.Fatal(err)
+	}
+
+	// Read once up front so every process starts with the same environment. Restarts read the files again
+	loaded, err := loadEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	shared := useEnv(loaded)
+
+	// Line up the labels
+	width := 0
+	for _, e := range entries {
+		if len(e.Name) > width {
+			width = len(e.Name)
+		}
+	}
+	useColor := !_opts.NoColor && isTerminal(os.Stdout)
+
+	if _opts.IsTest {
+		fmt.Println("####--------++--------####")
+		for _, e := range entries {
+			env, err := processEnvironment(shared, e)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Process: %s\n", e.Name)
+			for _, o := range e.Overrides {
+				fmt.Printf("  %s=%s\n", o.Name, displayValue(o.Name, env.Get(o.Name)))
+			}
+			fmt.Printf("  Command: %s\n", maskSecretsIn(e.Command))
+		}
+		launch, err := resolveLaunchSettings(&_opts, shared)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("On exit: %s\n", _opts.OnExit)
+		fmt.Printf("Restart: %s\n", policy)
+		fmt.Println(launch)
+		if _opts.Timeout > 0 {
+			fmt.Printf("Timeout: %s, then killed after %s\n", _opts.Timeout, _opts.StopGrace)
+		} else {
+			fmt.Println("Timeout: none")
+		}
+		fmt.Println(&_opts.Limits)
+		return
+	}
+
+	// Every process writes to the same terminal, and maybe the same files
+	lines := &lineSerializer{}
+	results := make(chan processResult, len(entries))
+	supervisors := make([]*supervisor, len(entries))
+	outputs := make([]*childOutput, len(entries))
+	preparers := make([]*commandPreparer, len(entries))
+	for i, e := range entries {
+		if _, err := processEnvironment(shared, e); err != nil {
+			log.Fatal(err)
+		}
+
+		procOpts := _opts
+		procOpts.OutputLabel = fmt.Sprintf("%-*s", width, e.Name)
+		procOpts.OutputLines = lines
+		if useColor {
+			procOpts.OutputColor = processColors[i%len(processColors)]
+		}
+		output, err := openChildOutput(&procOpts, _secretValues)
+		if err != nil {
+			log.Fatal(err)
+		}
+		outputs[i] = output
+
+		entry := e
+		shell, args := shellInvocation(entry.Command)
+		preparer := &commandPreparer{path: shell, args: args, output: output, next: loaded}
+		preparer.adjust = func(env *environment.VariableMap) (*environment.VariableMap, error) {
+			return processEnvironment(env, entry)
+		}
+		preparers[i] = preparer
+		sup, err := newCommandSupervisor(e.Name, policy, preparer.prepare, &_opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		supervisors[i] = sup
+		go func() {
+			exitCode, err := sup.Run()
+			results <- processResult{name: entry.Name, exitCode: exitCode, err: err}
+		}()
+	}
+
+	exitCode := 0
+	stoppingAll := false
+	for remaining := len(entries); remaining > 0; remaining-- {
+		r := <-results
+		if r.err != nil {
+			log.Printf("[%s] %s", r.name, r.err)
+			if r.exitCode == 0 {
+				r.exitCode = 1
+			}
+		}
+		log.Printf("[%s] exited with code %d", r.name, r.exitCode)
+		if r.exitCode != 0 && exitCode == 0 {
+			exitCode = r.exitCode
+		}
+		if _opts.OnExit == ON_EXIT_STOP && !stoppingAll && remaining > 1 {
+			stoppingAll = true
+			log.Printf("stopping all processes")
+			for _, sup := range supervisors {
+				sup.Stop()
+			}
+		}
+	}
+
+	for i, output := range outputs {
+		preparers[i].Close()
+		if err := output.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	os.Exit(exitCode)
+}
+
+// Is f connected to a terminal?
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+func TestReadShellWord(t *testing.T) {
+	tests := []struct {
+		text string
+		word string
+		rest string
+	}{
+		{"plain rest", "plain", " rest"},
+		{"last", "last", ""},
+		{`"two words" rest`, "two words", " rest"},
+		{`'single $HOME' rest`, "single $HOME", " rest"},
+		{`mixed"quo"'tes' rest`, "mixedquotes", " rest"},
+		{`esc\ aped rest`, "esc aped", " rest"},
+		{`"a \"quote\"" rest`, `a "quote"`, " rest"},
+		// Backslashes are kept as they are inside single quotes
+		{`'back\slash' rest`, `back\slash`, " rest"},
+		{`""`, "", ""},
+		{"tab\trest", "tab", "\trest"},
+	}
+	for _, tt := range tests {
+		word, rest, err := readShellWord(tt.text)
+		if err != nil || word != tt.word || rest != tt.rest {
+			t.Fatalf("%s: want '%s' then '%s', got '%s' then '%s' %v", tt.text, tt.word, tt.rest, word, rest, err)
+		}
+	}
+
+	for _, text := range []string{`"open`, `'open`, `ok"open rest`} {
+		if _, _, err := readShellWord(text); err == nil {
+			t.Fatalf("%s: want an error for the unterminated quote", text)
+		}
+	}
+}
+
+func TestSplitLeadingAssignments(t *testing.T) {
+	tests := []struct {
+		line        string
+		assignments environment.Variables
+		rest        string
+	}{
+		{"npm start", nil, "npm start"},
+		{"PORT=5000 npm start", environment.Variables{{Name: "PORT", Value: "5000"}}, "npm start"},
+		{`  A=1   B="two words" C='$X' run --flag=1`,
+			environment.Variables{{Name: "A", Value: "1"}, {Name: "B", Value: "two words"}, {Name: "C", Value: "$X"}}, "run --flag=1"},
+		{"EMPTY= run", environment.Variables{{Name: "EMPTY", Value: ""}}, "run"},
+		// Only names a shell would take are assignments
+		{"1A=x run", nil, "1A=x run"},
+		{"run A=1", nil, "run A=1"},
+		{"ONLY=1", environment.Variables{{Name: "ONLY", Value: "1"}}, ""},
+	}
+	for _, tt := range tests {
+		assignments, rest, err := splitLeadingAssignments(tt.line)
+		if err != nil || !reflect.DeepEqual(assignments, tt.assignments) || rest != tt.rest {
+			t.Fatalf("%s: want %v then '%s', got %v then '%s' %v", tt.line, tt.assignments, tt.rest, assignments, rest, err)
+		}
+	}
+
+	if _, _, err := splitLeadingAssignments(`A="open run`); err == nil {
+		t.Fatal("want an error for the unterminated quote")
+	}
+}
+
+func TestReadProcfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Procfile")
+	os.WriteFile(path, []byte(strings.Join([]string{
+		"# Processes",
+		"",
+		"web: PORT=5000 npm start",
+		"  worker-1:\tbundle exec sidekiq  ",
+		"clock: echo 'a: b'",
+	}, "\n")), 0644)
+
+	entries, err := readProcfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []procfileEntry{
+		{Name: "web", Overrides: environment.Variables{{Name: "PORT", Value: "5000"}}, Command: "npm start"},
+		{Name: "worker-1", Command: "bundle exec sidekiq"},
+		{Name: "clock", Command: "echo 'a: b'"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("want %+v, got %+v", want, entries)
+	}
+
+	for contents, wantErr := range map[string]string{
+		"web npm start":       "Procfile:1: expected 'name: command'",
+		"web: a\n\nweb: b":    "Procfile:3: process 'web' is defined more than once",
+		"web: PORT=1":         "Procfile:1: process 'web' has no command",
+		"web: A=\"open run":   "Procfile:1: unterminated \" quote",
+		"# nothing here\n\n":  "Procfile: no processes defined",
+		"web: a\nbad name: b": "Procfile:2: expected 'name: command'",
+	} {
+		os.WriteFile(path, []byte(contents), 0644)
+		if _, err := readProcfile(path); err == nil || !strings.HasSuffix(err.Error(), wantErr) {
+			t.Fatalf("%q: want an error ending '%s', got %v", contents, wantErr, err)
+		}
+	}
+}
+
+func TestProcessEnvironment(t *testing.T) {
+	shared := environment.VariableMapOf(map[string]string{"HOST": "localhost", "PORT": "80"})
+	entry := procfileEntry{Name: "web", Overrides: environment.Variables{
+		{Name: "PORT", Value: "5000"},
+		{Name: "URL", Value: "http://${HOST}:${PORT}"},
+	}}
+	env, err := processEnvironment(shared, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := env.Get("URL"); got != "http://localhost:5000" {
+		t.Fatalf("want overrides to see earlier overrides, got '%s'", got)
+	}
+	if got := shared.Get("PORT"); got != "80" {
+		t.Fatalf("want the shared environment left alone, got '%s'", got)
+	}
+
+	entry.Overrides = environment.Variables{{Name: "URL", Value: "${MISSING}"}}
+	if _, err := processEnvironment(shared, entry); err == nil {
+		t.Fatal("want an error for an unknown variable")
+	}
+}
+
+func TestCommandPreparer(t *testing.T) {
+	_opts = CreateDefaultOperationOptions()
+	_opts.QuietEnv = true
+	t.Cleanup(func() { _opts = CreateDefaultOperationOptions() })
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app.env": "PORT=80\n"})
+	_opts.Globs = []string{filepath.Join(dir, "app.env")}
+	_opts.WorkingDir = "${PORT_DIR}"
+	output, err := openChildOutput(&OperationOptions{StdoutTarget: "discard", StderrTarget: "discard"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	entry := procfileEntry{Name: "web", Overrides: environment.Variables{{Name: "ADDR", Value: ":${PORT}"}}, Command: "serve"}
+	preparer := &commandPreparer{path: "serve", output: output}
+	preparer.adjust = func(env *environment.VariableMap) (*environment.VariableMap, error) {
+		return processEnvironment(env, entry)
+	}
+	envOf := func() []string {
+		t.Helper()
+		cmd, err := preparer.prepare()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd.Dir != dir {
+			t.Fatalf("want -cwd applied, got '%s'", cmd.Dir)
+		}
+		return cmd.Env
+	}
+	t.Setenv("PORT_DIR", dir)
+	if env := envOf(); !hasEntry(env, "ADDR=:80") {
+		t.Fatalf("want the override applied, got %v", env)
+	}
+
+	// Each run reads the files again, and keeps the last good environment if they can't be read
+	writeFiles(t, dir, map[string]string{"app.env": "PORT=90\n"})
+	if env := envOf(); !hasEntry(env, "ADDR=:90") {
+		t.Fatalf("want the changed environment, got %v", env)
+	}
+	writeFiles(t, dir, map[string]string{"app.env": "PORT=$MISSING_VALUE\n"})
+	if env := envOf(); !hasEntry(env, "ADDR=:90") {
+		t.Fatalf("want the last good environment, got %v", env)
+	}
+}
+
+// Is entry one of the NAME=value entries in env?
+func hasEntry(env []string, entry string) bool {
+	for _, e := range env {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Starts cmd in a new process group, or a new session, when asked to
+func setProcessGroup(cmd *exec.Cmd, group bool, session bool) error {
+	if !group && !session {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = group
+	cmd.SysProcAttr.Setsid = session
+	return nil
+}
+
+// Is cmd in a process group of its own? If so it won't see signals the terminal sends to glenv's group
+func inOwnProcessGroup(cmd *exec.Cmd) bool {
+	return cmd.SysProcAttr != nil && (cmd.SysProcAttr.Setpgid || cmd.SysProcAttr.Setsid)
+}
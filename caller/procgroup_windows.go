@@ -0,0 +1,18 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Process groups and sessions aren't supported on Windows
+func setProcessGroup(cmd *exec.Cmd, group bool, session bool) error {
+	if group || session {
+		return errors.New("-new-pgroup and -new-session are not supported on windows")
+	}
+	return nil
+}
+
+func inOwnProcessGroup(cmd *exec.Cmd) bool {
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// Writer that replaces any occurrence of a secret value with environment.SECRET_MASK before passing data on.
+// Secrets that are split across separate writes are still found. Only the trailing bytes of a write that could be
+// the start of a secret are held back, so at most the length of the longest secret is ever buffered.
+type redactingWriter struct {
+	out     io.Writer
+	secrets [][]byte
+	mask    []byte
+	// Quick check for bytes that can start a secret
+	firstBytes [256]bool
+
+	mu sync.Mutex
+	// Trailing bytes from earlier writes that may be the start of a secret
+	pending []byte
+}
+
+// Creates a writer that redacts all of the given secrets from anything written through it to out.
+// Flush must be called once writing has finished so any held back bytes are written out.
+func newRedactingWriter(out io.Writer, secrets []string) *redactingWriter {
+	rw := &redactingWriter{out: out, mask: []byte(environment.SECRET_MASK)}
+	rw.setSecrets(secrets)
+	return rw
+}
+
+// Replaces the secrets that are redacted. Anything already held back is still checked against the new secrets.
+func (rw *redactingWriter) SetSecrets(secrets []string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.setSecrets(secrets)
+}
+
+func (rw *redactingWriter) setSecrets(secrets []string) {
+	rw.secrets = rw.secrets[:0]
+	rw.firstBytes = [256]bool{}
+	for _, s := range secrets {
+		if len(s) > 0 {
+			rw.secrets = append(rw.secrets, []byte(s))
+			rw.firstBytes[s[0]] = true
+		}
+	}
+	// Longest first so a secret containing another is replaced completely
+	sort.Slice(rw.secrets, func(i, j int) bool { return len(rw.secrets[i]) > len(rw.secrets[j]) })
+}
+
+func (rw *redactingWriter) Write(p []byte) (n int, err error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	data := p
+	if len(rw.pending) > 0 {
+		data = append(rw.pending, p...)
+	}
+	redacted, rest := rw.redact(data, false)
+	rw.pending = append([]byte(nil), rest...)
+
+	if len(redacted) > 0 {
+		if _, err := rw.out.Write(redacted); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Writes out anything that was held back waiting to see if it was a secret
+func (rw *redactingWriter) Flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	redacted, _ := rw.redact(rw.pending, true)
+	rw.pending = nil
+	_, err := rw.out.Write(redacted)
+	return err
+}
+
+// Replaces the secrets in data. Unless final is true, trailing bytes that could still become a secret in the next
+// write are held back and returned as rest. That includes a complete secret that is the start of a longer one
+func (rw *redactingWriter) redact(data []byte, final bool) (redacted []byte, rest []byte) {
+	redacted = make([]byte, 0, len(data))
+	i := 0
+	for i < len(data) {
+		if !rw.firstBytes[data[i]] {
+			redacted = append(redacted, data[i])
+			i++
+		} else if !final && rw.isPartialAt(data[i:]) {
+			// Might be a secret that continues in the next write. Wait to see the rest of it
+			break
+		} else if matched := rw.matchAt(data[i:]); matched > 0 {
+			redacted = append(redacted, rw.mask...)
+			i += matched
+		} else {
+			redacted = append(redacted, data[i])
+			i++
+		}
+	}
+	return redacted, data[i:]
+}
+
+// Provides the length of the secret that data starts with. 0 if there isn't one
+func (rw *redactingWriter) matchAt(data []byte) int {
+	for _, s := range rw.secrets {
+		if bytes.HasPrefix(data, s) {
+			return len(s)
+		}
+	}
+	return 0
+}
+
+// Is all of data the beginning of a secret?
+func (rw *redactingWriter) isPartialAt(data []byte) bool {
+	for _, s := range rw.secrets {
+		if len(data) < len(s) && bytes.HasPrefix(s, data) {
+			return true
+		}
+	}
+	return false
+}
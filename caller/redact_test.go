@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Writes each of the chunks through a redactingWriter for secrets, then flushes it
+func redactChunks(t *testing.T, secrets []string, chunks ...string) string {
+	t.Helper()
+	out := &bytes.Buffer{}
+	rw := newRedactingWriter(out, secrets)
+	for _, c := range chunks {
+		if n, err := rw.Write([]byte(c)); err != nil || n != len(c) {
+			t.Fatalf("write '%s': wrote %d, %v", c, n, err)
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestRedactingWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+		chunks  []string
+		want    string
+	}{
+		{"whole", []string{"hunter2"}, []string{"pass=hunter2\n"}, "pass=****\n"},
+		{"split", []string{"hunter2"}, []string{"pass=hun", "ter2\n"}, "pass=****\n"},
+		{"split per byte", []string{"hunter2"}, strings.Split("a hunter2 b", ""), "a **** b"},
+		{"not a secret after all", []string{"hunter2"}, []string{"hunt", "ing\n"}, "hunting\n"},
+		{"held back at the end", []string{"hunter2"}, []string{"ends with hunt"}, "ends with hunt"},
+		{"secret at the end", []string{"hunter2"}, []string{"x hunter2"}, "x ****"},
+		{"several", []string{"abc", "xyz"}, []string{"abc-x", "yz-abc"}, "****-****-****"},
+		// A secret that is the start of a longer one mustn't let the rest of the longer one out
+		{"prefix split after short", []string{"abc", "abcdef"}, []string{"1 abc", "def 2"}, "1 **** 2"},
+		{"prefix split inside long", []string{"abc", "abcdef"}, []string{"1 abcd", "ef 2"}, "1 **** 2"},
+		{"prefix short only", []string{"abc", "abcdef"}, []string{"1 abc", "x 2"}, "1 ****x 2"},
+		{"prefix short at the end", []string{"abc", "abcdef"}, []string{"1 abc"}, "1 ****"},
+		// Overlapping secrets are replaced by the longest one
+		{"overlapping", []string{"secret", "secretive"}, []string{"so secretive"}, "so ****"},
+		{"contained", []string{"pass", "mypassword"}, []string{"my", "password and pass"}, "**** and ****"},
+		{"none", nil, []string{"plain ", "text"}, "plain text"},
+	}
+	for _, tt := range tests {
+		if got := redactChunks(t, tt.secrets, tt.chunks...); got != tt.want {
+			t.Fatalf("%s: want '%s', got '%s'", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestRedactingWriterSetSecrets(t *testing.T) {
+	out := &bytes.Buffer{}
+	rw := newRedactingWriter(out, []string{"old-secret"})
+	rw.Write([]byte("a old-sec"))
+	// Bytes held back are checked against the new secrets
+	rw.SetSecrets([]string{"new-secret"})
+	rw.Write([]byte("ret new-secret"))
+	rw.Flush()
+	if want := "a old-secret ****"; out.String() != want {
+		t.Fatalf("want '%s', got '%s'", want, out.String())
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Size in bytes that can be given as a flag with an optional unit. Ex '500K', '100M' or '2G'
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	size, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
+// Parses a size such as '100M' into a number of bytes. Units are K, M and G (powers of 1024) with an optional trailing B.
+func parseByteSize(value string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return n * multiplier, nil
+}
+
+// Describes when an output file should be rotated and what happens to the older files
+type rotationPolicy struct {
+	// Rotate once the file would grow larger than this many bytes. 0 disables size based rotation
+	MaxSize int64
+	// Rotate on boundaries of this interval. Ex every 24h rotates at midnight UTC. 0 disables time based rotation
+	Interval time.Duration
+	// Number of older files to keep
+	Keep int
+	// Should older files be gzipped?
+	Compress bool
+}
+
+// Is rotation turned on at all?
+func (rp rotationPolicy) Enabled() bool {
+	return rp.MaxSize > 0 || rp.Interval > 0
+}
+
+// Describes the policy in a human readable way
+func (rp rotationPolicy) String() string {
+	if !rp.Enabled() {
+		return "off"
+	}
+	parts := []string{}
+	if rp.MaxSize > 0 {
+		parts = append(parts, fmt.Sprintf("size > %d bytes", rp.MaxSize))
+	}
+	if rp.Interval > 0 {
+		parts = append(parts, fmt.Sprintf("every %s", rp.Interval))
+	}
+	desc := fmt.Sprintf("%s, keep %d", strings.Join(parts, " or "), rp.Keep)
+	if rp.Compress {
+		desc += ", gzip"
+	}
+	return desc
+}
+
+// File that is rotated according to a rotationPolicy as it is written to.
+// Older files are renamed to path.1, path.2 and so on, with path.1 being the newest.
+type rotatingFile struct {
+	path   string
+	policy rotationPolicy
+
+	mu           sync.Mutex
+	file         *os.File
+	size         int64
+	nextRotation time.Time
+	// Finishes once the last rotated file has been compressed
+	compressing sync.WaitGroup
+}
+
+// Opens the file at path so it can be written to and rotated based on policy.
+// If append is false then any existing content is removed.
+func openRotatingFile(path string, append bool, policy rotationPolicy) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, policy: policy}
+	if err := rf.open(append); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open(append bool) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	if append {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := createOutputFile(rf.path, flags)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	if rf.policy.Interval > 0 {
+		rf.nextRotation = time.Now().Truncate(rf.policy.Interval).Add(rf.policy.Interval)
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (n int, err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.shouldRotate(len(p)) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) shouldRotate(writeSize int) bool {
+	if rf.policy.MaxSize > 0 && rf.size > 0 && rf.size+int64(writeSize) > rf.policy.MaxSize {
+		return true
+	}
+	return rf.policy.Interval > 0 && !time.Now().Before(rf.nextRotation)
+}
+
+// Moves the current file out of the way, shifting older generations along, and starts a fresh file
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+	// The previous generation has to be done compressing before it can be moved
+	rf.compressing.Wait()
+
+	if rf.policy.Keep <= 0 {
+		if err := os.Remove(rf.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return rf.open(false)
+	}
+
+	// Drop the oldest generation and shift the rest along
+	rf.removeGeneration(rf.policy.Keep)
+	for i := rf.policy.Keep - 1; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			from := rf.generationPath(i) + ext
+			if _, err := os.Stat(from); err == nil {
+				if err := os.Rename(from, rf.generationPath(i+1)+ext); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	first := rf.generationPath(1)
+	if err := os.Rename(rf.path, first); err != nil {
+		return err
+	}
+	if rf.policy.Compress {
+		rf.compressing.Add(1)
+		go func() {
+			defer rf.compressing.Done()
+			if err := gzipFile(first); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress rotated log %s: %s\n", first, err)
+			}
+		}()
+	}
+	return rf.open(false)
+}
+
+func (rf *rotatingFile) generationPath(generation int) string {
+	return fmt.Sprintf("%s.%d", rf.path, generation)
+}
+
+func (rf *rotatingFile) removeGeneration(generation int) {
+	os.Remove(rf.generationPath(generation))
+	os.Remove(rf.generationPath(generation) + ".gz")
+}
+
+// Closes and opens the file again without rotating.
+// Lets an external tool move the file away and have writing continue in a new file at the same path.
+func (rf *rotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return os.ErrClosed
+	}
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	return rf.open(true)
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	rf.compressing.Wait()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// Opens the file at path with flags, creating it with glenv's own file mode creation mask if it doesn't exist.
+// Output files can be rotated while a command is being started with a different mask
+func createOutputFile(path string, flags int) (*os.File, error) {
+	umaskLock.RLock()
+	defer umaskLock.RUnlock()
+	return os.OpenFile(path, flags, 0644)
+}
+
+// Compresses the file at path into path.gz and removes the original
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createOutputFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Reopens all of the given files whenever glenv receives SIGHUP.
+// Returns a function that stops listening for the signal.
+func reopenOnHangup(files []*rotatingFile) (stop func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-hup:
+				for _, rf := range files {
+					if err := rf.Reopen(); err != nil {
+						fmt.Fprintf(os.Stderr, "failed to reopen %s: %s\n", rf.path, err)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		signal.Stop(hup)
+		close(done)
+		return nil
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"0":     0,
+		"512":   512,
+		"64K":   64 << 10,
+		"64kb":  64 << 10,
+		"100M":  100 << 20,
+		" 2G ":  2 << 30,
+		"1B":    1,
+		"10MB":  10 << 20,
+		"1024k": 1 << 20,
+	} {
+		if got, err := parseByteSize(value); err != nil || got != want {
+			t.Fatalf("'%s': want %d, got %d %v", value, want, got, err)
+		}
+	}
+	for _, value := range []string{"", "M", "-1K", "1.5M", "10T", "ten"} {
+		if _, err := parseByteSize(value); err == nil {
+			t.Fatalf("'%s': want an error", value)
+		}
+	}
+}
+
+// Reads the file at path, ungzipping it first if compressed is true
+func readRotated(t *testing.T, path string, compressed bool) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	rf, err := openRotatingFile(path, false, rotationPolicy{MaxSize: 8, Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each write after the first two would take the file past 8 bytes
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]string{path: "five\n", path + ".1": "four\n", path + ".2": "three\n"} {
+		if got := readRotated(t, p, false); got != want {
+			t.Fatalf("%s: want '%s', got '%s'", filepath.Base(p), want, got)
+		}
+	}
+	// Only Keep older files are kept
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("want no third generation, got %v", err)
+	}
+
+	// A single write larger than the limit still goes into the fresh file rather than rotating forever
+	rf, _ = openRotatingFile(path, true, rotationPolicy{MaxSize: 8, Keep: 2})
+	rf.Write([]byte("far too long for one file\n"))
+	rf.Close()
+	if got := readRotated(t, path, false); got != "far too long for one file\n" {
+		t.Fatalf("got '%s'", got)
+	}
+	if got := readRotated(t, path+".1", false); got != "five\n" {
+		t.Fatalf("want the previous file shifted along, got '%s'", got)
+	}
+}
+
+func TestRotatingFileCompressed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	rf, err := openRotatingFile(path, false, rotationPolicy{MaxSize: 5, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"} {
+		rf.Write([]byte(line))
+	}
+	// Closing waits for the last file to be compressed
+	rf.Close()
+
+	if got := readRotated(t, path+".1.gz", true); got != "cccc\n" {
+		t.Fatalf("want cccc in out.log.1.gz, got '%s'", got)
+	}
+	if got := readRotated(t, path+".2.gz", true); got != "bbbb\n" {
+		t.Fatalf("want bbbb in out.log.2.gz, got '%s'", got)
+	}
+	for _, p := range []string{path + ".1", path + ".2", path + ".3.gz"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("want no %s, got %v", filepath.Base(p), err)
+		}
+	}
+}
+
+func TestRotatingFileKeepNone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	rf, _ := openRotatingFile(path, false, rotationPolicy{MaxSize: 5})
+	rf.Write([]byte("aaaa\n"))
+	rf.Write([]byte("bbbb\n"))
+	rf.Close()
+	if got := readRotated(t, path, false); got != "bbbb\n" {
+		t.Fatalf("got '%s'", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("want no older files, got %v", err)
+	}
+}
+
+func TestRotatingFileByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	rf, _ := openRotatingFile(path, false, rotationPolicy{Interval: 20 * time.Millisecond, Keep: 1})
+	rf.Write([]byte("before\n"))
+	time.Sleep(50 * time.Millisecond)
+	rf.Write([]byte("after\n"))
+	rf.Close()
+	if got := readRotated(t, path+".1", false); got != "before\n" {
+		t.Fatalf("got '%s'", got)
+	}
+	if got := readRotated(t, path, false); got != "after\n" {
+		t.Fatalf("got '%s'", got)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.log")
+	rf, _ := openRotatingFile(path, false, rotationPolicy{})
+	rf.Write([]byte("one\n"))
+	// An external tool moves the file away, then asks for it to be reopened
+	os.Rename(path, filepath.Join(dir, "moved.log"))
+	if err := rf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte("two\n"))
+	rf.Close()
+	if got := readRotated(t, path, false); got != "two\n" {
+		t.Fatalf("got '%s'", got)
+	}
+	if _, err := rf.Write([]byte("closed")); err == nil {
+		t.Fatal("want an error writing after Close")
+	}
+}
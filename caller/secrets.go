@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// Decides which values are secret so they can be masked in anything glenv prints
+var _secrets = environment.NewSecretDetector()
+
+// Values of all processed variables that were found to be secret. Longest first.
+var _secretValues []string
+
+// Values shorter than this are never masked within other text. Avoids masking things like "1" everywhere.
+const MIN_MASKED_VALUE_LENGTH = 4
+
+// Provides the values in env that are secret, longest first, so they can be masked wherever they appear in output.
+// Values too short to mask are left out, with a warning if -redact was given
+func secretValuesOf(env *environment.VariableMap) []string {
+	values := []string{}
+	env.Range(func(k, v string) bool {
+		if !_secrets.IsSecret(k, v) {
+			return true
+		}
+		if len(v) >= MIN_MASKED_VALUE_LENGTH {
+			values = append(values, v)
+		} else if len(v) > 0 && _opts.RedactOutput {
+			log.Printf("Warning: '%s' is shorter than %d characters and won't be redacted", k, MIN_MASKED_VALUE_LENGTH)
+		}
+		return true
+	})
+	// Longer values first so a secret containing another is masked completely
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return values
+}
+
+// Provides the value of the variable called name as it should be printed. Secret values are masked unless -show-secrets was given.
+func displayValue(name string, value string) string {
+	if !_opts.ShowSecrets && _secrets.IsSecret(name, value) {
+		return environment.SECRET_MASK
+	}
+	return value
+}
+
+// Provides each "name=value" entry as it should be printed. Secret values are masked unless -show-secrets was given.
+func displayEntries(entries []string) []string {
+	displayed := make([]string, len(entries))
+	for i, e := range entries {
+		if k, v, ok := strings.Cut(e, "="); ok {
+			displayed[i] = fmt.Sprintf("%s=%s", k, displayValue(k, v))
+		} else {
+			displayed[i] = e
+		}
+	}
+	return displayed
+}
+
+// Masks any known secret values that appear within text unless -show-secrets was given.
+func maskSecretsIn(text string) string {
+	if _opts.ShowSecrets {
+		return text
+	}
+	for _, v := range _secretValues {
+		text = strings.ReplaceAll(text, v, environment.SECRET_MASK)
+	}
+	return text
+}
+
+// Options shared by the subcommands that edit secret values inside Environment files
+func addSecretEditOptions(targetFlag *flag.FlagSet) {
+	addKeyOptions(targetFlag)
+	targetFlag.Var(&_opts.SecretNames, "n", "Name of a variable to work on. You may supply multiple of these.")
+	targetFlag.BoolVar(&_opts.DoLogDebug, "debug.main", false, "True if you want most debug info displayed")
+}
+
+// Attempts to find the key for encrypted values.
+// The file at opts.KeyPath is used if given, otherwise the Environment Variable named by opts.KeyEnvName.
+// Returns nil without an error if neither is available.
+func loadKey(opts *OperationOptions) ([]byte, error) {
+	if len(opts.KeyPath) > 0 {
+		key, err := environment.ReadKeyFile(opts.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file '%s': %w", opts.KeyPath, err)
+		}
+		return key, nil
+	}
+	if len(opts.KeyEnvName) > 0 {
+		if encoded, ok := os.LookupEnv(opts.KeyEnvName); ok && len(encoded) > 0 {
+			key, err := environment.ParseKey(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read key from '%s': %w", opts.KeyEnvName, err)
+			}
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// Same as loadKey, but fails if no key could be found
+func requireKey(opts *OperationOptions) ([]byte, error) {
+	key, err := loadKey(opts)
+	if err == nil && key == nil {
+		err = fmt.Errorf("no key available. provide -key-file or set %s", opts.KeyEnvName)
+	}
+	return key, err
+}
+
+// Encrypts the values of the variables named with -n in each of the given Environment files
+func encryptAction() {
+	if len(_opts.SecretNames) == 0 {
+		log.Fatal("at least one variable name must be given with -n")
+	}
+	if _opts.GenerateKey && len(_opts.KeyPath) > 0 {
+		if err := generateKeyFile(_opts.KeyPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	key, err := requireKey(&_opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := namesToSet(_opts.SecretNames)
+	err = rewriteEnvFiles(&_opts, func(v environment.Variable) (string, bool, error) {
+		if !names[v.Name] {
+			return v.Value, false, nil
+		}
+		if environment.IsEncryptedValue(v.Value) {
+			fmt.Printf("'%s' is already encrypted. Skipping\n", v.Name)
+			return v.Value, false, nil
+		}
+		// Decrypted values aren't expanded, so a reference would be kept as literal text
+		if strings.Contains(v.Value, "$") {
+			return v.Value, false, fmt.Errorf("'%s' refers to other values or commands, which can't be encrypted. Encrypt the values it refers to instead", v.Name)
+		}
+		encrypted, err := environment.EncryptValue(v.Name, v.Value, key)
+		return encrypted, err == nil, err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Decrypts the values of the variables named with -n in each of the given Environment files
+func decryptAction() {
+	if len(_opts.SecretNames) == 0 {
+		log.Fatal("at least one variable name must be given with -n")
+	}
+	key, err := requireKey(&_opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := namesToSet(_opts.SecretNames)
+	err = rewriteEnvFiles(&_opts, func(v environment.Variable) (string, bool, error) {
+		if !names[v.Name] || !environment.IsEncryptedValue(v.Value) {
+			return v.Value, false, nil
+		}
+		plain, err := environment.DecryptValue(v.Name, v.Value, key)
+		return plain, err == nil, err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Re-encrypts encrypted values with the key at -new-key-file.
+// All encrypted values are rotated unless specific ones are named with -n
+func rotateKeyAction() {
+	if len(_opts.NewKeyPath) == 0 {
+		log.Fatal("-new-key-file must be given")
+	}
+	oldKey, err := requireKey(&_opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := generateKeyFile(_opts.NewKeyPath); err != nil {
+		log.Fatal(err)
+	}
+	newKey, err := environment.ReadKeyFile(_opts.NewKeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := namesToSet(_opts.SecretNames)
+	err = rewriteEnvFiles(&_opts, func(v environment.Variable) (string, bool, error) {
+		if (len(names) > 0 && !names[v.Name]) || !environment.IsEncryptedValue(v.Value) {
+			return v.Value, false, nil
+		}
+		plain, err := environment.DecryptValue(v.Name, v.Value, oldKey)
+		if err != nil {
+			return v.Value, false, err
+		}
+		encrypted, err := environment.EncryptValue(v.Name, plain, newKey)
+		return encrypted, err == nil, err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Writes a newly generated key to path. Does nothing if there is already a file there.
+func generateKeyFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := environment.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := environment.WriteKeyFile(path, key); err != nil {
+		return err
+	}
+	fmt.Printf("Generated new key: %s\n", path)
+	return nil
+}
+
+// Applies update to the variables in every Environment file found from opts.Globs.
+// Every file is rewritten to a temporary file first. None are replaced unless all of them were rewritten successfully.
+func rewriteEnvFiles(opts *OperationOptions, update func(v environment.Variable) (string, bool, error)) error {
+	if err := processEnvGlobs(opts); err != nil {
+		return err
+	}
+	if len(opts.EnvPaths) == 0 {
+		return errors.New("no environment files found")
+	}
+
+	rewritten := make([]string, 0, len(opts.EnvPaths))
+	defer func() {
+		// Only those that weren't moved into place are still there
+		for _, tmp := range rewritten {
+			if len(tmp) > 0 {
+				os.Remove(tmp)
+			}
+		}
+	}()
+	counts := make([]int, 0, len(opts.EnvPaths))
+	for _, p := range opts.EnvPaths {
+		changes := 0
+		countingUpdate := func(v environment.Variable) (string, bool, error) {
+			newValue, changed, err := update(v)
+			if changed {
+				changes++
+				if opts.DoLogDebug {
+					fmt.Printf("Updated '%s' in %s\n", v.Name, p)
+				}
+			}
+			return newValue, changed, err
+		}
+		tmp, err := rewriteEnvFile(p, countingUpdate)
+		if err != nil {
+			return fmt.Errorf("%s: %w. No files were changed", p, err)
+		}
+		rewritten = append(rewritten, tmp)
+		counts = append(counts, changes)
+	}
+
+	for i, p := range opts.EnvPaths {
+		if err := os.Rename(rewritten[i], p); err != nil {
+			return fmt.Errorf("%s: %w. Already replaced: %v", p, err, opts.EnvPaths[:i])
+		}
+		rewritten[i] = ""
+		fmt.Printf("%s: %d value(s) updated\n", p, counts[i])
+	}
+	return nil
+}
+
+// Rewrites the Environment file at path through environment.RewriteValues into a temporary file next to it, keeping the original's permissions.
+// Returns the temporary file's path. It's up to the caller to move it into place
+func rewriteEnvFile(path string, update func(v environment.Variable) (string, bool, error)) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	fIn, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fIn.Close()
+
+	fOut, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	err = environment.RewriteValues(fIn, fOut, update)
+	if err == nil {
+		err = fOut.Chmod(info.Mode().Perm())
+	}
+	if closeErr := fOut.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fOut.Name())
+		return "", err
+	}
+	return fOut.Name(), nil
+}
+
+// Converts a list of names to a set for quick lookups
+func namesToSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return set
+}
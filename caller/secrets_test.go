@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+func TestRewriteEnvFilesAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.env": "PASS=a\n", "b.env": "PASS=b\n", "c.env": "PASS=bad\n"}
+	writeFiles(t, dir, files)
+	opts := CreateDefaultOperationOptions()
+	opts.Globs = []string{filepath.Join(dir, "a.env"), filepath.Join(dir, "b.env"), filepath.Join(dir, "c.env")}
+
+	// The last file failing leaves the ones before it as they were
+	err := rewriteEnvFiles(&opts, func(v environment.Variable) (string, bool, error) {
+		if v.Value == "bad" {
+			return v.Value, false, errors.New("wrong key")
+		}
+		return "rotated", true, nil
+	})
+	if err == nil {
+		t.Fatal("want the rewrite to fail")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != len(files) {
+		t.Fatalf("want the temporary files removed, got %d files", len(entries))
+	}
+	for name, content := range files {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != content {
+			t.Fatalf("%s: want `%s` left alone, got `%s`", name, content, got)
+		}
+	}
+
+	opts.EnvPaths = nil
+	if err := rewriteEnvFiles(&opts, func(v environment.Variable) (string, bool, error) {
+		return "rotated", true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != "PASS=rotated\n" {
+			t.Fatalf("%s: want it rewritten, got `%s`", name, got)
+		}
+	}
+}
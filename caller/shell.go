@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// Set inside shells started by glenv. Holds the shell's label
+const SHELL_MARKER_ENV = "GLENV_SHELL"
+
+// Works out the shell to start. The -shell flag wins, then $SHELL, then the system's default shell.
+func chooseShell(opts *OperationOptions) (string, error) {
+	shell := opts.ShellPath
+	if len(shell) == 0 {
+		shell = os.Getenv("SHELL")
+	}
+	if len(shell) == 0 {
+		shell, _ = shellInvocation("")
+	}
+	return exec.LookPath(shell)
+}
+
+// Provides the label shown in the prompt. Defaults to the last part of each env file's name before '.env'.
+// Ex 'finances.mac.env finances.local.env' gives 'mac,local'
+func shellLabel(opts *OperationOptions) string {
+	if len(opts.ShellLabel) > 0 {
+		return opts.ShellLabel
+	}
+	names := []string{}
+	seen := map[string]bool{}
+	for _, p := range opts.EnvPaths {
+		name := strings.TrimSuffix(filepath.Base(p), ".env")
+		if i := strings.LastIndex(name, "."); i >= 0 && i < len(name)-1 {
+			name = name[i+1:]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "env"
+	}
+	return strings.Join(names, ",")
+}
+
+// Sets up the given shell so its prompt starts with prompt and the init commands run once it has loaded the user's
+// own startup files. Startup files written for this go in dir.
+// Returns any extra arguments and environment entries the shell needs.
+func shellStartup(shell string, prompt string, initCommands []string, dir string) (args []string, env []string, err error) {
+	write := func(name string, lines ...string) (string, error) {
+		path := filepath.Join(dir, name)
+		return path, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+
+	switch name := strings.TrimSuffix(filepath.Base(shell), ".exe"); name {
+	case "bash":
+		lines := []string{`[ -f ~/.bashrc ] && . ~/.bashrc`, fmt.Sprintf(`PS1=%s"$PS1"`, environment.QuotePosix(prompt))}
+		rc, err := write("bashrc", append(lines, initCommands...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{"--rcfile", rc, "-i"}, nil, nil
+	case "zsh":
+		// zsh only reads its startup files from ZDOTDIR. Ours load the user's, wherever they are, then put ZDOTDIR back
+		original, hadOriginal := os.LookupEnv("ZDOTDIR")
+		restore := "unset ZDOTDIR"
+		if hadOriginal {
+			restore = "ZDOTDIR=" + environment.QuotePosix(original)
+		}
+		userDir := environment.QuotePosix(original)
+		if !hadOriginal {
+			userDir = `"$HOME"`
+		}
+		if _, err := write(".zshenv", fmt.Sprintf(`[ -f %s/.zshenv ] && . %s/.zshenv`, userDir, userDir)); err != nil {
+			return nil, nil, err
+		}
+		lines := []string{
+			restore,
+			fmt.Sprintf(`[ -f %s/.zshrc ] && . %s/.zshrc`, userDir, userDir),
+			fmt.Sprintf(`PROMPT=%s"$PROMPT"`, environment.QuotePosix(prompt)),
+		}
+		if _, err := write(".zshrc", append(lines, initCommands...)...); err != nil {
+			return nil, nil, err
+		}
+		return []string{"-i"}, []string{"ZDOTDIR=" + dir}, nil
+	case "fish":
+		lines := []string{
+			"functions -c fish_prompt _glenv_fish_prompt",
+			fmt.Sprintf("function fish_prompt; printf '%%s' %s; _glenv_fish_prompt; end", environment.QuoteFish(prompt)),
+		}
+		return []string{"--init-command", strings.Join(append(lines, initCommands...), "; ")}, nil, nil
+	case "cmd":
+		init := append([]string{"prompt " + prompt + "$P$G"}, initCommands...)
+		return []string{"/K", strings.Join(init, " & ")}, nil, nil
+	default:
+		// POSIX shells run the file named by ENV when they start interactively
+		lines := []string{fmt.Sprintf(`PS1=%s"${PS1:-$ }"`, environment.QuotePosix(prompt))}
+		rc, err := write("shrc", append(lines, initCommands...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{"-i"}, []string{"ENV=" + rc}, nil
+	}
+}
+
+// Starts an interactive shell with the env files applied, and waits for it to exit.
+// Our own shell is left untouched. glenv exits with the shell's exit code.
+func startShellAction() {
+	shell, err := chooseShell(&_opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	envProcessed, err := readEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	label := shellLabel(&_opts)
+	prompt := fmt.Sprintf("(glenv:%s) ", label)
+	if outer := os.Getenv(SHELL_MARKER_ENV); len(outer) > 0 {
+		log.Printf("already inside a glenv shell (%s). starting another one inside it", outer)
+	}
+
+	if _opts.IsTest {
+		fmt.Println("####--------++--------####")
+		fmt.Printf("Shell: %s\n", shell)
+		fmt.Printf("Prompt: %s\n", prompt)
+		for _, c := range _opts.ShellInit {
+			fmt.Printf("Init: %s\n", maskSecretsIn(c))
+		}
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "glenv-shell-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	args, extraEnv, err := shellStartup(shell, prompt, _opts.ShellInit, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Fatal(err)
+	}
+	cmd, err := buildCommand(shell, args, envProcessed, _opts.Unset)
+	if err != nil {
+		os.RemoveAll(dir)
+		log.Fatal(err)
+	}
+	cmd.Env = append(cmd.Env, extraEnv...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", SHELL_MARKER_ENV, label))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// The shell deals with Ctrl+C itself. glenv shouldn't exit underneath it.
+	// Ignoring the signal outright would be inherited by the shell
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+		}
+	}()
+
+	fmt.Fprintf(os.Stderr, "Starting %s. Exit it to return\n", shell)
+	err = cmd.Run()
+	os.RemoveAll(dir)
+	if err != nil && cmd.ProcessState == nil {
+		log.Fatal(err)
+	}
+	os.Exit(exitCodeOf(err))
+}
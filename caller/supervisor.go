@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const (
+	// Never restart the command
+	RESTART_NO = "no"
+	// Restart the command if it exits with a non-zero exit code or is killed
+	RESTART_ON_FAILURE = "on-failure"
+	// Restart the command whenever it exits
+	RESTART_ALWAYS = "always"
+)
+
+// Describes when, and how often, a command should be restarted after it exits
+type restartPolicy struct {
+	// One of RESTART_NO, RESTART_ON_FAILURE or RESTART_ALWAYS
+	Mode string
+	// Delay before the first restart. Doubles for each restart after a run shorter than MinUptime
+	Delay time.Duration
+	// Longest the delay between restarts can grow to
+	MaxDelay time.Duration
+	// Most restarts allowed within Window. 0 means there is no limit
+	MaxRestarts int
+	// Period of time that MaxRestarts applies to
+	Window time.Duration
+	// Runs at least this long are considered healthy and reset the delay back to Delay
+	MinUptime time.Duration
+	// Shell command to run whenever the command fails
+	OnCrash string
+}
+
+// Makes sure the policy is usable
+func (rp restartPolicy) Validate() error {
+	switch rp.Mode {
+	case RESTART_NO, RESTART_ON_FAILURE, RESTART_ALWAYS:
+	default:
+		return fmt.Errorf("unknown restart policy '%s'. expecting '%s', '%s' or '%s'", rp.Mode, RESTART_NO, RESTART_ON_FAILURE, RESTART_ALWAYS)
+	}
+	if rp.Delay < 0 || rp.MaxDelay < 0 || rp.Window < 0 || rp.MinUptime < 0 || rp.MaxRestarts < 0 {
+		return errors.New("restart delays, windows and limits can't be negative")
+	}
+	return nil
+}
+
+// Describes the policy in a human readable way
+func (rp restartPolicy) String() string {
+	if rp.Mode == RESTART_NO {
+		return RESTART_NO
+	}
+	desc := fmt.Sprintf("%s, delay %s up to %s, min uptime %s", rp.Mode, rp.Delay, rp.MaxDelay, rp.MinUptime)
+	if rp.MaxRestarts > 0 {
+		desc += fmt.Sprintf(", at most %d restarts per %s", rp.MaxRestarts, rp.Window)
+	}
+	if len(rp.OnCrash) > 0 {
+		desc += fmt.Sprintf(", on crash run `%s`", rp.OnCrash)
+	}
+	return desc
+}
+
+// Should a command that exited with exitCode be restarted?
+func (rp restartPolicy) shouldRestart(exitCode int) bool {
+	switch rp.Mode {
+	case RESTART_ALWAYS:
+		return true
+	case RESTART_ON_FAILURE:
+		return exitCode != 0
+	}
+	return false
+}
+
+// Runs a command and restarts it according to a restartPolicy.
+// Status is reported through the standard logger.
+type supervisor struct {
+	// Name used in status messages
+	name   string
+	policy restartPolicy
+	// Builds a fresh command to run. Called again before every restart so changes to the environment take effect.
+	prepare func() (*exec.Cmd, error)
+
+	// Receives a value whenever the environment may have changed. nil if nothing is being watched
+	changes <-chan struct{}
+	// Checks that a changed environment is usable. Changes are ignored if it fails
+	validate func() error
+	// Signal sent to the command when the environment changes. The command is restarted instead if this is nil
+	changeSignal os.Signal
+	// How long the command gets to exit after being asked to stop, before it is killed. 0 waits forever when stopping
+	stopGrace time.Duration
+	// Called once the command has started, and once it has exited or failed to start. Either may be nil
+	started  func(cmd *exec.Cmd)
+	finished func(cmd *exec.Cmd)
+	// Longest each run of the command may take before it is asked to stop. 0 means no limit
+	timeout time.Duration
+	// File mode creation mask the command is started with. Negative to leave it as it is
+	umask int
+	// Set while the command is being stopped so it can be restarted with a changed environment
+	reloading bool
+
+	// Times of the restarts that happened within the policy's window
+	restarts []time.Time
+	delay    time.Duration
+	// Receives the signals that ask the command to stop, whether they came from outside of glenv or from Stop
+	stop chan os.Signal
+	// Set once glenv has been asked to stop. No more restarts will happen
+	stopping bool
+	// Provides the current time when counting restarts. Only replaced by tests
+	now func() time.Time
+}
+
+func newSupervisor(name string, policy restartPolicy, prepare func() (*exec.Cmd, error)) *supervisor {
+	return &supervisor{name: name, policy: policy, prepare: prepare, delay: policy.Delay, umask: -1, stop: make(chan os.Signal, 1), now: time.Now}
+}
+
+// Asks the supervisor to stop its command and not restart it. Safe to call from any goroutine.
+func (s *supervisor) Stop() {
+	select {
+	case s.stop <- syscall.SIGTERM:
+	default:
+		// Already asked to stop
+	}
+}
+
+// Runs the command until it exits for good, or glenv is told to stop.
+// Returns the exit code of the last run of the command.
+func (s *supervisor) Run() (exitCode int, err error) {
+	stop := s.stop
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	for runCount := 0; ; runCount++ {
+		cmd, err := s.prepare()
+		if err != nil {
+			return 1, err
+		}
+
+		started := time.Now()
+		exitCode, err = s.runOnce(cmd, stop)
+		if err != nil && runCount == 0 {
+			// Couldn't start at all. Restarting won't help
+			return exitCode, err
+		} else if err != nil {
+			log.Printf("[%s] %s", s.name, err)
+		}
+		uptime := time.Since(started)
+
+		if s.stopping {
+			log.Printf("[%s] stopped with exit code %d", s.name, exitCode)
+			return exitCode, nil
+		}
+		if s.reloading {
+			// Stopped on purpose. Start again right away with the new environment
+			s.reloading = false
+			continue
+		}
+		if exitCode != 0 {
+			log.Printf("[%s] crashed with exit code %d after %s", s.name, exitCode, uptime.Round(time.Millisecond))
+			s.runCrashHook(cmd, exitCode, uptime, runCount)
+		}
+		if !s.policy.shouldRestart(exitCode) {
+			return exitCode, nil
+		}
+		if !s.allowRestart(uptime) {
+			log.Printf("[%s] restarted %d times within %s. giving up", s.name, len(s.restarts), s.policy.Window)
+			return exitCode, nil
+		}
+
+		log.Printf("[%s] restarting in %s", s.name, s.delay)
+		select {
+		case <-time.After(s.delay):
+		case <-stop:
+			log.Printf("[%s] stopped while waiting to restart", s.name)
+			return exitCode, nil
+		}
+		s.backOff()
+	}
+}
+
+// Doubles the delay before the next restart, up to the policy's MaxDelay
+func (s *supervisor) backOff() {
+	s.delay *= 2
+	if s.delay > s.policy.MaxDelay {
+		s.delay = s.policy.MaxDelay
+	}
+}
+
+// Starts cmd and waits for it to exit. Signals received on stop are passed on to the command.
+func (s *supervisor) runOnce(cmd *exec.Cmd, stop chan os.Signal) (exitCode int, err error) {
+	if err := startWithUmask(cmd, s.umask); err != nil {
+		if s.finished != nil {
+			s.finished(cmd)
+		}
+		return 127, fmt.Errorf("failed to start command: %w", err)
+	}
+	if s.started != nil {
+		s.started(cmd)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var timedOut <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+	// Fires if the command takes too long to stop for a restart
+	var forceKill <-chan time.Time
+	for {
+		select {
+		case err := <-done:
+			if s.finished != nil {
+				s.finished(cmd)
+			}
+			return exitCodeOf(err), nil
+		case sig := <-stop:
+			if !s.stopping && s.stopGrace > 0 {
+				forceKill = time.After(s.stopGrace)
+			}
+			s.stopping = true
+			forwardSignal(cmd, sig)
+		case <-s.changes:
+			if s.reloading || s.stopping {
+				continue
+			}
+			if s.validate != nil {
+				if err := s.validate(); err != nil {
+					log.Printf("[%s] environment changed but is invalid. keeping the current one: %s", s.name, err)
+					continue
+				}
+			}
+			if s.changeSignal != nil {
+				log.Printf("[%s] environment changed. sending %s", s.name, s.changeSignal)
+				forwardSignal(cmd, s.changeSignal)
+			} else {
+				log.Printf("[%s] environment changed. restarting", s.name)
+				s.reloading = true
+				forceKill = requestStop(cmd, s.stopGrace)
+			}
+		case <-timedOut:
+			if s.reloading || s.stopping {
+				continue
+			}
+			log.Printf("[%s] timed out after %s. stopping", s.name, s.timeout)
+			forceKill = requestStop(cmd, s.stopGrace)
+		case <-forceKill:
+			log.Printf("[%s] didn't stop within %s. killing", s.name, s.stopGrace)
+			cmd.Process.Kill()
+		}
+	}
+}
+
+// Asks the command to exit. Returns a channel that fires once it has had grace to do so.
+// The command is killed right away if it can't be asked nicely.
+func requestStop(cmd *exec.Cmd, grace time.Duration) <-chan time.Time {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+		return nil
+	}
+	if grace <= 0 {
+		return nil
+	}
+	return time.After(grace)
+}
+
+// Tracks another restart. Returns false if the policy doesn't allow any more restarts right now.
+func (s *supervisor) allowRestart(uptime time.Duration) bool {
+	now := s.now()
+	// A healthy run starts the backoff over
+	if uptime >= s.policy.MinUptime {
+		s.delay = s.policy.Delay
+	}
+
+	if s.policy.MaxRestarts > 0 {
+		recent := s.restarts[:0]
+		for _, t := range s.restarts {
+			if now.Sub(t) < s.policy.Window {
+				recent = append(recent, t)
+			}
+		}
+		s.restarts = recent
+		if len(s.restarts) >= s.policy.MaxRestarts {
+			return false
+		}
+	}
+	s.restarts = append(s.restarts, now)
+	return true
+}
+
+// Runs the policy's OnCrash command, if there is one. Details of the crash are provided through its environment.
+func (s *supervisor) runCrashHook(crashed *exec.Cmd, exitCode int, uptime time.Duration, runCount int) {
+	if len(s.policy.OnCrash) == 0 {
+		return
+	}
+	hook := shellCommand(s.policy.OnCrash)
+	hook.Env = append(crashed.Environ(),
+		fmt.Sprintf("GLENV_NAME=%s", s.name),
+		fmt.Sprintf("GLENV_EXIT_CODE=%d", exitCode),
+		fmt.Sprintf("GLENV_UPTIME=%s", uptime.Round(time.Millisecond)),
+		fmt.Sprintf("GLENV_RESTARTS=%d", runCount),
+	)
+	hook.Stdout = os.Stderr
+	hook.Stderr = os.Stderr
+	if err := hook.Run(); err != nil {
+		log.Printf("[%s] crash hook failed: %s", s.name, err)
+	}
+}
+
+// Passes sig on to the command.
+// Interrupts aren't passed on as the terminal already sends them to the whole foreground process group, unless the
+// command has a process group of its own.
+func forwardSignal(cmd *exec.Cmd, sig os.Signal) {
+	if (sig == os.Interrupt && !inOwnProcessGroup(cmd)) || cmd.Process == nil {
+		return
+	}
+	if err := cmd.Process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		log.Printf("failed to pass on signal %s: %s", sig, err)
+	}
+}
+
+// Provides the exit code for the result of running a command.
+// Commands that were killed by a signal are given 128 plus the signal's number, the same as a shell would.
+func exitCodeOf(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// Creates a command that runs the given command line through the system's shell
+func shellCommand(commandLine string) *exec.Cmd {
+	shell, args := shellInvocation(commandLine)
+	return exec.Command(shell, args...)
+}
+
+// Provides the shell, and the arguments for it, that will run the given command line
+func shellInvocation(commandLine string) (shell string, args []string) {
+	if runtime.GOOS == "windows" {
+		return "cmd", []string{"/C", commandLine}
+	}
+	return "/bin/sh", []string{"-c", commandLine}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// Creates a supervisor for policy whose clock only moves when the returned function is called
+func newTestSupervisor(policy restartPolicy) (*supervisor, func(time.Duration)) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newSupervisor("test", policy, nil)
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRestartPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		mode     string
+		exitCode int
+		want     bool
+	}{
+		{RESTART_NO, 1, false},
+		{RESTART_ON_FAILURE, 0, false},
+		{RESTART_ON_FAILURE, 137, true},
+		{RESTART_ALWAYS, 0, true},
+	} {
+		if got := (restartPolicy{Mode: tt.mode}).shouldRestart(tt.exitCode); got != tt.want {
+			t.Fatalf("%s after exit code %d: want %t, got %t", tt.mode, tt.exitCode, tt.want, got)
+		}
+	}
+
+	if err := (restartPolicy{Mode: "sometimes"}).Validate(); err == nil {
+		t.Fatal("want an error for an unknown mode")
+	}
+	if err := (restartPolicy{Mode: RESTART_ALWAYS, Delay: -time.Second}).Validate(); err == nil {
+		t.Fatal("want an error for a negative delay")
+	}
+}
+
+func TestAllowRestartWindow(t *testing.T) {
+	s, advance := newTestSupervisor(restartPolicy{Mode: RESTART_ALWAYS, MaxRestarts: 2, Window: time.Minute})
+	if !s.allowRestart(0) {
+		t.Fatal("want the first restart allowed")
+	}
+	advance(30 * time.Second)
+	if !s.allowRestart(0) {
+		t.Fatal("want the second restart allowed")
+	}
+	if s.allowRestart(0) {
+		t.Fatal("want a third restart within the window refused")
+	}
+
+	// Refused restarts aren't counted, so the window is still measured from the first restart
+	advance(29 * time.Second)
+	if s.allowRestart(0) {
+		t.Fatal("want restarts refused until the first one leaves the window")
+	}
+	advance(time.Second)
+	if !s.allowRestart(0) {
+		t.Fatal("want a restart allowed once the first one has left the window")
+	}
+	if s.allowRestart(0) {
+		t.Fatal("want the restart just allowed to count towards the window")
+	}
+	if len(s.restarts) != 2 {
+		t.Fatalf("want only the restarts within the window kept, got %d", len(s.restarts))
+	}
+
+	// Without MaxRestarts there is no limit
+	s, _ = newTestSupervisor(restartPolicy{Mode: RESTART_ALWAYS, Window: time.Minute})
+	for i := 0; i < 100; i++ {
+		if !s.allowRestart(0) {
+			t.Fatalf("want restart %d allowed", i)
+		}
+	}
+}
+
+func TestBackOff(t *testing.T) {
+	s, _ := newTestSupervisor(restartPolicy{Mode: RESTART_ALWAYS, Delay: time.Second, MaxDelay: 5 * time.Second, MinUptime: time.Minute})
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		s.allowRestart(time.Second)
+		delays = append(delays, s.delay)
+		s.backOff()
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Fatalf("want delays %v, got %v", want, delays)
+		}
+	}
+
+	// A run of at least MinUptime starts the delay over
+	s.allowRestart(time.Minute)
+	if s.delay != time.Second {
+		t.Fatalf("want the delay reset to 1s, got %s", s.delay)
+	}
+}
+
+func TestSupervisorRun(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	runs := 0
+	prepare := func() (*exec.Cmd, error) {
+		runs++
+		return shellCommand("exit 3"), nil
+	}
+	policy := restartPolicy{Mode: RESTART_ON_FAILURE, Delay: time.Millisecond, MaxDelay: 3 * time.Millisecond,
+		MaxRestarts: 4, Window: time.Minute, MinUptime: time.Hour}
+	s := newSupervisor("test", policy, prepare)
+	exitCode, err := s.Run()
+	if err != nil || exitCode != 3 {
+		t.Fatalf("want exit code 3, got %d %v", exitCode, err)
+	}
+	// The first run then the 4 restarts the window allows
+	if runs != 5 {
+		t.Fatalf("want 5 runs, got %d", runs)
+	}
+	if s.delay != policy.MaxDelay {
+		t.Fatalf("want the delay capped at %s, got %s", policy.MaxDelay, s.delay)
+	}
+
+	// A clean exit isn't restarted on failure
+	runs = 0
+	s = newSupervisor("test", policy, func() (*exec.Cmd, error) {
+		runs++
+		return shellCommand("exit 0"), nil
+	})
+	if exitCode, err := s.Run(); err != nil || exitCode != 0 || runs != 1 {
+		t.Fatalf("want one clean run, got %d runs, exit code %d %v", runs, exitCode, err)
+	}
+
+	// Once asked to stop, the command is never restarted however long the delay
+	s = newSupervisor("test", restartPolicy{Mode: RESTART_ALWAYS, Delay: time.Hour}, func() (*exec.Cmd, error) {
+		return shellCommand("exit 0"), nil
+	})
+	s.Stop()
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("want Run to return once stopped")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+// A change made to the processed environment by one of the flags such as -only. Ex '-only LOGSTASH_*'
+type envTransform struct {
+	// Name of the flag that asked for it
+	Flag string
+	// Value given to the flag
+	Arg string
+}
+
+func (et envTransform) String() string {
+	return fmt.Sprintf("-%s %s", et.Flag, et.Arg)
+}
+
+// Adds each use of a transform flag to a list shared by all of them, so they're applied in the order they were given
+type transformFlag struct {
+	name string
+	list *[]envTransform
+}
+
+func (tf transformFlag) String() string {
+	return ""
+}
+
+func (tf transformFlag) Set(value string) error {
+	switch tf.name {
+	case "only-regex":
+		if _, err := regexp.Compile(value); err != nil {
+			return err
+		}
+	case "rename":
+		if from, to, ok := strings.Cut(value, "="); !ok || len(from) == 0 || len(to) == 0 {
+			return fmt.Errorf("expecting OLD=NEW, or OLD_*=NEW_* for a prefix, got '%s'", value)
+		}
+	}
+	*tf.list = append(*tf.list, envTransform{Flag: tf.name, Arg: value})
+	return nil
+}
+
+// Options for slicing the environment before it's used. They can be chained and are applied in the order given.
+// Ex '-only LOGSTASH_* -strip-prefix LOGSTASH_'
+func addTransformOptions(targetFlag *flag.FlagSet) {
+	transforms := []struct{ name, usage string }{
+		{"only", "Keeps only the variables whose names match this glob. Ex 'LOGSTASH_*'"},
+		{"except", "Removes the variables whose names match this glob"},
+		{"only-regex", "Keeps only the variables whose names match this regular expression"},
+		{"strip-prefix", "Takes this prefix off of the names that start with it"},
+		{"add-prefix", "Puts this prefix in front of every name"},
+		{"rename", "Renames a variable, given as OLD=NEW. 'DB_*=ELASTIC_*' renames every variable starting with DB_"},
+		{"intersect", "Keeps only the variables that are also defined by this env file"},
+		{"subtract", "Removes the variables that are also defined by this env file"},
+		{"merge", "Adds the variables from this env file. -merge-conflict decides which value is used when both have one"},
+	}
+	for _, t := range transforms {
+		targetFlag.Var(transformFlag{name: t.name, list: &_opts.Transforms}, t.name, t.usage+". You may supply multiple of these. All of these are applied in the order given")
+	}
+	targetFlag.StringVar(&_opts.MergeConflict, "merge-conflict", string(environment.MERGE_LAST_WINS), fmt.Sprintf("What -merge does when a variable already has a different value. One of '%s', '%s' or '%s'", environment.MERGE_FIRST_WINS, environment.MERGE_LAST_WINS, environment.MERGE_ERROR))
+}
+
+// Applies the transforms from the command line to env, in order. Env files named by them are read with processOpts
+func applyTransforms(env *environment.VariableMap, processOpts environment.ProcessOptions) (*environment.VariableMap, error) {
+	// Env files read for a transform don't count towards where variables came from, or what was unset
+	processOpts.Provenance = nil
+	processOpts.Unset = nil
+
+	var err error
+	for _, t := range _opts.Transforms {
+		var rename func(name string) string
+		switch t.Flag {
+		case "only":
+			env, err = env.FilterGlob(t.Arg)
+		case "except":
+			env, err = env.ExcludeGlob(t.Arg)
+		case "only-regex":
+			env = env.FilterRegex(regexp.MustCompile(t.Arg))
+		case "strip-prefix":
+			prefix := t.Arg
+			rename = func(n string) string { return strings.TrimPrefix(n, prefix) }
+		case "add-prefix":
+			prefix := t.Arg
+			rename = func(n string) string { return prefix + n }
+		case "rename":
+			from, to, _ := strings.Cut(t.Arg, "=")
+			if strings.HasSuffix(from, "*") && strings.HasSuffix(to, "*") {
+				from, to = strings.TrimSuffix(from, "*"), strings.TrimSuffix(to, "*")
+				rename = func(n string) string {
+					if strings.HasPrefix(n, from) {
+						return to + strings.TrimPrefix(n, from)
+					}
+					return n
+				}
+			} else {
+				rename = func(n string) string {
+					if n == from {
+						return to
+					}
+					return n
+				}
+			}
+		case "intersect", "subtract", "merge":
+			other := environment.NewVariableMap()
+			if err = environment.ProcessEnvironmentFileWith(t.Arg, other, processOpts); err != nil {
+				break
+			}
+			switch t.Flag {
+			case "intersect":
+				env = env.Intersect(other)
+			case "subtract":
+				env = env.Subtract(other)
+			default:
+				var strategy environment.MergeStrategy
+				if strategy, err = environment.ParseMergeStrategy(_opts.MergeConflict); err == nil {
+					env, err = env.Merge(other, strategy)
+				}
+			}
+		}
+		if rename != nil {
+			if err = checkRenames(env, rename); err == nil {
+				markRenamedSecrets(env, rename)
+				env = env.RenameFunc(rename)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+	}
+	return env, nil
+}
+
+// Makes sure rename gives every variable in env a name, and that no two of them end up with the same one.
+// RenameFunc would otherwise drop them, or keep only the last value, without a word
+func checkRenames(env *environment.VariableMap, rename func(name string) string) error {
+	renamedFrom := map[string]string{}
+	var err error
+	env.Range(func(n, _ string) bool {
+		to := rename(n)
+		if len(to) == 0 {
+			err = fmt.Errorf("'%s' would have no name left", n)
+			return false
+		}
+		if from, ok := renamedFrom[to]; ok {
+			err = fmt.Errorf("'%s' and '%s' would both be named '%s'", from, n, to)
+			return false
+		}
+		renamedFrom[to] = n
+		return true
+	})
+	return err
+}
+
+// Marks the new name of each secret variable in env as secret, so it stays masked after being renamed.
+// Secrets are known by name, ex from -secret or decryption, so would otherwise be shown under their new one
+func markRenamedSecrets(env *environment.VariableMap, rename func(name string) string) {
+	env.Range(func(n, v string) bool {
+		if to := rename(n); len(to) > 0 && to != n && _secrets.IsSecret(n, v) {
+			_secrets.Mark(to)
+		}
+		return true
+	})
+}
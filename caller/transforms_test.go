@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Kynreuten/go-llama-utils/environment"
+)
+
+func TestTransformsKeepSecrets(t *testing.T) {
+	_opts = CreateDefaultOperationOptions()
+	_secrets = environment.NewSecretDetector()
+	t.Cleanup(func() {
+		_opts = CreateDefaultOperationOptions()
+		_secrets = environment.NewSecretDetector()
+		_secretValues = nil
+	})
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"cert":    "-----cert-----\n",
+		"app.env": "LOGSTASH_PIN=8472\nLOGSTASH_CERT=@file:cert\nDB_PASSWORD=hunter2\nLOGSTASH_HOME=/opt/logstash\n",
+	})
+	// Marked by -secret, read from a file and matching a secret name, each under the name it was defined with
+	_secrets.Mark("LOGSTASH_PIN")
+	processOpts := environment.ProcessOptions{Secrets: _secrets, FileRefs: environment.NewFileRefOptions()}
+	env := environment.NewVariableMap()
+	if err := environment.ProcessEnvironmentFileWith(filepath.Join(dir, "app.env"), env, processOpts); err != nil {
+		t.Fatal(err)
+	}
+
+	_opts.Transforms = []envTransform{{Flag: "strip-prefix", Arg: "LOGSTASH_"}, {Flag: "rename", Arg: "DB_*=ES_*"}, {Flag: "add-prefix", Arg: "APP_"}}
+	env, err := applyTransforms(env, processOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(env.Names(), ","); got != "APP_PIN,APP_CERT,APP_ES_PASSWORD,APP_HOME" {
+		t.Fatalf("want the renamed variables, got %s", got)
+	}
+	_secretValues = secretValuesOf(env)
+	for _, name := range []string{"APP_PIN", "APP_CERT", "APP_ES_PASSWORD"} {
+		if got := displayValue(name, env.Get(name)); got != environment.SECRET_MASK {
+			t.Fatalf("%s: want the value masked, got '%s'", name, got)
+		}
+	}
+	if got := displayValue("APP_HOME", env.Get("APP_HOME")); got != "/opt/logstash" {
+		t.Fatalf("want other values shown, got '%s'", got)
+	}
+	if got := maskSecretsIn("pin 8472 from -----cert-----"); got != "pin **** from ****" {
+		t.Fatalf("want the secrets masked in child output, got '%s'", got)
+	}
+}
+
+func TestTransformsRefuseLostNames(t *testing.T) {
+	_opts = CreateDefaultOperationOptions()
+	t.Cleanup(func() { _opts = CreateDefaultOperationOptions() })
+
+	tests := []struct {
+		transform envTransform
+		wantErr   string
+	}{
+		{envTransform{Flag: "strip-prefix", Arg: "LOGSTASH_"}, "'LOGSTASH_' would have no name left"},
+		{envTransform{Flag: "rename", Arg: "LOGSTASH_*=*"}, "'LOGSTASH_' would have no name left"},
+		{envTransform{Flag: "rename", Arg: "HOME=JAVA_HOME"}, "'JAVA_HOME' and 'HOME' would both be named 'JAVA_HOME'"},
+	}
+	for _, tt := range tests {
+		env := environment.NewVariableMap()
+		env.Set("JAVA_HOME", "/opt/java")
+		env.Set("HOME", "/home/me")
+		env.Set("LOGSTASH_", "odd")
+		_opts.Transforms = []envTransform{tt.transform}
+		if _, err := applyTransforms(env, environment.ProcessOptions{}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Fatalf("%s: want an error containing '%s', got %v", tt.transform, tt.wantErr, err)
+		}
+	}
+}
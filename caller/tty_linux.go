@@ -0,0 +1,269 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Byte a terminal sends for Ctrl+D. Tells the command its input has ended
+const TTY_END_OF_INPUT = 0x04
+
+// Longest to wait for the rest of the command's output once it has exited.
+// Anything it started in the background may keep the terminal open.
+const TTY_DRAIN_TIMEOUT = 2 * time.Second
+
+// Terminal size as used by the TIOCGWINSZ and TIOCSWINSZ ioctls
+type windowSize struct {
+	Rows    uint16
+	Columns uint16
+	XPixels uint16
+	YPixels uint16
+}
+
+// Runs commands on a pseudo-terminal so they behave as they would when run from a shell.
+// Our own terminal is put into raw mode so keys are passed through untouched. Its size is kept in sync with the
+// pseudo-terminal's.
+type ttySession struct {
+	// Where everything the command writes to its terminal ends up
+	out io.Writer
+
+	mu sync.Mutex
+	// Our end of the current command's pseudo-terminal
+	master *os.File
+	// The command's end. Closed once the command has started
+	slave *os.File
+	// Closed once everything the current command wrote has been copied to out
+	copied chan struct{}
+	// Input that arrived while no command was running. Given to the next one
+	pending []byte
+
+	// Settings our terminal had before raw mode. nil if stdin isn't a terminal
+	saved *syscall.Termios
+	// Receives SIGWINCH when our terminal is resized
+	resized chan os.Signal
+}
+
+// Starts a session that copies the output of each command to out.
+func newTTYSession(out io.Writer) (*ttySession, error) {
+	ts := &ttySession{out: out, resized: make(chan os.Signal, 1)}
+	if isTerminal(os.Stdin) {
+		saved, err := getTermios(os.Stdin.Fd())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read terminal settings: %w", err)
+		}
+		raw := *saved
+		makeRaw(&raw)
+		if err := setTermios(os.Stdin.Fd(), &raw); err != nil {
+			return nil, fmt.Errorf("failed to put terminal into raw mode: %w", err)
+		}
+		ts.saved = saved
+
+		signal.Notify(ts.resized, syscall.SIGWINCH)
+		go func() {
+			for range ts.resized {
+				ts.mu.Lock()
+				ts.syncSize()
+				ts.mu.Unlock()
+			}
+		}()
+	}
+	go ts.pumpInput()
+	return ts, nil
+}
+
+// Gives cmd a new pseudo-terminal for its input and output, and makes it the command's controlling terminal
+func (ts *ttySession) Prepare(cmd *exec.Cmd) error {
+	master, slave, err := openPTY()
+	if err != nil {
+		return fmt.Errorf("failed to open a pseudo-terminal: %w", err)
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	// Stdin in the command
+	cmd.SysProcAttr.Ctty = 0
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.master = master
+	ts.slave = slave
+	ts.copied = make(chan struct{})
+	ts.syncSize()
+	if len(ts.pending) > 0 {
+		master.Write(ts.pending)
+		ts.pending = nil
+	}
+	return nil
+}
+
+// Starts copying the command's output once it is running
+func (ts *ttySession) Started(cmd *exec.Cmd) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	// Only the command should hold its end open, so reads fail once it exits
+	ts.slave.Close()
+	ts.slave = nil
+	go func(master *os.File, copied chan struct{}) {
+		defer close(copied)
+		// Reading fails with EIO once the command has exited. That's the normal end of its output
+		io.Copy(ts.out, master)
+	}(ts.master, ts.copied)
+}
+
+// Waits for the rest of the command's output, then closes its pseudo-terminal
+func (ts *ttySession) Finished(cmd *exec.Cmd) {
+	ts.mu.Lock()
+	master, slave, copied := ts.master, ts.slave, ts.copied
+	ts.master, ts.slave = nil, nil
+	ts.mu.Unlock()
+
+	if slave != nil {
+		// Never started
+		slave.Close()
+	} else if copied != nil {
+		select {
+		case <-copied:
+		case <-time.After(TTY_DRAIN_TIMEOUT):
+			log.Printf("command's terminal is still open. closing it")
+		}
+	}
+	if master != nil {
+		master.Close()
+	}
+}
+
+// Puts our terminal back the way it was
+func (ts *ttySession) Close() error {
+	signal.Stop(ts.resized)
+	if ts.saved == nil {
+		return nil
+	}
+	return setTermios(os.Stdin.Fd(), ts.saved)
+}
+
+// Passes our input on to whichever command is currently running. Runs until our input ends.
+func (ts *ttySession) pumpInput() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			ts.writeInput(buf[:n])
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// Let the command know there is no more input, the same as Ctrl+D would
+				ts.writeInput([]byte{TTY_END_OF_INPUT})
+			}
+			return
+		}
+	}
+}
+
+func (ts *ttySession) writeInput(data []byte) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.master == nil {
+		ts.pending = append(ts.pending, data...)
+		return
+	}
+	ts.master.Write(data)
+}
+
+// Copies our terminal's size to the command's. Must be called with mu held
+func (ts *ttySession) syncSize() {
+	if ts.master == nil || ts.saved == nil {
+		return
+	}
+	var size windowSize
+	if err := ioctl(os.Stdin.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&size)); err != nil {
+		return
+	}
+	withFd(ts.master, func(fd uintptr) error {
+		return ioctl(fd, syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+	})
+}
+
+// Opens a new pseudo-terminal. Returns our end of it and the end for the command.
+func openPTY() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var number uint32
+	err = withFd(master, func(fd uintptr) error {
+		unlock := int32(0)
+		if err := ioctl(fd, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+			return err
+		}
+		return ioctl(fd, syscall.TIOCGPTN, unsafe.Pointer(&number))
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// Runs fn with the file's descriptor without taking it out of non-blocking mode
+func withFd(f *os.File, fn func(fd uintptr) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := conn.Control(func(fd uintptr) { fnErr = fn(fd) }); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	var t syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func setTermios(fd uintptr, t *syscall.Termios) error {
+	return ioctl(fd, syscall.TCSETS, unsafe.Pointer(t))
+}
+
+// Turns off line editing, echo and signal keys so every key goes straight to the command.
+// Output processing is left on so our own log lines still start at the beginning of a line.
+func makeRaw(t *syscall.Termios) {
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+}
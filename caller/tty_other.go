@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"runtime"
+)
+
+// Pseudo-terminals are only supported on Linux
+type ttySession struct{}
+
+func newTTYSession(out io.Writer) (*ttySession, error) {
+	return nil, errors.New("-tty is only supported on linux, not " + runtime.GOOS)
+}
+
+func (ts *ttySession) Prepare(cmd *exec.Cmd) error { return nil }
+func (ts *ttySession) Started(cmd *exec.Cmd)       {}
+func (ts *ttySession) Finished(cmd *exec.Cmd)      {}
+func (ts *ttySession) Close() error                { return nil }
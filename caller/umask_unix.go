@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Starts cmd with the file mode creation mask set to mask. glenv's own mask is put back once the command has started.
+// A negative mask leaves the mask as it is. See umaskLock for how this is kept from affecting anything else.
+func startWithUmask(cmd *exec.Cmd, mask int) error {
+	if mask < 0 {
+		return cmd.Start()
+	}
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	previous := syscall.Umask(mask)
+	defer syscall.Umask(previous)
+	return cmd.Start()
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStartWithUmask(t *testing.T) {
+	own := syscall.Umask(022)
+	defer syscall.Umask(own)
+
+	// Commands started at the same time each get their own mask
+	masks := []int{0, 007, 027, 077, 0022, 0177, 0222, 0277}
+	errs := make(chan error, len(masks))
+	for _, mask := range masks {
+		go func(mask int) {
+			out := &bytes.Buffer{}
+			cmd := exec.Command("/bin/sh", "-c", "umask")
+			cmd.Stdout = out
+			if err := startWithUmask(cmd, mask); err != nil {
+				errs <- err
+				return
+			}
+			if err := cmd.Wait(); err != nil {
+				errs <- err
+				return
+			}
+			if got, want := strings.TrimSpace(out.String()), fmt.Sprintf("%04o", mask); got != want {
+				errs <- fmt.Errorf("want umask %s, got %s", want, got)
+				return
+			}
+			errs <- nil
+		}(mask)
+	}
+	for range masks {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if current := syscall.Umask(022); current != 022 {
+		t.Fatalf("want glenv's own mask put back, got %03o", current)
+	}
+}
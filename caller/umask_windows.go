@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Starts cmd. Setting a file mode creation mask isn't possible on Windows, so a non-negative mask is an error.
+func startWithUmask(cmd *exec.Cmd, mask int) error {
+	if mask >= 0 {
+		return errors.New("-umask is not supported on windows")
+	}
+	return cmd.Start()
+}
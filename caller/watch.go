@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Restart the command when the watched files change
+	WATCH_RESTART = "restart"
+	// Send the command a signal when the watched files change
+	WATCH_SIGNAL = "signal"
+)
+
+// Polls the files matching a set of globs and reports when they have changed.
+// Files that newly match a glob, or no longer exist, count as changes too.
+type envWatcher struct {
+	// Provides the globs to check. Asked again on every poll, as a changed env file may include others
+	globs    func() []string
+	interval time.Duration
+	// Changes are only reported once the files have stopped changing for this long
+	debounce time.Duration
+
+	// Content hash of each file, by path, as of the last poll
+	snapshot map[string][32]byte
+}
+
+func newEnvWatcher(globs func() []string, interval time.Duration, debounce time.Duration) *envWatcher {
+	w := &envWatcher{globs: globs, interval: interval, debounce: debounce}
+	w.snapshot = w.scan()
+	return w
+}
+
+// Starts polling. A value is sent on the returned channel after each burst of changes has settled.
+// Polling ends once done is closed.
+func (w *envWatcher) Watch(done <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		pending := false
+		var lastChange time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			current := w.scan()
+			if !sameSnapshot(w.snapshot, current) {
+				w.snapshot = current
+				pending = true
+				lastChange = time.Now()
+				continue
+			}
+			if pending && time.Since(lastChange) >= w.debounce {
+				pending = false
+				select {
+				case changes <- struct{}{}:
+				default:
+					// A change is already waiting to be handled
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+// Hashes the current content of every file matching the globs
+func (w *envWatcher) scan() map[string][32]byte {
+	snapshot := make(map[string][32]byte)
+	for _, g := range w.globs() {
+		matches, err := filepath.Glob(g)
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			if data, err := os.ReadFile(m); err == nil {
+				snapshot[m] = sha256.Sum256(data)
+			}
+		}
+	}
+	return snapshot
+}
+
+// Provides the paths being watched in a stable order
+func (w *envWatcher) Paths() []string {
+	paths := make([]string, 0, len(w.snapshot))
+	for p := range w.snapshot {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func sameSnapshot(a map[string][32]byte, b map[string][32]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for p, h := range a {
+		if other, ok := b[p]; !ok || other != h {
+			return false
+		}
+	}
+	return true
+}
+
+// Describes what happens when watched files change
+type watchPolicy struct {
+	// Are the env files being watched?
+	Enabled bool
+	// How often the files are checked
+	Interval time.Duration
+	// How long the files must stay unchanged before acting
+	Debounce time.Duration
+	// Either WATCH_RESTART or WATCH_SIGNAL
+	Action string
+	// Name of the signal sent for WATCH_SIGNAL. Ex 'HUP'
+	Signal string
+}
+
+// Makes sure the policy is usable
+func (wp watchPolicy) Validate() error {
+	if !wp.Enabled {
+		return nil
+	}
+	if wp.Interval <= 0 {
+		return fmt.Errorf("watch interval must be greater than 0")
+	}
+	switch wp.Action {
+	case WATCH_RESTART:
+	case WATCH_SIGNAL:
+		if _, err := parseSignal(wp.Signal); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown watch action '%s'. expecting '%s' or '%s'", wp.Action, WATCH_RESTART, WATCH_SIGNAL)
+	}
+	return nil
+}
+
+// Describes the policy in a human readable way
+func (wp watchPolicy) String() string {
+	if !wp.Enabled {
+		return "off"
+	}
+	action := wp.Action
+	if wp.Action == WATCH_SIGNAL {
+		action = fmt.Sprintf("send SIG%s", strings.TrimPrefix(strings.ToUpper(wp.Signal), "SIG"))
+	}
+	return fmt.Sprintf("%s, every %s, debounce %s", action, wp.Interval, wp.Debounce)
+}
+
+// Finds the signal with the given name, with or without the "SIG" prefix, or number. Ex 'HUP', 'SIGUSR1' or '1'
+func parseSignal(name string) (syscall.Signal, error) {
+	upper := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	if sig, ok := signalsByName[upper]; ok {
+		return sig, nil
+	}
+	var num int
+	if _, err := fmt.Sscanf(upper, "%d", &num); err == nil && num > 0 {
+		return syscall.Signal(num), nil
+	}
+	return 0, fmt.Errorf("unknown signal '%s'", name)
+}
+
+// Starts watching the globs based on policy. Returns nil if watching is turned off.
+func startWatching(globs func() []string, policy watchPolicy, done <-chan struct{}) <-chan struct{} {
+	if !policy.Enabled {
+		return nil
+	}
+	watcher := newEnvWatcher(globs, policy.Interval, policy.Debounce)
+	log.Printf("watching %s", strings.Join(watcher.Paths(), ", "))
+	return watcher.Watch(done)
+}
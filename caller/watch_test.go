@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWatcherFindsNewIncludes(t *testing.T) {
+	_opts = CreateDefaultOperationOptions()
+	t.Cleanup(func() { _opts = CreateDefaultOperationOptions() })
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"app.env": "A=1\n", "extra.env": "B=2\n"})
+	_opts.Globs = []string{filepath.Join(dir, "app.env")}
+	w := newEnvWatcher(_opts.watchedGlobs, 0, 0)
+	if paths := w.Paths(); len(paths) != 1 {
+		t.Fatalf("want only app.env watched, got %v", paths)
+	}
+
+	// Files included after watching started are picked up by the next poll
+	writeFiles(t, dir, map[string]string{"app.env": "# @include ./extra.env\nA=1\n"})
+	snapshot := w.scan()
+	if _, ok := snapshot[filepath.Join(dir, "extra.env")]; !ok || len(snapshot) != 2 {
+		t.Fatalf("want extra.env watched once it's included, got %v", snapshot)
+	}
+}
@@ -2,6 +2,7 @@ package environment
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -28,6 +29,14 @@ type DefinitionBuilder struct {
 	// Often used to wrap with quotes or similar.
 	// See the provided ValueHandlerDoubleQuoted and ValueHandlerSingleQuoted functions
 	ValueHandler func(enVar Variable) string
+
+	// Builder used to write Undefined variables instead. Ex 'unset NAME'
+	// If nil then Undefined variables are written the same as any other
+	UnsetBuilder *DefinitionBuilder
+
+	// Checks each name before it is written. Variables whose names it returns false for are left out.
+	// If nil then every variable is written
+	ValidName func(name string) bool
 }
 
 // Creates a default DefinitionBuilder instance to create a normal .env file format
@@ -39,6 +48,7 @@ func NewDefinitionBuilder() *DefinitionBuilder {
 		NameToValueConnector: "=",
 		NameHandler:          NameHandlerAsIs,
 		ValueHandler:         ValueHandlerAsIs,
+		UnsetBuilder:         newUnsetBuilder("unset", " "),
 	}
 }
 
@@ -47,6 +57,13 @@ func NewDefinitionBuilder() *DefinitionBuilder {
 func (opts *DefinitionBuilder) BuildString(input Variables) (str string) {
 	sb := strings.Builder{}
 	for _, kv := range input {
+		if kv.Undefined && opts.UnsetBuilder != nil {
+			sb.WriteString(opts.UnsetBuilder.BuildString(Variables{kv}))
+			continue
+		}
+		if opts.ValidName != nil && !opts.ValidName(kv.Name) {
+			continue
+		}
 		if len(opts.Prefix) > 0 {
 			sb.WriteString(opts.Prefix)
 
@@ -62,6 +79,123 @@ func (opts *DefinitionBuilder) BuildString(input Variables) (str string) {
 	return sb.String()
 }
 
+// Puts together a single string representing all of the entries in m, in the order they were set.
+// The same map always gives the same string
+func (opts *DefinitionBuilder) BuildMap(m *VariableMap) string {
+	return opts.BuildString(*m.ToVariables())
+}
+
+const (
+	// Shells that read POSIX style definitions. Ex bash, zsh, sh, dash and ksh
+	SHELL_POSIX = "posix"
+	// The fish shell
+	SHELL_FISH = "fish"
+	// Windows PowerShell and PowerShell Core
+	SHELL_POWERSHELL = "powershell"
+)
+
+// Works out which family of shells the named shell belongs to. Accepts a name or path. Ex '/bin/zsh' or 'pwsh.exe'
+// Returns SHELL_POSIX, SHELL_FISH or SHELL_POWERSHELL.
+func ShellKind(shell string) (string, error) {
+	name := shell
+	if i := strings.LastIndexAny(name, "/\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".exe")
+	switch name {
+	case SHELL_POSIX, "sh", "bash", "zsh", "dash", "ksh", "mksh", "ash", "busybox":
+		return SHELL_POSIX, nil
+	case SHELL_FISH:
+		return SHELL_FISH, nil
+	case SHELL_POWERSHELL, "pwsh":
+		return SHELL_POWERSHELL, nil
+	}
+	return "", fmt.Errorf("unsupported shell '%s'. expecting a posix shell such as bash or zsh, fish or powershell", shell)
+}
+
+// Creates a DefinitionBuilder that writes commands setting each variable in the given shell.
+// Values are quoted so the shell uses them exactly as they are, without expanding anything in them.
+// Variables whose names the shell can't take are left out. See IsShellName
+// Evaluating the result loads the variables into the shell. Ex eval "$(glenv export local.env)"
+func NewShellDefinitionBuilder(shell string) (*DefinitionBuilder, error) {
+	kind, err := ShellKind(shell)
+	if err != nil {
+		return nil, err
+	}
+	unset, err := NewShellUnsetBuilder(shell)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case SHELL_FISH:
+		return &DefinitionBuilder{
+			Prefix:               "set -gx",
+			PrefixToNameFiller:   " ",
+			NameToValueConnector: " ",
+			NameHandler:          NameHandlerAsIs,
+			ValueHandler:         ValueHandlerFishQuoted,
+			UnsetBuilder:         unset,
+			ValidName:            IsShellName,
+		}, nil
+	case SHELL_POWERSHELL:
+		return &DefinitionBuilder{
+			Prefix:               "$env:",
+			NameToValueConnector: " = ",
+			NameHandler:          NameHandlerAsIs,
+			ValueHandler:         ValueHandlerPowerShellQuoted,
+			UnsetBuilder:         unset,
+			ValidName:            IsShellName,
+		}, nil
+	}
+	return &DefinitionBuilder{
+		Prefix:               "export",
+		PrefixToNameFiller:   " ",
+		NameToValueConnector: "=",
+		NameHandler:          NameHandlerAsIs,
+		ValueHandler:         ValueHandlerPosixQuoted,
+		UnsetBuilder:         unset,
+		ValidName:            IsShellName,
+	}, nil
+}
+
+// Creates a DefinitionBuilder that writes commands removing each variable from the given shell.
+// Undoes what a builder from NewShellDefinitionBuilder wrote. Variables whose names the shell can't take are left out.
+func NewShellUnsetBuilder(shell string) (*DefinitionBuilder, error) {
+	kind, err := ShellKind(shell)
+	if err != nil {
+		return nil, err
+	}
+	var unset *DefinitionBuilder
+	switch kind {
+	case SHELL_FISH:
+		unset = newUnsetBuilder("set -e", " ")
+	case SHELL_POWERSHELL:
+		unset = newUnsetBuilder("Remove-Item", " Env:")
+	default:
+		unset = newUnsetBuilder("unset", " ")
+	}
+	unset.ValidName = IsShellName
+	return unset, nil
+}
+
+var rShellName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Can name be used as a variable name in every supported shell? Letters, digits and underscores, not starting with a
+// digit. Ex 'DB_HOST' can but 'DB-HOST' and '1HOST' can't
+func IsShellName(name string) bool {
+	return rShellName.MatchString(name)
+}
+
+// Creates a DefinitionBuilder that writes only the prefix and name of each variable. Ex 'unset NAME'
+func newUnsetBuilder(prefix string, filler string) *DefinitionBuilder {
+	return &DefinitionBuilder{
+		Prefix:             prefix,
+		PrefixToNameFiller: filler,
+		NameHandler:        NameHandlerAsIs,
+		ValueHandler:       func(enVar Variable) string { return "" },
+	}
+}
+
 // Simple function that returns string n that was given to it.
 func StringNoOp(n string) string { return n }
 
@@ -85,6 +219,36 @@ func ValueHandlerSingleQuoted(enVar Variable) string {
 	return WrapString(enVar.Value, "'")
 }
 
+// Quotes the value so POSIX shells use it exactly as it is
+func ValueHandlerPosixQuoted(enVar Variable) string {
+	return QuotePosix(enVar.Value)
+}
+
+// Quotes the value so fish uses it exactly as it is
+func ValueHandlerFishQuoted(enVar Variable) string {
+	return QuoteFish(enVar.Value)
+}
+
+// Quotes the value so PowerShell uses it exactly as it is
+func ValueHandlerPowerShellQuoted(enVar Variable) string {
+	return QuotePowerShell(enVar.Value)
+}
+
+// Wraps str in single quotes for POSIX shells. Single quotes inside are closed, escaped and reopened
+func QuotePosix(str string) string {
+	return WrapString(strings.ReplaceAll(str, "'", `'\''`), "'")
+}
+
+// Wraps str in single quotes for fish. Backslashes and single quotes inside are escaped
+func QuoteFish(str string) string {
+	return WrapString(strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(str), "'")
+}
+
+// Wraps str in single quotes for PowerShell. Single quotes inside are doubled
+func QuotePowerShell(str string) string {
+	return WrapString(strings.ReplaceAll(str, "'", "''"), "'")
+}
+
 func WrapString(str string, wrapper string) string {
 	return fmt.Sprintf("%s%s%s", wrapper, str, wrapper)
 }
@@ -117,7 +117,7 @@ func (etr *DefinitionReader) readFromScanner(p []byte) (n int, err error) {
 		sections := varSections.FindStringSubmatch(etr.tokenScanner.Text())
 		if len(sections) == 2 {
 			// Track the actual name/value of the variable
-			etr.env = append(etr.env, Variable{sections[0], sections[1]})
+			etr.env = append(etr.env, Variable{Name: sections[0], Value: sections[1]})
 			// Write it out to the normal output buffer
 			etr.buffOut.Write(etr.tokenScanner.Bytes())
 		} else if len(sections) == 0 && !commentedSection.Match(etr.tokenScanner.Bytes()) {
@@ -1,37 +1,251 @@
 package environment
 
+import "sort"
+
 // Simple Key/Value element for tracking Environment Variables
 type Variable struct {
 	Name  string
 	Value string
+	// True if the variable is explicitly not defined, such as by an 'unset NAME' line.
+	// Tells it apart from a variable defined with an empty Value
+	Undefined bool
 }
 
 // Array of type Variable
 type Variables []Variable
 
 // Converts this Variables to a VariableMap instance and provides a pointer to it
+// Later entries win over earlier ones. Undefined entries remove any earlier entry with the same name
 func (v *Variables) ToMap() *VariableMap {
-	m := make(map[string]string, len(*v))
+	m := NewVariableMap()
 	for _, x := range *v {
-		m[x.Name] = x.Value
+		if x.Undefined {
+			m.Unset(x.Name)
+		} else {
+			m.Set(x.Name, x.Value)
+		}
+	}
+	return m
+}
+
+// Map of variable names to values that remembers the order they were first set in.
+// Lookups are as quick as a normal map, and ranging over it always gives the same order, so anything written from it
+// can be compared between runs. The zero value is an empty map ready to use.
+type VariableMap struct {
+	// Names in the order they were set. Unset names are left as gaps until there are enough to be worth tidying
+	names []string
+	// Position of each name in names
+	index  map[string]int
+	values map[string]string
+	// Number of gaps in names
+	removed int
+	// Where the variables were defined, for errors from the typed accessors. May be nil
+	provenance *Provenance
+}
+
+// Creates an empty VariableMap
+func NewVariableMap() *VariableMap {
+	return &VariableMap{}
+}
+
+// Creates a VariableMap holding the entries of m. As m has no order they are added sorted by name
+func VariableMapOf(m map[string]string) *VariableMap {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	vm := NewVariableMap()
+	for _, n := range names {
+		vm.Set(n, m[n])
+	}
+	return vm
+}
+
+// Sets the value of name. A name that is already set keeps its place in the order.
+// Panics on a nil map, the same as assigning to a nil map[string]string would
+func (m *VariableMap) Set(name string, value string) {
+	if m == nil {
+		panic("assignment to entry in nil VariableMap")
+	}
+	if m.values == nil {
+		m.values = make(map[string]string)
+		m.index = make(map[string]int)
+	}
+	if _, ok := m.index[name]; !ok {
+		m.index[name] = len(m.names)
+		m.names = append(m.names, name)
+	}
+	m.values[name] = value
+}
+
+// Provides the value of name. Empty if it isn't set
+func (m *VariableMap) Get(name string) string {
+	if m == nil {
+		return ""
+	}
+	return m.values[name]
+}
+
+// Provides the value of name. defined is false if it isn't in the map, which is different to it having an empty value
+func (m *VariableMap) Lookup(name string) (value string, defined bool) {
+	if m == nil {
+		return "", false
+	}
+	value, defined = m.values[name]
+	return value, defined
+}
+
+// Removes each of the named variables
+func (m *VariableMap) Unset(names ...string) {
+	if m == nil {
+		return
+	}
+	for _, n := range names {
+		i, ok := m.index[n]
+		if !ok {
+			continue
+		}
+		delete(m.index, n)
+		delete(m.values, n)
+		m.names[i] = ""
+		m.removed++
+	}
+	if m.removed > 0 && m.removed*2 >= len(m.names) {
+		m.compact()
+	}
+}
+
+// Takes the gaps left by Unset out of names
+func (m *VariableMap) compact() {
+	names := make([]string, 0, len(m.index))
+	for _, n := range m.names {
+		if _, ok := m.index[n]; ok {
+			m.index[n] = len(names)
+			names = append(names, n)
+		}
+	}
+	m.names = names
+	m.removed = 0
+}
+
+// Number of variables in the map
+func (m *VariableMap) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.index)
+}
+
+// Provides the names in the order they were set
+func (m *VariableMap) Names() []string {
+	if m == nil {
+		return []string{}
+	}
+	names := make([]string, 0, len(m.index))
+	for _, n := range m.names {
+		if _, ok := m.index[n]; ok {
+			names = append(names, n)
+		}
 	}
-	xMap := VariableMap(m)
-	return &xMap
+	return names
 }
 
-// Map of variable names to values.
-type VariableMap map[string]string
+// Provides the names sorted alphabetically
+func (m *VariableMap) SortedNames() []string {
+	names := m.Names()
+	sort.Strings(names)
+	return names
+}
 
-// Converts this VariableMap to a Variables instance and provides a pointer to it
+// Calls fn with each variable in order. Stops early if fn returns false
+func (m *VariableMap) Range(fn func(name string, value string) bool) {
+	for _, n := range m.Names() {
+		if !fn(n, m.values[n]) {
+			return
+		}
+	}
+}
+
+// Reorders the map so names are sorted alphabetically
+func (m *VariableMap) Sort() {
+	m.SortFunc(func(a, b string) bool { return a < b })
+}
+
+// Reorders the map with less, which reports whether name a goes before name b. Equal names keep their order
+func (m *VariableMap) SortFunc(less func(a, b string) bool) {
+	if m == nil {
+		return
+	}
+	names := m.Names()
+	sort.SliceStable(names, func(i, j int) bool { return less(names[i], names[j]) })
+	for i, n := range names {
+		m.index[n] = i
+	}
+	m.names = names
+	m.removed = 0
+}
+
+// Provides a copy that can be changed without affecting this one
+func (m *VariableMap) Clone() *VariableMap {
+	c := NewVariableMap()
+	c.provenance = m.Provenance()
+	m.Range(func(n, v string) bool {
+		c.Set(n, v)
+		return true
+	})
+	return c
+}
+
+// Provides the variables as a plain map, which has no order
+func (m *VariableMap) Map() map[string]string {
+	plain := make(map[string]string, m.Len())
+	m.Range(func(n, v string) bool {
+		plain[n] = v
+		return true
+	})
+	return plain
+}
+
+// Converts this VariableMap to a Variables instance and provides a pointer to it. Variables are in the map's order
 func (m *VariableMap) ToVariables() *Variables {
-	xMap := map[string]string(*m)
-	vars := make([]Variable, len(xMap))
-	i := 0
-	for n, v := range xMap {
-		vars[i] = Variable{n, v}
-		i++
+	vars := make(Variables, 0, m.Len())
+	m.Range(func(n, v string) bool {
+		vars = append(vars, Variable{Name: n, Value: v})
+		return true
+	})
+	return &vars
+}
+
+// Names of variables that have been unset. Kept so they can also be removed from environments that the variables would
+// otherwise be inherited from, such as the OS's
+type UnsetNames map[string]bool
+
+// Adds each of the names. Does nothing if un is nil
+func (un UnsetNames) Add(names ...string) {
+	if un == nil {
+		return
+	}
+	for _, n := range names {
+		un[n] = true
 	}
+}
 
-	xVars := Variables(vars)
-	return &xVars
+// Takes name back out, as it has been defined again. Does nothing if un is nil
+func (un UnsetNames) Remove(name string) {
+	delete(un, name)
+}
+
+// Provides the names as Undefined variables, sorted by name
+func (un UnsetNames) ToVariables() Variables {
+	names := make([]string, 0, len(un))
+	for n := range un {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	vars := make(Variables, len(names))
+	for i, n := range names {
+		vars[i] = Variable{Name: n, Undefined: true}
+	}
+	return vars
 }
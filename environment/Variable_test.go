@@ -0,0 +1,66 @@
+package environment
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVariableMapOrder(t *testing.T) {
+	env := NewVariableMap()
+	input := "BB=1\nAA=2\nCC=3\nBB=4\nunset AA\nDD=$BB$CC\nAA=5\n"
+	if err := ProcessEnvironmentWith(strings.NewReader(input), env, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(env.Names(), ","); got != "BB,CC,DD,AA" {
+		t.Fatalf("want BB,CC,DD,AA got %s", got)
+	}
+	written := NewDefinitionBuilder().BuildMap(env)
+	if want := "export BB=4\nexport CC=3\nexport DD=43\nexport AA=5\n"; written != want {
+		t.Fatalf("want\n%s\ngot\n%s", want, written)
+	}
+
+	sorted := env.Clone()
+	sorted.Sort()
+	if got := strings.Join(sorted.Names(), ","); got != "AA,BB,CC,DD" {
+		t.Fatalf("want AA,BB,CC,DD got %s", got)
+	}
+	if got := strings.Join(env.Names(), ","); got != "BB,CC,DD,AA" {
+		t.Fatalf("sorting a clone changed the original: %s", got)
+	}
+
+	// Gaps left by removing most entries are tidied up without losing the order of the rest
+	many := NewVariableMap()
+	for i := 0; i < 10; i++ {
+		many.Set(fmt.Sprint("V", i), fmt.Sprint(i))
+	}
+	many.Unset("V0", "V2", "V4", "V6", "V8", "V9")
+	many.Set("V0", "again")
+	if got := strings.Join(many.Names(), ","); got != "V1,V3,V5,V7,V0" || many.Len() != 5 {
+		t.Fatalf("want V1,V3,V5,V7,V0 got %s", got)
+	}
+	if v, ok := many.Lookup("V7"); !ok || v != "7" {
+		t.Fatalf("want V7 '7', got '%s'", v)
+	}
+
+	var zero VariableMap
+	zero.Set("X", "1")
+	if zero.Get("X") != "1" || zero.Len() != 1 {
+		t.Fatal("want the zero VariableMap to be usable")
+	}
+
+	var none *VariableMap
+	none.Unset("X")
+	none.Sort()
+	if _, ok := none.Lookup("X"); ok || none.Len() != 0 {
+		t.Fatal("want a nil VariableMap to stay empty")
+	}
+
+	// Writes to a nil map would be lost, so they panic like a nil map[string]string
+	defer func() {
+		if recover() == nil {
+			t.Fatal("want Set on a nil VariableMap to panic")
+		}
+	}()
+	none.Set("X", "1")
+}
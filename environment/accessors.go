@@ -0,0 +1,343 @@
+package environment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reason given by a VariableError for a variable that isn't in the map
+var ErrUndefined = errors.New("isn't defined")
+
+// Error from one of the typed accessors, such as GetInt. Says which variable it was, where it was set and why its
+// value couldn't be used. The value itself isn't kept as it may be secret
+type VariableError struct {
+	// Name of the variable
+	Name string
+	// What the value was wanted as. Ex 'int'
+	Type string
+	// Where the value was set. nil if that isn't known
+	Origin *Origin
+	// Why the value couldn't be used. ErrUndefined if it isn't defined
+	Err error
+}
+
+// Ex "PORT (set at app.env:3) can't be used as int: invalid syntax"
+func (e *VariableError) Error() string {
+	name := e.Name
+	if e.Origin != nil && e.Origin.Unset {
+		name = fmt.Sprintf("%s (unset at %s)", e.Name, e.Origin)
+	} else if e.Origin != nil {
+		name = fmt.Sprintf("%s (set at %s)", e.Name, e.Origin)
+	}
+	if errors.Is(e.Err, ErrUndefined) {
+		return fmt.Sprintf("%s %s", name, e.Err)
+	}
+	return fmt.Sprintf("%s can't be used as %s: %s", name, e.Type, e.Err)
+}
+
+func (e *VariableError) Unwrap() error {
+	return e.Err
+}
+
+// Records where the variables were defined, so errors from the typed accessors can say where a value came from.
+// Done for you when the map is processed with ProcessOptions.Provenance
+func (m *VariableMap) SetProvenance(p *Provenance) {
+	m.provenance = p
+}
+
+// Provides where the variables were defined. nil if that isn't known
+func (m *VariableMap) Provenance() *Provenance {
+	if m == nil {
+		return nil
+	}
+	return m.provenance
+}
+
+// Provides the value of name for one of the typed accessors. Fails if it isn't defined
+func (m *VariableMap) typedValue(name string, typ string) (string, error) {
+	if value, ok := m.Lookup(name); ok {
+		return value, nil
+	}
+	return "", m.typedError(name, typ, ErrUndefined)
+}
+
+// Creates the VariableError for name, along with where it was set, or unset, if that's known.
+// Where it was last defined is left out for a name that isn't in the map, ex one that was filtered out
+func (m *VariableMap) typedError(name string, typ string, err error) error {
+	e := &VariableError{Name: name, Type: typ, Err: err}
+	_, defined := m.Lookup(name)
+	if origin, ok := m.Provenance().Last(name); ok && origin.Unset != defined {
+		e.Origin = &origin
+	}
+	return e
+}
+
+// Provides the value of name. Fails if it isn't defined, which is different to it being empty
+func (m *VariableMap) GetString(name string) (string, error) {
+	return m.typedValue(name, "string")
+}
+
+// Provides the value of name as an int. Ex '8080' or '-1'
+func (m *VariableMap) GetInt(name string) (int, error) {
+	value, err := m.typedValue(name, "int")
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, m.typedError(name, "int", numberReason(err))
+	}
+	return i, nil
+}
+
+// Provides the value of name as a float64. Ex '0.75'
+func (m *VariableMap) GetFloat(name string) (float64, error) {
+	value, err := m.typedValue(name, "float")
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, m.typedError(name, "float", numberReason(err))
+	}
+	return f, nil
+}
+
+// Provides the value of name as a bool. Accepts true/false, yes/no, on/off, y/n, t/f and 1/0 in any case
+func (m *VariableMap) GetBool(name string) (bool, error) {
+	value, err := m.typedValue(name, "bool")
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "t", "yes", "y", "on", "1":
+		return true, nil
+	case "false", "f", "no", "n", "off", "0":
+		return false, nil
+	}
+	return false, m.typedError(name, "bool", errors.New("expecting true/false, yes/no, on/off or 1/0"))
+}
+
+// Provides the value of name as a time.Duration. Ex '30s' or '1h30m'
+func (m *VariableMap) GetDuration(name string) (time.Duration, error) {
+	value, err := m.typedValue(name, "duration")
+	if err != nil {
+		return 0, err
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, m.typedError(name, "duration", errors.New("expecting a number with a unit such as 30s or 1h30m"))
+	}
+	return d, nil
+}
+
+// Provides the value of name split on sep, with the space around each item trimmed. Ex 'a, b, c' with ','.
+// An empty value gives an empty list
+func (m *VariableMap) GetList(name string, sep string) ([]string, error) {
+	value, err := m.typedValue(name, "list")
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(value)) == 0 {
+		return []string{}, nil
+	}
+	items := strings.Split(value, sep)
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items, nil
+}
+
+// Provides the value of name as a URL. It must have a scheme. Ex 'https://example.com/api' or 'postgres://db:5432/app'
+func (m *VariableMap) GetURL(name string) (*url.URL, error) {
+	value, err := m.typedValue(name, "URL")
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		// The value is part of url.Error's own message
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, m.typedError(name, "URL", err)
+	}
+	if len(u.Scheme) == 0 {
+		return nil, m.typedError(name, "URL", errors.New("missing a scheme such as https://"))
+	}
+	return u, nil
+}
+
+// Decodes the value of name as JSON into v, the same as json.Unmarshal. v is only changed if the whole value could be decoded
+func (m *VariableMap) GetJSON(name string, v any) error {
+	value, err := m.typedValue(name, "JSON")
+	if err != nil {
+		return err
+	}
+	if err := unmarshalWhole([]byte(value), v); err != nil {
+		return m.typedError(name, "JSON", err)
+	}
+	return nil
+}
+
+// Same as json.Unmarshal, but leaves v as it was when that fails rather than partly filled in.
+// The data is decoded into a fresh value of the same type first, as copying v would share its maps and pointers
+func unmarshalWhole(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		// Lets json.Unmarshal give its usual error
+		return json.Unmarshal(data, v)
+	}
+	if err := json.Unmarshal(data, reflect.New(rv.Elem().Type()).Interface()); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Gives the reason a number couldn't be parsed, without the value that strconv includes
+func numberReason(err error) error {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return numErr.Err
+	}
+	return err
+}
+
+// Same as GetString, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetString(name string) string {
+	value, err := m.GetString(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Same as GetInt, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetInt(name string) int {
+	value, err := m.GetInt(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Same as GetFloat, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetFloat(name string) float64 {
+	value, err := m.GetFloat(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Same as GetBool, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetBool(name string) bool {
+	value, err := m.GetBool(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Same as GetDuration, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetDuration(name string) time.Duration {
+	value, err := m.GetDuration(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Same as GetList, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetList(name string, sep string) []string {
+	value, err := m.GetList(name, sep)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Same as GetURL, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetURL(name string) *url.URL {
+	value, err := m.GetURL(name)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Same as GetJSON, but panics with the VariableError. For values a program can't run without
+func (m *VariableMap) MustGetJSON(name string, v any) {
+	if err := m.GetJSON(name, v); err != nil {
+		panic(err)
+	}
+}
+
+// Same as GetString, but gives def when the variable isn't defined or its value can't be used
+func (m *VariableMap) GetStringOr(name string, def string) string {
+	if value, err := m.GetString(name); err == nil {
+		return value
+	}
+	return def
+}
+
+// Same as GetInt, but gives def when the variable isn't defined or its value can't be used
+func (m *VariableMap) GetIntOr(name string, def int) int {
+	if value, err := m.GetInt(name); err == nil {
+		return value
+	}
+	return def
+}
+
+// Same as GetFloat, but gives def when the variable isn't defined or its value can't be used
+func (m *VariableMap) GetFloatOr(name string, def float64) float64 {
+	if value, err := m.GetFloat(name); err == nil {
+		return value
+	}
+	return def
+}
+
+// Same as GetBool, but gives def when the variable isn't defined or its value can't be used
+func (m *VariableMap) GetBoolOr(name string, def bool) bool {
+	if value, err := m.GetBool(name); err == nil {
+		return value
+	}
+	return def
+}
+
+// Same as GetDuration, but gives def when the variable isn't defined or its value can't be used
+func (m *VariableMap) GetDurationOr(name string, def time.Duration) time.Duration {
+	if value, err := m.GetDuration(name); err == nil {
+		return value
+	}
+	return def
+}
+
+// Same as GetList, but gives def when the variable isn't defined or its value can't be used
+func (m *VariableMap) GetListOr(name string, sep string, def []string) []string {
+	if value, err := m.GetList(name, sep); err == nil {
+		return value
+	}
+	return def
+}
+
+// Same as GetURL, but gives def when the variable isn't defined or its value can't be used
+func (m *VariableMap) GetURLOr(name string, def *url.URL) *url.URL {
+	if value, err := m.GetURL(name); err == nil {
+		return value
+	}
+	return def
+}
+
+// Same as GetJSON, but leaves v as it was when the variable isn't defined or its value can't be decoded into v, so
+// defaults can be put in it first. Reports whether the value was used
+func (m *VariableMap) GetJSONOr(name string, v any) bool {
+	return m.GetJSON(name, v) == nil
+}
@@ -0,0 +1,97 @@
+package environment
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTypedAccessors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.env")
+	writeTestFiles(t, dir, map[string]string{
+		"app.env": "PORT=8080\nBAD_PORT=80a\nRATIO=0.75\nDEBUG=Yes\nQUIET=off\nTIMEOUT=1m30s\nHOSTS=a, b ,c\nEMPTY=\nAPI=https://example.com/api\nNOT_URL=example.com\nLIMITS=[1, 2, 3]\nOLD=1\nunset OLD\n",
+	})
+	env := NewVariableMap()
+	if err := ProcessEnvironmentFileWith(path, env, ProcessOptions{Provenance: NewProvenance()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if port, err := env.GetInt("PORT"); err != nil || port != 8080 {
+		t.Fatalf("want PORT 8080, got %d %v", port, err)
+	}
+	if ratio := env.MustGetFloat("RATIO"); ratio != 0.75 {
+		t.Fatalf("want RATIO 0.75, got %f", ratio)
+	}
+	if !env.MustGetBool("DEBUG") || env.GetBoolOr("QUIET", true) {
+		t.Fatal("want DEBUG on and QUIET off")
+	}
+	if d := env.MustGetDuration("TIMEOUT"); d != 90*time.Second {
+		t.Fatalf("want TIMEOUT 1m30s, got %s", d)
+	}
+	if hosts := env.MustGetList("HOSTS", ","); strings.Join(hosts, "|") != "a|b|c" {
+		t.Fatalf("want a|b|c, got %v", hosts)
+	}
+	if empty := env.MustGetList("EMPTY", ","); len(empty) != 0 {
+		t.Fatalf("want an empty list, got %v", empty)
+	}
+	if u := env.MustGetURL("API"); u.Host != "example.com" {
+		t.Fatalf("want host example.com, got %s", u.Host)
+	}
+	limits := []int{}
+	if err := env.GetJSON("LIMITS", &limits); err != nil || len(limits) != 3 {
+		t.Fatalf("want 3 limits, got %v %v", limits, err)
+	}
+	if env.GetJSONOr("PORT", &limits) || env.GetJSONOr("MISSING", &limits) || len(limits) != 3 {
+		t.Fatalf("want limits left as they were, got %v", limits)
+	}
+	// A value that only partly fits isn't half decoded
+	pair := NewVariableMap()
+	pair.Set("PAIR", `{"a":5,"b":"x"}`)
+	ab := struct{ A, B int }{1, 2}
+	if pair.GetJSONOr("PAIR", &ab) || ab.A != 1 || ab.B != 2 {
+		t.Fatalf("want the defaults left as they were, got %+v", ab)
+	}
+	if env.GetIntOr("MISSING", 3) != 3 || env.GetIntOr("BAD_PORT", 4) != 4 || env.GetStringOr("EMPTY", "x") != "" {
+		t.Fatal("want defaults for missing and invalid values only")
+	}
+
+	// Errors say which variable it was and where it was set, without the value
+	_, err := env.GetInt("BAD_PORT")
+	var varErr *VariableError
+	if !errors.As(err, &varErr) || varErr.Name != "BAD_PORT" || varErr.Origin == nil || varErr.Origin.Line != 2 || !errors.Is(err, strconv.ErrSyntax) {
+		t.Fatalf("want a VariableError for BAD_PORT on line 2, got %v", err)
+	}
+	if want := "BAD_PORT (set at " + path + ":2) can't be used as int: invalid syntax"; err.Error() != want {
+		t.Fatalf("want '%s', got '%s'", want, err)
+	}
+	if _, err := env.GetURL("NOT_URL"); err == nil || !strings.Contains(err.Error(), "scheme") {
+		t.Fatalf("want an error about the scheme, got %v", err)
+	}
+	if _, err := env.GetDuration("PORT"); err == nil || strings.Contains(err.Error(), "8080") {
+		t.Fatalf("want an error without the value, got %v", err)
+	}
+	if _, err := env.GetBool("MISSING"); !errors.Is(err, ErrUndefined) {
+		t.Fatalf("want ErrUndefined, got %v", err)
+	}
+	_, err = env.GetInt("OLD")
+	if want := "OLD (unset at " + path + ":13) isn't defined"; err == nil || err.Error() != want {
+		t.Fatalf("want '%s', got %v", want, err)
+	}
+	// Where a variable that was filtered out was set doesn't explain why it's missing
+	only, _ := env.FilterGlob("PORT")
+	if _, err := only.GetInt("BAD_PORT"); err == nil || err.Error() != "BAD_PORT isn't defined" {
+		t.Fatalf("want 'BAD_PORT isn't defined', got %v", err)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("want MustGetInt to panic")
+			}
+		}()
+		env.MustGetInt("RATIO")
+	}()
+}
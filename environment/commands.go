@@ -0,0 +1,556 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest a command may run by default
+const COMMAND_TIMEOUT = 10 * time.Second
+
+// Names of the variables from our own environment that commands get by default. Commands need these to work normally
+var DefaultCommandEnvNames = []string{"PATH", "HOME", "USER", "LANG", "TMPDIR", "SYSTEMROOT", "COMSPEC", "PATHEXT", "TEMP", "TMP"}
+
+// A command that was substituted into a value
+type CommandRun struct {
+	// Command as written, without the '$(' and ')'
+	Command string
+	// Directory it ran in
+	Dir string
+	// Variable whose value it was in
+	Name string
+	// Env file the variable was read from. Empty if it wasn't read from a file
+	File string
+	// Was the output from an earlier run of the same command used?
+	Cached bool
+	// How long it took
+	Duration time.Duration
+}
+
+// Runs commands in '$(...)' and puts their output in its place, the same as a shell. Ex 'VERSION=$(git rev-parse HEAD)'.
+// Commands run through Shell without our environment. They only get Env and the variables defined before them.
+// With an allow list they are run directly instead, and can't use anything that needs a shell.
+// Each command is only run once from each directory with the same variables. Later uses get the same output.
+// Trailing newlines are removed from the output.
+type CommandSubstitution struct {
+	// Shell and its arguments that the command is added to. Ex ['sh', '-c']. Not used when there is an allow list
+	Shell []string
+	// Longest a command may run. 0 means there is no limit
+	Timeout time.Duration
+	// Directory commands run in. Defaults to the directory of the env file the command is in
+	Dir string
+	// Environment that commands get, as NAME=value entries. Variables defined before the command are added to it,
+	// but can't replace its entries when there is an allow list
+	Env []string
+	// Executables that commands may use. Names are found on the PATH from Env, otherwise the path must match exactly.
+	// Any executable may be used if empty
+	Allow []string
+
+	mu    sync.Mutex
+	cache map[string]string
+	runs  []CommandRun
+}
+
+// Creates a CommandSubstitution that uses 'sh -c', or 'cmd /C' on Windows, with a COMMAND_TIMEOUT timeout and the
+// DefaultCommandEnvNames from our own environment.
+func NewCommandSubstitution() *CommandSubstitution {
+	shell := []string{"sh", "-c"}
+	if runtime.GOOS == "windows" {
+		shell = []string{"cmd", "/C"}
+	}
+	return &CommandSubstitution{Shell: shell, Timeout: COMMAND_TIMEOUT, Env: CommandEnv(DefaultCommandEnvNames...)}
+}
+
+// Provides the NAME=value entries from our own environment for each of the names that is set
+func CommandEnv(names ...string) []string {
+	env := []string{}
+	for _, n := range names {
+		if v, ok := os.LookupEnv(n); ok {
+			env = append(env, n+"="+v)
+		}
+	}
+	return env
+}
+
+// Provides every command that was substituted, in the order they were reached
+func (cs *CommandSubstitution) Runs() []CommandRun {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return append([]CommandRun{}, cs.runs...)
+}
+
+// Runs command and provides its output, or the output from running it before
+func (cs *CommandSubstitution) Run(command string, ctx ExpansionContext) (string, error) {
+	dir := cs.Dir
+	if len(dir) == 0 {
+		var err error
+		if dir, err = ctx.FileDir(); err != nil {
+			return "", err
+		}
+	}
+	env := cs.environment(ctx.Variables)
+	// Only checked once we know what the command will see, as the allow list resolves names with it
+	pipeline, err := cs.allowedPipeline(command, dir, env)
+	if err != nil {
+		return "", fmt.Errorf("$(%s): %w", command, err)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	run := CommandRun{Command: command, Dir: dir, Name: ctx.Name, File: ctx.File}
+	// The command sees the variables defined so far, so the same command may give something else once they change
+	key := dir + "\x00" + command + "\x00" + strings.Join(env, "\x00")
+	if output, ok := cs.cache[key]; ok {
+		run.Cached = true
+		cs.runs = append(cs.runs, run)
+		return output, nil
+	}
+
+	started := time.Now()
+	output, err := cs.execute(command, pipeline, dir, env)
+	run.Duration = time.Since(started)
+	cs.runs = append(cs.runs, run)
+	if err != nil {
+		return "", fmt.Errorf("$(%s): %w", command, err)
+	}
+	if cs.cache == nil {
+		cs.cache = make(map[string]string)
+	}
+	cs.cache[key] = output
+	return output, nil
+}
+
+// Provides the NAME=value entries a command gets. With an allow list the entries in Env come last, so variables from
+// env files can't replace them. Ex a 'PATH=./bin' variable can't change where allowed executables are found
+func (cs *CommandSubstitution) environment(variables *VariableMap) []string {
+	env := []string{}
+	if len(cs.Allow) == 0 {
+		env = append(env, cs.Env...)
+	}
+	pinned := map[string]bool{}
+	if len(cs.Allow) > 0 {
+		for _, e := range cs.Env {
+			pinned[envName(e)] = true
+		}
+	}
+	variables.Range(func(n, v string) bool {
+		if !pinned[n] {
+			env = append(env, n+"="+v)
+		}
+		return true
+	})
+	if len(cs.Allow) > 0 {
+		env = append(env, cs.Env...)
+	}
+	return env
+}
+
+// Provides the name from a NAME=value entry. Names are case insensitive on Windows
+func envName(entry string) string {
+	name, _, _ := strings.Cut(entry, "=")
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(name)
+	}
+	return name
+}
+
+// Provides the value of name in env, the last entry winning the same as for a process
+func envValue(env []string, name string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if envName(env[i]) == envName(name+"=") {
+			return env[i][strings.IndexByte(env[i], '=')+1:], true
+		}
+	}
+	return "", false
+}
+
+// Runs the command, or pipeline when there is an allow list, with its output going to files rather than pipes.
+// Anything the command leaves running in the background would otherwise keep us waiting after it has been stopped
+func (cs *CommandSubstitution) execute(command string, pipeline [][]string, dir string, env []string) (string, error) {
+	if len(pipeline) == 0 && len(cs.Shell) == 0 {
+		return "", errors.New("no shell to run commands with")
+	}
+	ctx := context.Background()
+	if cs.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cs.Timeout)
+		defer cancel()
+	}
+	cmds := []*exec.Cmd{}
+	if len(pipeline) == 0 {
+		cmds = append(cmds, exec.CommandContext(ctx, cs.Shell[0], append(cs.Shell[1:], command)...))
+	}
+	for _, args := range pipeline {
+		cmds = append(cmds, exec.CommandContext(ctx, args[0], args[1:]...))
+	}
+
+	stdout, err := os.CreateTemp("", "glenv-command-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	stderr, err := os.CreateTemp("", "glenv-command-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	// Each command in a pipeline reads what the one before it wrote
+	pipes := []*os.File{}
+	defer func() {
+		for _, p := range pipes {
+			p.Close()
+		}
+	}()
+	for i, cmd := range cmds {
+		cmd.Dir = dir
+		cmd.Env = env
+		cmd.Stderr = stderr
+		cmd.Stdout = stdout
+		if i+1 < len(cmds) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return "", err
+			}
+			pipes = append(pipes, r, w)
+			cmd.Stdout = w
+			cmds[i+1].Stdin = r
+		}
+	}
+
+	var runErr error
+	started := []*exec.Cmd{}
+	for _, cmd := range cmds {
+		if runErr = cmd.Start(); runErr != nil {
+			break
+		}
+		started = append(started, cmd)
+	}
+	// Only the commands hold the pipes open now, so each sees the end of its input once the one before it exits
+	for _, p := range pipes {
+		p.Close()
+	}
+	for i, cmd := range started {
+		if err := cmd.Wait(); err != nil && runErr == nil {
+			runErr = err
+			if len(started) > 1 {
+				runErr = fmt.Errorf("%s: %w", filepath.Base(pipeline[i][0]), err)
+			}
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s", cs.Timeout)
+	}
+	if runErr != nil {
+		message, _ := os.ReadFile(stderr.Name())
+		if text := strings.TrimSpace(string(message)); len(text) > 0 {
+			return "", fmt.Errorf("%w: %s", runErr, text)
+		}
+		return "", runErr
+	}
+	output, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
+
+// Splits command into the pipeline of executables, and their arguments, it runs when there is an allow list.
+// Each executable must be in Allow and is resolved to an absolute path. Provides nil if there is no allow list.
+// Commands are run directly rather than through Shell, so only simple commands joined by '|' can be used
+func (cs *CommandSubstitution) allowedPipeline(command string, dir string, env []string) ([][]string, error) {
+	if len(cs.Allow) == 0 {
+		return nil, nil
+	}
+	pipeline, err := splitCommandWords(command, func(name string) (string, bool) { return envValue(env, name) })
+	if err != nil {
+		return nil, err
+	}
+	pathList, _ := envValue(env, "PATH")
+	for _, args := range pipeline {
+		if !cs.isAllowed(args[0]) {
+			return nil, fmt.Errorf("'%s' isn't allowed", args[0])
+		}
+		resolved, err := findExecutable(args[0], dir, pathList, env)
+		if err != nil {
+			return nil, err
+		}
+		args[0] = resolved
+	}
+	return pipeline, nil
+}
+
+func (cs *CommandSubstitution) isAllowed(executable string) bool {
+	for _, a := range cs.Allow {
+		if executable == a {
+			return true
+		}
+		// Paths only match paths, so a copy elsewhere with the same name isn't allowed
+		if strings.ContainsAny(executable, `/\`) && strings.ContainsAny(a, `/\`) && filepath.Clean(executable) == filepath.Clean(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Provides the absolute path of executable. Paths are relative to dir, and names are found on pathList.
+// Relative entries in pathList are skipped, so what runs doesn't depend on the directory
+func findExecutable(executable string, dir string, pathList string, env []string) (string, error) {
+	if strings.ContainsAny(executable, `/\`) {
+		path := executable
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if found, ok := executableFile(path, env); ok {
+			return found, nil
+		}
+		return "", fmt.Errorf("'%s' isn't an executable", executable)
+	}
+	for _, d := range filepath.SplitList(pathList) {
+		if !filepath.IsAbs(d) {
+			continue
+		}
+		if found, ok := executableFile(filepath.Join(d, executable), env); ok {
+			return found, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' wasn't found on the PATH", executable)
+}
+
+// Provides path if it is an executable file. On Windows the extensions in PATHEXT are tried as well
+func executableFile(path string, env []string) (string, bool) {
+	candidates := []string{path}
+	if runtime.GOOS == "windows" {
+		exts, ok := envValue(env, "PATHEXT")
+		if !ok {
+			exts = ".com;.exe;.bat;.cmd"
+		}
+		for _, ext := range strings.Split(exts, ";") {
+			if len(ext) > 0 {
+				candidates = append(candidates, path+ext)
+			}
+		}
+	}
+	for _, c := range candidates {
+		info, err := os.Stat(c)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if runtime.GOOS == "windows" {
+			if len(filepath.Ext(c)) > 0 {
+				return c, true
+			}
+		} else if info.Mode()&0111 != 0 {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// Splits a command into the words of each command in its pipeline, removing quotes and escapes the way a shell would.
+// '$NAME' and '${NAME}' are replaced with lookup's value, as a single word. Anything else a shell would treat
+// specially is an error rather than being passed on literally, as it could only be handled properly by a shell.
+// Ex nested commands, backquotes, redirections, lists, subshells and globs.
+func splitCommandWords(command string, lookup func(name string) (string, bool)) ([][]string, error) {
+	pipeline := [][]string{}
+	words := []string{}
+	word := strings.Builder{}
+	inWord := false
+	var quote rune
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+		}
+		word.Reset()
+		inWord = false
+	}
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("nothing follows the final '\\'")
+			}
+			next := runes[i+1]
+			i++
+			switch {
+			case next == '\n':
+				// Continues the line
+			case quote == 0 || strings.ContainsRune("$`\"\\\n", next):
+				word.WriteRune(next)
+				inWord = true
+			default:
+				word.WriteRune(c)
+				word.WriteRune(next)
+			}
+		case c == '$' && i+1 < len(runes) && runes[i+1] == '(':
+			return nil, errors.New("nested commands can't be used with an allow list")
+		case c == '$':
+			name, length := commandVariableName(runes[i+1:])
+			if length == 0 {
+				return nil, fmt.Errorf("only $NAME and ${NAME} can be used with an allow list")
+			}
+			value, ok := lookup(name)
+			if !ok {
+				return nil, fmt.Errorf("'%s' isn't defined", name)
+			}
+			word.WriteString(value)
+			inWord = true
+			i += length
+		case c == '`':
+			return nil, errors.New("nested commands can't be used with an allow list")
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == '|':
+			endWord()
+			if len(words) == 0 || (i+1 < len(runes) && runes[i+1] == '|') {
+				return nil, errors.New("'|' can only join commands into a pipeline with an allow list")
+			}
+			pipeline = append(pipeline, words)
+			words = []string{}
+		case strings.ContainsRune(";&<>(){}*?[]~#!\n\r", c):
+			return nil, fmt.Errorf("'%c' can't be used with an allow list unless it is quoted", c)
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	endWord()
+	if len(words) == 0 {
+		if len(pipeline) > 0 {
+			return nil, errors.New("'|' can only join commands into a pipeline with an allow list")
+		}
+		return nil, errors.New("no command given")
+	}
+	return append(pipeline, words), nil
+}
+
+// Reads the name of a variable reference, just after its '$'. Ex 'NAME' or '{NAME}'.
+// length is how much of text the reference takes up, or 0 if it isn't a plain reference to a variable
+func commandVariableName(text []rune) (name string, length int) {
+	braced := len(text) > 0 && text[0] == '{'
+	start := 0
+	if braced {
+		start = 1
+	}
+	end := start
+	for end < len(text) && (text[end] == '_' || (text[end] >= 'A' && text[end] <= 'Z') || (text[end] >= 'a' && text[end] <= 'z') ||
+		(end > start && text[end] >= '0' && text[end] <= '9')) {
+		end++
+	}
+	if end == start {
+		return "", 0
+	}
+	if !braced {
+		return string(text[start:end]), end
+	}
+	if end == len(text) || text[end] != '}' {
+		return "", 0
+	}
+	return string(text[start:end]), end + 1
+}
+
+// Finds the first '$(...)' in value that isn't escaped. end is just after its closing ')'.
+// ok is false if there isn't one, or it is never closed
+func findCommandSubstitution(value string) (start int, end int, ok bool) {
+	for i := 0; i+1 < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] != '$' || value[i+1] != '(' {
+			continue
+		}
+		depth := 0
+		var quote byte
+		for j := i + 1; j < len(value); j++ {
+			c := value[j]
+			switch {
+			case c == '\\' && quote != '\'':
+				// Escaped quotes and parentheses don't count
+				j++
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				quote = c
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+				if depth == 0 {
+					return i, j + 1, true
+				}
+			}
+		}
+		return 0, 0, false
+	}
+	return 0, 0, false
+}
+
+// Expands the variables in value, and substitutes the output of any commands if commands is given.
+// Commands are kept as they were written otherwise. Variables inside commands are left for the shell.
+func expandValue(value string, ctx ExpansionContext, commands *CommandSubstitution) (expanded string, allTranslated bool, neededKeys []string, err error) {
+	sb := strings.Builder{}
+	allTranslated = true
+	neededKeys = []string{}
+	rest := value
+	for {
+		start, end, found := findCommandSubstitution(rest)
+		literal := rest
+		if found {
+			literal = rest[:start]
+		}
+		replaced, done, missing, err := ExpandVarStringWith(literal, ctx)
+		if err != nil {
+			return "", false, nil, err
+		}
+		allTranslated = allTranslated && done
+		neededKeys = append(neededKeys, missing...)
+		sb.WriteString(replaced)
+		if !found {
+			return sb.String(), allTranslated, neededKeys, nil
+		}
+
+		if commands == nil {
+			sb.WriteString(rest[start:end])
+		} else {
+			output, err := commands.Run(rest[start+2:end-1], ctx)
+			if err != nil {
+				return "", false, nil, err
+			}
+			sb.WriteString(output)
+		}
+		rest = rest[end:]
+	}
+}
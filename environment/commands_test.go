@@ -0,0 +1,96 @@
+package environment
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandSubstitution(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are written for sh")
+	}
+	input := "NAME=world\nGREETING=\"hello $(echo $NAME | tr a-z A-Z)!\"\nAGAIN=$(echo $NAME | tr a-z A-Z)$(echo $NAME | tr a-z A-Z)\n"
+
+	// Kept as written unless turned on
+	env := NewVariableMap()
+	if err := ProcessEnvironmentWith(strings.NewReader(input), env, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello $(echo $NAME | tr a-z A-Z)!"; env.Get("GREETING") != want {
+		t.Fatalf("want '%s', got '%s'", want, env.Get("GREETING"))
+	}
+
+	commands := NewCommandSubstitution()
+	env = NewVariableMap()
+	if err := ProcessEnvironmentWith(strings.NewReader(input), env, ProcessOptions{Commands: commands}); err != nil {
+		t.Fatal(err)
+	}
+	if env.Get("GREETING") != "hello WORLD!" || env.Get("AGAIN") != "WORLDWORLD" {
+		t.Fatalf("wrong output substituted: %v", env)
+	}
+	// AGAIN's command sees GREETING as well, so only its second use is cached
+	if runs := commands.Runs(); len(runs) != 3 || runs[0].Name != "GREETING" || runs[1].Cached || !runs[2].Cached {
+		t.Fatalf("want only the last run to be cached, got %+v", runs)
+	}
+
+	// Changed variables run the command again
+	env = NewVariableMap()
+	if err := ProcessEnvironmentWith(strings.NewReader("X=one\nA=$(echo $X)\nX=two\nB=$(echo $X)\n"), env, ProcessOptions{Commands: NewCommandSubstitution()}); err != nil {
+		t.Fatal(err)
+	}
+	if env.Get("A") != "one" || env.Get("B") != "two" {
+		t.Fatalf("want 'one' then 'two', got '%s' then '%s'", env.Get("A"), env.Get("B"))
+	}
+
+	commands = NewCommandSubstitution()
+	commands.Allow = []string{"echo"}
+	commands.Timeout = 200 * time.Millisecond
+	for value, want := range map[string]string{
+		"$(echo hi | tr a-z A-Z)":            "'tr' isn't allowed",
+		"$(echo $(id))":                      "nested commands",
+		"$(echo `id`)":                       "nested commands",
+		"$(sleep 5)":                         "'sleep' isn't allowed",
+		"$(echo \\'; touch pwned; echo \\')": "';' can't be used",
+		"$(echo <(touch pwned))":             "'<' can't be used",
+		"$(echo hi > pwned)":                 "'>' can't be used",
+		"$(echo hi && touch pwned)":          "'&' can't be used",
+		"$(echo hi || touch pwned)":          "'|' can only join",
+		"$(echo ${X:-y})":                    "only $NAME and ${NAME}",
+		"$(PATH=. echo hi)":                  "'PATH=.' isn't allowed",
+	} {
+		err := ProcessEnvironmentWith(strings.NewReader("X="+value+"\n"), &VariableMap{}, ProcessOptions{Commands: commands})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: want an error containing '%s', got %v", value, want, err)
+		}
+	}
+
+	// Commands run without a shell, so quotes and escapes are only ever arguments
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"bin/echo": "#!/bin/sh\necho fake\n"})
+	if err := os.Chmod(filepath.Join(dir, "bin", "echo"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	commands.Dir = dir
+	env = NewVariableMap()
+	input = "NAME=\"a b\"\nPATH=./bin:/nowhere\nQUOTED=$(echo it\\'s '$NAME;' ${NAME} c\\ d | cat)\n"
+	commands.Allow = []string{"echo", "cat"}
+	if err := ProcessEnvironmentWith(strings.NewReader(input), env, ProcessOptions{Commands: commands}); err != nil {
+		t.Fatal(err)
+	}
+	// The PATH from the env file doesn't change which echo runs
+	if want := "it's $NAME; a b c d"; env.Get("QUOTED") != want {
+		t.Fatalf("want '%s', got '%s'", want, env.Get("QUOTED"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+		t.Fatal("want nothing but the allowed commands run")
+	}
+
+	commands.Allow = nil
+	if err := ProcessEnvironmentWith(strings.NewReader("X=$(sleep 5)\n"), &VariableMap{}, ProcessOptions{Commands: commands}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("want a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package environment
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// RegEx pattern to match the directives of a conditional block.
+// Ex '# @if OS == "darwin"', '# @elif OS == "windows"', '# @else' and '# @endif'
+const CONDITION_LINE_REGEX = `^[ \t]*#[ \t]*@(if|elif|else|endif)\b[ \t]*(.*?)[ \t]*$`
+
+// A single term of a condition. Ex 'OS == "darwin"', 'HOSTNAME != "build-01"' or '!DEBUG'
+const conditionTermRegex = `^(?:(!)?[ \t]*(\$\{[A-Za-z][\w-]*\}|\$?[A-Za-z][\w-]*)|("[^"]*"|'[^']*'|\$\{[A-Za-z][\w-]*\}|\$?[A-Za-z][\w-]*)[ \t]*(==|!=)[ \t]*("[^"]*"|'[^']*'|\$\{[A-Za-z][\w-]*\}|\$?[A-Za-z][\w-]*))$`
+
+// Provides the variables that conditions can always use, on top of those already defined.
+// GOOS and GOARCH are as Go names them. Ex 'darwin' and 'arm64'. OS is the same as GOOS.
+// HOSTNAME and USER are left out if they can't be found.
+func BuiltinVariables() *VariableMap {
+	builtins := NewVariableMap()
+	builtins.Set("GOOS", runtime.GOOS)
+	builtins.Set("GOARCH", runtime.GOARCH)
+	builtins.Set("OS", runtime.GOOS)
+	if hostname, err := os.Hostname(); err == nil {
+		builtins.Set("HOSTNAME", hostname)
+	}
+	if u, err := user.Current(); err == nil {
+		builtins.Set("USER", u.Username)
+	}
+	return builtins
+}
+
+// Decides whether the condition holds. Names are looked up with lookup.
+// Terms compare two values with '==' or '!=', or check that a variable is defined and not empty. Ex 'DEBUG' or '!DEBUG'.
+// Values are names or quoted strings. Terms can be joined with '&&' and '||'. '&&' is done first.
+// Ex 'OS == "darwin" && USER != "root"'
+func EvaluateCondition(condition string, lookup func(name string) (string, bool)) (bool, error) {
+	rTerm := regexp.MustCompile(conditionTermRegex)
+	if len(strings.TrimSpace(condition)) == 0 {
+		return false, fmt.Errorf("condition is empty")
+	}
+
+	for _, either := range splitCondition(condition, "||") {
+		all := true
+		for _, term := range splitCondition(either, "&&") {
+			matches := rTerm.FindStringSubmatch(strings.TrimSpace(term))
+			if matches == nil {
+				return false, fmt.Errorf("can't understand condition '%s'", strings.TrimSpace(term))
+			}
+			var holds bool
+			if len(matches[2]) > 0 {
+				value, ok := lookup(conditionName(matches[2]))
+				holds = ok && len(value) > 0
+				if len(matches[1]) > 0 {
+					holds = !holds
+				}
+			} else {
+				left, err := conditionValue(matches[3], lookup)
+				if err != nil {
+					return false, err
+				}
+				right, err := conditionValue(matches[5], lookup)
+				if err != nil {
+					return false, err
+				}
+				holds = (left == right) == (matches[4] == "==")
+			}
+			all = all && holds
+		}
+		if all {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Splits condition on each sep that isn't inside quotes
+func splitCondition(condition string, sep string) []string {
+	parts := []string{}
+	var quote byte
+	start := 0
+	for i := 0; i < len(condition); i++ {
+		c := condition[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(condition[i:], sep):
+			parts = append(parts, condition[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, condition[start:])
+}
+
+// Takes any '$' or '${}' off of a name
+func conditionName(operand string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(operand, "$"), "{"), "}")
+}
+
+// Provides the value an operand stands for. Quoted strings are used as they are, without the quotes
+func conditionValue(operand string, lookup func(name string) (string, bool)) (string, error) {
+	if operand[0] == '"' || operand[0] == '\'' {
+		return operand[1 : len(operand)-1], nil
+	}
+	name := conditionName(operand)
+	if value, ok := lookup(name); ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown variable '%s' in condition", name)
+}
+
+// Where a conditional block is, part way through processing a file
+type conditionalBlock struct {
+	// Were the definitions around the block being used?
+	parentActive bool
+	// Are the definitions in the current branch being used?
+	active bool
+	// Has a branch been used already?
+	taken bool
+}
+
+// Tracks the conditional blocks in a file and decides which definitions are used
+type conditionalState struct {
+	blocks   []*conditionalBlock
+	builtins *VariableMap
+}
+
+// Is the current definition being used?
+func (cs *conditionalState) Active() bool {
+	return len(cs.blocks) == 0 || cs.blocks[len(cs.blocks)-1].active
+}
+
+// Moves into, along or out of a conditional block. Conditions are evaluated against envProcessed, then the builtins.
+// Returns the branch that was reached, for the provenance. ok is false if it wasn't looked at as the whole block is
+// being skipped.
+func (cs *conditionalState) Apply(d Definition, origin Origin, envProcessed *VariableMap) (branch Branch, ok bool, err error) {
+	branch = Branch{Origin: origin, Kind: d.Kind, Condition: d.Condition}
+	lookup := func(name string) (string, bool) {
+		if v, ok := envProcessed.Lookup(name); ok {
+			return v, true
+		}
+		if cs.builtins == nil {
+			cs.builtins = BuiltinVariables()
+		}
+		return cs.builtins.Lookup(name)
+	}
+
+	switch d.Kind {
+	case DEFINITION_IF:
+		block := &conditionalBlock{parentActive: cs.Active()}
+		cs.blocks = append(cs.blocks, block)
+		if !block.parentActive {
+			return branch, false, nil
+		}
+		if block.active, err = EvaluateCondition(d.Condition, lookup); err != nil {
+			return branch, false, err
+		}
+		block.taken = block.active
+		branch.Taken = block.active
+		return branch, true, nil
+	case DEFINITION_ELIF, DEFINITION_ELSE:
+		block := cs.blocks[len(cs.blocks)-1]
+		if !block.parentActive {
+			return branch, false, nil
+		}
+		block.active = false
+		if !block.taken {
+			if d.Kind == DEFINITION_ELSE {
+				block.active = true
+			} else if block.active, err = EvaluateCondition(d.Condition, lookup); err != nil {
+				return branch, false, err
+			}
+		}
+		block.taken = block.taken || block.active
+		branch.Taken = block.active
+		return branch, true, nil
+	case DEFINITION_ENDIF:
+		cs.blocks = cs.blocks[:len(cs.blocks)-1]
+	}
+	return branch, false, nil
+}
@@ -0,0 +1,184 @@
+package environment
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Line that defines a variable. Ex 'NAME=value'
+	DEFINITION_VARIABLE = "variable"
+	// Line that pulls in the definitions from another file. Ex '# @include ./common.env'
+	DEFINITION_INCLUDE = "include"
+	// Line that removes a variable defined earlier, or inherited. Ex 'unset NAME'
+	DEFINITION_UNSET = "unset"
+	// Lines of a conditional block. Ex '# @if OS == "darwin"', '# @elif OS == "linux"', '# @else' and '# @endif'
+	DEFINITION_IF    = "if"
+	DEFINITION_ELIF  = "elif"
+	DEFINITION_ELSE  = "else"
+	DEFINITION_ENDIF = "endif"
+)
+
+// RegEx pattern to match an include directive.
+// Ex '# @include ./common.env', '# @include? ./optional.env' or 'source ./common.env'
+const INCLUDE_LINE_REGEX = `^[ \t]*(?:#[ \t]*@include(\?)?|source)[ \t]+(.*?)[ \t]*$`
+
+// RegEx pattern to match an unset directive. Several names may be given. Ex 'unset NAME OTHER_NAME'
+const UNSET_LINE_REGEX = `^[ \t]*unset((?:[ \t]+[A-Za-z][\w-]*)+)[ \t]*$`
+
+// A line of an env file that does something
+type Definition struct {
+	// What the line does. One of the DEFINITION_* kinds
+	Kind string
+	// Line number, from 1
+	Line int
+
+	// Name of the variable being defined, or unset
+	Name string
+	// Value as written, without any wrapping double-quotes
+	Value string
+
+	// Path to the file being included. Relative paths are relative to the file the directive is in
+	Path string
+	// Is it fine for the included file not to exist?
+	Optional bool
+
+	// Condition for an if or elif branch. See EvaluateCondition
+	Condition string
+}
+
+// Provides the definition as a Variable. Unset definitions give an Undefined one.
+// Only meaningful for DEFINITION_VARIABLE and DEFINITION_UNSET
+func (d Definition) Variable() Variable {
+	return Variable{Name: d.Name, Value: d.Value, Undefined: d.Kind == DEFINITION_UNSET}
+}
+
+// Reads every line in rIn that does something. Comments, blank lines and anything unrecognised are skipped.
+// Conditional blocks must be complete within rIn.
+func ReadDefinitions(rIn io.Reader) ([]Definition, error) {
+	defs := make([]Definition, 0, 10)
+	// Lines of the conditional blocks that are open, and whether each has reached its else yet
+	openBlocks := []int{}
+	pastElse := []bool{}
+
+	scanner := bufio.NewScanner(rIn)
+	rVar := regexp.MustCompile(ENV_LINE_REGEX)
+	rInclude := regexp.MustCompile(INCLUDE_LINE_REGEX)
+	rUnset := regexp.MustCompile(UNSET_LINE_REGEX)
+	rCondition := regexp.MustCompile(CONDITION_LINE_REGEX)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if idxes := rVar.FindStringSubmatchIndex(text); len(idxes) > 0 {
+			// The value's group only holds the last part it repeated over. The whole value is taken from the line instead
+			start, end := definitionValueSpan(text, idxes[3], idxes[1])
+			defs = append(defs, Definition{Kind: DEFINITION_VARIABLE, Line: line, Name: text[idxes[2]:idxes[3]], Value: text[start:end]})
+		} else if matches := rCondition.FindStringSubmatch(text); len(matches) == 3 {
+			d := Definition{Kind: matches[1], Line: line, Condition: matches[2]}
+			depth := len(openBlocks)
+			switch d.Kind {
+			case DEFINITION_IF:
+				openBlocks = append(openBlocks, line)
+				pastElse = append(pastElse, false)
+			case DEFINITION_ELIF, DEFINITION_ELSE, DEFINITION_ENDIF:
+				if depth == 0 {
+					return defs, fmt.Errorf("line %d: @%s without @if", line, d.Kind)
+				}
+				if d.Kind != DEFINITION_ENDIF && pastElse[depth-1] {
+					return defs, fmt.Errorf("line %d: @%s after @else", line, d.Kind)
+				}
+				if d.Kind == DEFINITION_ENDIF {
+					openBlocks, pastElse = openBlocks[:depth-1], pastElse[:depth-1]
+				} else if d.Kind == DEFINITION_ELSE {
+					pastElse[depth-1] = true
+				}
+			}
+			if hasCondition := d.Kind == DEFINITION_IF || d.Kind == DEFINITION_ELIF; hasCondition != (len(d.Condition) > 0) {
+				if hasCondition {
+					return defs, fmt.Errorf("line %d: @%s is missing its condition", line, d.Kind)
+				}
+				return defs, fmt.Errorf("line %d: @%s doesn't take a condition", line, d.Kind)
+			}
+			defs = append(defs, d)
+		} else if matches := rInclude.FindStringSubmatch(text); len(matches) == 3 {
+			path := strings.Trim(matches[2], `"'`)
+			if len(path) == 0 {
+				return defs, fmt.Errorf("line %d: include is missing the file to include", line)
+			}
+			defs = append(defs, Definition{Kind: DEFINITION_INCLUDE, Line: line, Path: path, Optional: len(matches[1]) > 0})
+		} else if matches := rUnset.FindStringSubmatch(text); len(matches) == 2 {
+			for _, name := range strings.Fields(matches[1]) {
+				defs = append(defs, Definition{Kind: DEFINITION_UNSET, Line: line, Name: name})
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return defs, err
+	}
+	if len(openBlocks) > 0 {
+		return defs, fmt.Errorf("line %d: @if is never closed with @endif", openBlocks[len(openBlocks)-1])
+	}
+	return defs, nil
+}
+
+// Works out where an include directive's file is. Relative paths are relative to the directory of the including file,
+// or the working directory if it wasn't read from a file.
+func resolveInclude(from string, target string) string {
+	if filepath.IsAbs(target) || len(from) == 0 {
+		return target
+	}
+	return filepath.Join(filepath.Dir(from), target)
+}
+
+// Provides the given files along with every file they include, directly or not, in the order they are first reached.
+// Nothing is processed, so it is safe to use on files that haven't been reviewed. Optional includes that don't exist
+// are left out.
+func IncludedFiles(paths ...string) ([]string, error) {
+	found := []string{}
+	seen := map[string]bool{}
+	var visit func(path string, optional bool) error
+	visit = func(path string, optional bool) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if seen[abs] {
+			return nil
+		}
+		file, err := os.Open(path)
+		if optional && errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defs, err := ReadDefinitions(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		seen[abs] = true
+		found = append(found, path)
+		for _, d := range defs {
+			if d.Kind == DEFINITION_INCLUDE {
+				if err := visit(resolveInclude(path, d.Path), d.Optional); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, p := range paths {
+		if err := visit(p, false); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,203 @@
+package environment
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Prefix that marks a variable's value as encrypted with version 1 of the format.
+	// Version 1 is AES-256-GCM with a random nonce. The variable's name is used as additional authenticated data
+	// so an encrypted value can't be copied to a different variable.
+	ENCRYPTED_PREFIX_V1 = "enc:v1:"
+	// Number of bytes required for an encryption key
+	ENCRYPTION_KEY_SIZE = 32
+	// Name of the Environment variable that is checked for an encryption key when no key file is given
+	ENCRYPTION_KEY_ENV = "GLENV_KEY"
+)
+
+// Returned when an encrypted value couldn't be decrypted with the given key
+var ErrDecryptionFailed = errors.New("failed to decrypt value. wrong key or the value was modified")
+
+// Creates a new random key suitable for EncryptValue and DecryptValue
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, ENCRYPTION_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encodes key as text, suitable for a key file or Environment variable
+func EncodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Parses a key in the format produced by EncodeKey. Surrounding whitespace is ignored.
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encoding: %w", err)
+	}
+	if len(key) != ENCRYPTION_KEY_SIZE {
+		return nil, fmt.Errorf("invalid key length. want %d bytes, got %d", ENCRYPTION_KEY_SIZE, len(key))
+	}
+	return key, nil
+}
+
+// Reads in a key from the file at path. The file should contain a single key as produced by EncodeKey.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(data))
+}
+
+// Writes a key to a new file at path that only the current user can read.
+// Fails if the file already exists so a key is never accidentally replaced.
+func WriteKeyFile(path string, key []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(file, EncodeKey(key)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Is value in the encrypted format produced by EncryptValue?
+func IsEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, ENCRYPTED_PREFIX_V1)
+}
+
+// Encrypts the value for the variable called name using key.
+// Returns the encrypted value, including the ENCRYPTED_PREFIX_V1 prefix, that can be written to an env file.
+func EncryptValue(name string, value string, key []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return ENCRYPTED_PREFIX_V1 + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a value that was produced by EncryptValue for the variable called name.
+// Returns ErrDecryptionFailed if the key is wrong or the value has been tampered with.
+func DecryptValue(name string, value string, key []byte) (string, error) {
+	if !IsEncryptedValue(value) {
+		return "", fmt.Errorf("value for '%s' is not encrypted", name)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, ENCRYPTED_PREFIX_V1))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value for '%s': %w", name, err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted value for '%s': too short", name)
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("'%s': %w", name, ErrDecryptionFailed)
+	}
+	return string(plain), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != ENCRYPTION_KEY_SIZE {
+		return nil, fmt.Errorf("invalid key length. want %d bytes, got %d", ENCRYPTION_KEY_SIZE, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Copies the env file data in r to w, allowing the values of variable definitions to be replaced along the way.
+// update is called for every variable definition found. If it returns changed == true then the definition's value is replaced with newValue.
+// All other content, such as comments, quotes and "export" prefixes, is written out untouched.
+// New values are written so they read back exactly as given. See FormatValue
+func RewriteValues(r io.Reader, w io.Writer, update func(v Variable) (newValue string, changed bool, err error)) error {
+	scanner := bufio.NewScanner(r)
+	rLine := regexp.MustCompile(ENV_LINE_REGEX)
+	bw := bufio.NewWriter(w)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idxes := rLine.FindStringSubmatchIndex(line); len(idxes) == 6 {
+			start, end := definitionValueSpan(line, idxes[3], idxes[1])
+			v := Variable{Name: line[idxes[2]:idxes[3]], Value: line[start:end]}
+			newValue, changed, err := update(v)
+			if err != nil {
+				return err
+			}
+			if changed {
+				formatted, err := FormatValue(v.Name, newValue, start > idxes[3]+1)
+				if err != nil {
+					return err
+				}
+				line = line[:idxes[3]+1] + formatted
+			}
+		}
+		if _, err := bw.WriteString(line); err != nil {
+			return err
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Gives the text to write after the '=' of a definition so that it reads back as value.
+// quote wraps the value in double-quotes. Values with leading or trailing spaces are always wrapped.
+// Env files have no way to escape a '$', a '"' without a '\' before it or a line break, so values holding any of those give an error.
+func FormatValue(name string, value string, quote bool) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("value for '%s' has a line break, which an env file can't hold", name)
+	}
+	if strings.Contains(value, "$") {
+		return "", fmt.Errorf("value for '%s' has a '$', which would be expanded when read", name)
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' && (i == 0 || value[i-1] != '\\') {
+			return "", fmt.Errorf("value for '%s' has a '\"' without a '\\' before it, which an env file can't hold", name)
+		}
+	}
+
+	padded := strings.Trim(value, " \t") != value
+	if padded || quote {
+		// A closing quote after a '\' is read as part of the value
+		if !strings.HasSuffix(value, `\`) {
+			return `"` + value + `"`, nil
+		}
+		if padded {
+			return "", fmt.Errorf("value for '%s' has spaces around it and ends with '\\', which an env file can't hold", name)
+		}
+	}
+	return value, nil
+}
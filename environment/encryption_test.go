@@ -0,0 +1,114 @@
+package environment
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptValue(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := EncryptValue("DB_PASS", "hunter2", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedValue(encrypted) {
+		t.Fatalf("missing prefix on `%s`", encrypted)
+	}
+
+	if plain, err := DecryptValue("DB_PASS", encrypted, key); err != nil {
+		t.Fatal(err)
+	} else if plain != "hunter2" {
+		t.Fatalf("want `hunter2`, got `%s`", plain)
+	}
+
+	// Moving the value to another variable must fail authentication
+	if _, err := DecryptValue("OTHER", encrypted, key); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("want ErrDecryptionFailed, got %v", err)
+	}
+}
+
+func TestProcessEnvironmentDecrypts(t *testing.T) {
+	key, _ := GenerateKey()
+	encrypted, _ := EncryptValue("DB_PASS", "pa$$word", key)
+	envString := "DB_USER=admin\nDB_PASS=" + encrypted + "\n"
+
+	env := NewVariableMap()
+	if err := ProcessEnvironmentWith(strings.NewReader(envString), env, ProcessOptions{Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if env.Get("DB_PASS") != "pa$$word" {
+		t.Fatalf("want decrypted value, got `%s`", env.Get("DB_PASS"))
+	}
+
+	// Without a key the value is left alone
+	env = NewVariableMap()
+	if err := ProcessEnvironment(strings.NewReader(envString), env, false); err != nil {
+		t.Fatal(err)
+	}
+	if env.Get("DB_PASS") != encrypted {
+		t.Fatalf("want encrypted value, got `%s`", env.Get("DB_PASS"))
+	}
+}
+
+func TestRewriteValuesKeepsOtherLines(t *testing.T) {
+	input := "# Comment\nexport A=\"first\"\nB=second\n"
+	sb := strings.Builder{}
+	err := RewriteValues(strings.NewReader(input), &sb, func(v Variable) (string, bool, error) {
+		return strings.ToUpper(v.Value), v.Name == "A", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Comment\nexport A=\"FIRST\"\nB=second\n"
+	if sb.String() != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, sb.String())
+	}
+}
+
+func TestRewriteValuesReadsBackTheSame(t *testing.T) {
+	tests := []struct {
+		line  string
+		value string
+		want  string
+		err   string
+	}{
+		{"A=old", "plain #text", "A=plain #text", ""},
+		{"A=old", " padded ", `A=" padded "`, ""},
+		{`A="old"`, `ends\"`, `A="ends\""`, ""},
+		// A closing quote after a '\' would be read as part of the value
+		{`A="old"`, `C:\dir\`, `A=C:\dir\`, ""},
+		{"A=old", "${HOST}", "", "has a '$'"},
+		{"A=old", `say "hi"`, "", "without a '\\'"},
+		{"A=old", "two\nlines", "", "line break"},
+		{"A=old", ` C:\dir\`, "", "ends with '\\'"},
+	}
+	for _, tt := range tests {
+		sb := strings.Builder{}
+		err := RewriteValues(strings.NewReader(tt.line+"\n"), &sb, func(v Variable) (string, bool, error) {
+			return tt.value, true, nil
+		})
+		if len(tt.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("`%s`: want error containing `%s`, got %v", tt.value, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(sb.String(), "\n"); got != tt.want {
+			t.Fatalf("want `%s`, got `%s`", tt.want, got)
+		}
+		env := NewVariableMap()
+		if err := ProcessEnvironment(strings.NewReader(sb.String()), env, false); err != nil {
+			t.Fatal(err)
+		}
+		if env.Get("A") != tt.value {
+			t.Fatalf("`%s`: want it read back unchanged, got `%s`", tt.want, env.Get("A"))
+		}
+	}
+}
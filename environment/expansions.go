@@ -0,0 +1,174 @@
+package environment
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Namespace of the builtins that describe where and when the Environment is being processed. Ex '${glenv:cwd}'
+const EXPANSION_NAMESPACE_GLENV = "glenv"
+
+// RegEx pattern for a namespace. Ex 'glenv' or 'upper'
+const REGEX_EXPANSION_NAMESPACE = `[A-Za-z][\w-]*`
+
+// Details about the value being expanded, given to each ExpansionFunc
+type ExpansionContext struct {
+	// Env file the value was read from. Empty if it wasn't read from a file
+	File string
+	// Name of the variable whose value is being expanded. Empty if it isn't for a variable
+	Name string
+	// Variables that have been defined so far
+	Variables *VariableMap
+	// Functions that can be used. DefaultExpansions is used if nil
+	Registry *ExpansionRegistry
+}
+
+// Directory of the env file the value was read from. The working directory if it wasn't read from a file
+func (ctx ExpansionContext) FileDir() (string, error) {
+	if len(ctx.File) == 0 {
+		return os.Getwd()
+	}
+	return filepath.Abs(filepath.Dir(ctx.File))
+}
+
+// Provides the value of a '${<namespace>:<arg>}' reference. arg is everything after the first ':'
+type ExpansionFunc func(arg string, ctx ExpansionContext) (string, error)
+
+// Functions that can be used in expansions, by namespace
+type ExpansionRegistry struct {
+	mu    sync.RWMutex
+	funcs map[string]ExpansionFunc
+}
+
+// Creates a registry with the builtins. See DefaultExpansions
+func NewExpansionRegistry() *ExpansionRegistry {
+	r := &ExpansionRegistry{funcs: make(map[string]ExpansionFunc)}
+	r.Register(EXPANSION_NAMESPACE_GLENV, expandGlenv)
+	r.Register("upper", ValueFunction(strings.ToUpper))
+	r.Register("lower", ValueFunction(strings.ToLower))
+	r.Register("basename", ValueFunction(filepath.Base))
+	r.Register("dirname", ValueFunction(filepath.Dir))
+	return r
+}
+
+// Registry used when no other is given. Functions added to it can be used everywhere. Holds:
+//
+//	${glenv:cwd}          the working directory
+//	${glenv:file_dir}     directory of the env file being read, so relative paths work from anywhere
+//	${glenv:hostname}     this machine's name
+//	${glenv:user}         the current user's name
+//	${glenv:now:RFC3339}  the current time. Takes the name of a layout from the time package, or a layout itself
+//	${glenv:uuid}         a random UUID
+//	${upper:NAME}         value of NAME in upper case
+//	${lower:NAME}         value of NAME in lower case
+//	${basename:NAME}      last element of the path in NAME
+//	${dirname:NAME}       all but the last element of the path in NAME
+var DefaultExpansions = NewExpansionRegistry()
+
+// Adds fn to DefaultExpansions under namespace. Replaces any function already there
+func RegisterExpansion(namespace string, fn ExpansionFunc) error {
+	return DefaultExpansions.Register(namespace, fn)
+}
+
+// Adds fn under namespace. Replaces any function already there
+func (r *ExpansionRegistry) Register(namespace string, fn ExpansionFunc) error {
+	if !regexp.MustCompile(`^` + REGEX_EXPANSION_NAMESPACE + `$`).MatchString(namespace) {
+		return fmt.Errorf("invalid expansion namespace '%s'", namespace)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.funcs[namespace] = fn
+	return nil
+}
+
+// Provides the function for namespace. ok is false if there isn't one
+func (r *ExpansionRegistry) Lookup(namespace string) (fn ExpansionFunc, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok = r.funcs[namespace]
+	return fn, ok
+}
+
+// Works out the value of '${<namespace>:<arg>}'
+func (r *ExpansionRegistry) Expand(namespace string, arg string, ctx ExpansionContext) (string, error) {
+	fn, ok := r.Lookup(namespace)
+	if !ok {
+		return "", fmt.Errorf("unknown expansion '%s'", namespace)
+	}
+	return fn(arg, ctx)
+}
+
+// Creates an ExpansionFunc that applies fn to the value of the variable named by its argument. Ex '${upper:NAME}'
+func ValueFunction(fn func(value string) string) ExpansionFunc {
+	return func(arg string, ctx ExpansionContext) (string, error) {
+		if v, ok := ctx.Variables.Lookup(arg); ok {
+			return fn(v), nil
+		}
+		return "", fmt.Errorf("unknown variable '%s'", arg)
+	}
+}
+
+// Names of the layouts from the time package that ${glenv:now:<layout>} accepts
+var timeLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"RFC822":      time.RFC822,
+	"RFC1123":     time.RFC1123,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"Stamp":       time.Stamp,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+	"TimeOnly":    "15:04:05",
+}
+
+// Provides the builtins in the glenv namespace
+func expandGlenv(arg string, ctx ExpansionContext) (string, error) {
+	name, param, _ := strings.Cut(arg, ":")
+	switch name {
+	case "cwd":
+		return os.Getwd()
+	case "file_dir":
+		return ctx.FileDir()
+	case "hostname":
+		return os.Hostname()
+	case "user":
+		u, err := user.Current()
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	case "now":
+		if len(param) == 0 {
+			param = "RFC3339"
+		}
+		if param == "Unix" {
+			return fmt.Sprint(time.Now().Unix()), nil
+		}
+		if layout, ok := timeLayouts[param]; ok {
+			param = layout
+		}
+		return time.Now().Format(param), nil
+	case "uuid":
+		return newUUID()
+	}
+	return "", fmt.Errorf("unknown builtin '%s:%s'", EXPANSION_NAMESPACE_GLENV, name)
+}
+
+// Creates a random, version 4, UUID
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
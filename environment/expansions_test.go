@@ -0,0 +1,46 @@
+package environment
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExpansions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.env")
+	writeTestFiles(t, dir, map[string]string{
+		"app.env": "DATA=${glenv:file_dir}/data\nNAME=Bob\nLOUD=\"${upper:NAME} ${lower:NAME}\"\nLEAF=${basename:DATA}\nID=${glenv:uuid}\nDAY=${glenv:now:DateOnly}\nBACKWARDS=${reverse:NAME}\n",
+	})
+
+	registry := NewExpansionRegistry()
+	registry.Register("reverse", ValueFunction(func(value string) string {
+		r := []rune(value)
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+		return string(r)
+	}))
+	env := NewVariableMap()
+	if err := ProcessEnvironmentFileWith(path, env, ProcessOptions{Expansions: registry}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"DATA": filepath.Join(dir) + "/data", "LOUD": "BOB bob", "LEAF": "data", "BACKWARDS": "boB"}
+	for name, value := range want {
+		if env.Get(name) != value {
+			t.Fatalf("want %s '%s', got '%s'", name, value, env.Get(name))
+		}
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(env.Get("ID")) {
+		t.Fatalf("not a UUID: '%s'", env.Get("ID"))
+	}
+	if !regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`).MatchString(env.Get("DAY")) {
+		t.Fatalf("not a date: '%s'", env.Get("DAY"))
+	}
+
+	// Custom functions stay out of the default registry
+	if err := ProcessEnvironment(strings.NewReader("X=${reverse:NAME}\n"), env, false); err == nil || !strings.Contains(err.Error(), "unknown expansion 'reverse'") {
+		t.Fatalf("want an unknown expansion error, got %v", err)
+	}
+}
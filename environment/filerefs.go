@@ -0,0 +1,122 @@
+package environment
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Start of a value that is read from a file. Ex 'DB_PASSWORD=@file:/run/secrets/db'
+const FILE_REF_PREFIX = "@file:"
+
+// Suffix of variables that hold the path to a file with the real value in it, as used by Docker's official images.
+// Ex 'DB_PASSWORD_FILE=/run/secrets/db'. Only used when given as FileRefOptions.Suffix, as plenty of variables that
+// end with it are just paths. Ex 'LOG_FILE=/var/log/app.log'
+const FILE_REF_SUFFIX = "_FILE"
+
+// Largest file read by default, in bytes
+const FILE_REF_MAX_SIZE = 1 << 20
+
+// Settings for values that are read from files, as Docker and Kubernetes secrets are mounted.
+// Values are read from files in two ways:
+//
+//	DB_PASSWORD=@file:/run/secrets/db       DB_PASSWORD is set to the contents of the file
+//	DB_PASSWORD_FILE=/run/secrets/db        DB_PASSWORD is set to the contents of the file as well, when Suffix is '_FILE'
+//
+// Relative paths are relative to the env file's directory.
+type FileRefOptions struct {
+	// Variables whose name ends with this hold the path to the value of the variable without it. Off if empty
+	Suffix string
+	// Should a trailing newline be kept? Files written by editors and 'echo' normally end with one
+	KeepNewline bool
+	// Largest file that may be read, in bytes. 0 means there's no limit
+	MaxSize int64
+	// Files must be within this directory. Any file may be read if empty
+	BaseDir string
+	// Should the values read be treated as secret?
+	MarkSecret bool
+}
+
+// Creates FileRefOptions that only read @file: values, trim a trailing newline, read up to FILE_REF_MAX_SIZE and
+// treat everything read as secret. Set Suffix to FILE_REF_SUFFIX to follow the _FILE convention as well
+func NewFileRefOptions() *FileRefOptions {
+	return &FileRefOptions{MaxSize: FILE_REF_MAX_SIZE, MarkSecret: true}
+}
+
+// Provides the name of the variable that the file should be read into, if name follows the Suffix convention.
+// Ex 'DB_PASSWORD' for 'DB_PASSWORD_FILE'
+func (fo *FileRefOptions) Target(name string) (target string, ok bool) {
+	if len(fo.Suffix) == 0 || len(name) <= len(fo.Suffix) || !strings.HasSuffix(name, fo.Suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, fo.Suffix), true
+}
+
+// Reads the value from the file at path. Relative paths are relative to the directory of from, the env file the
+// reference is in.
+func (fo *FileRefOptions) Read(path string, from string) (string, error) {
+	path = resolveInclude(from, path)
+	if err := fo.checkBaseDir(path); err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s isn't a regular file", path)
+	}
+
+	var r io.Reader = file
+	if fo.MaxSize > 0 {
+		// The file may grow after it was checked, so never read more than one byte past the limit
+		r = io.LimitReader(file, fo.MaxSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if fo.MaxSize > 0 && int64(len(data)) > fo.MaxSize {
+		return "", fmt.Errorf("%s is larger than the %d bytes allowed", path, fo.MaxSize)
+	}
+
+	value := string(data)
+	if !fo.KeepNewline {
+		value = strings.TrimSuffix(value, "\n")
+		value = strings.TrimSuffix(value, "\r")
+	}
+	return value, nil
+}
+
+// Makes sure path is within BaseDir once any links are followed
+func (fo *FileRefOptions) checkBaseDir(path string) error {
+	if len(fo.BaseDir) == 0 {
+		return nil
+	}
+	base, err := filepath.EvalSymlinks(fo.BaseDir)
+	if err != nil {
+		return err
+	}
+	if base, err = filepath.Abs(base); err != nil {
+		return err
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(base, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of %s", path, fo.BaseDir)
+	}
+	return nil
+}
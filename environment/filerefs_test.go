@@ -0,0 +1,61 @@
+package environment
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileRefs(t *testing.T) {
+	dir := t.TempDir()
+	secrets := filepath.Join(dir, "secrets")
+	writeTestFiles(t, dir, map[string]string{
+		"secrets/db":  "hunter2\n",
+		"secrets/big": strings.Repeat("x", 64),
+		"outside":     "nope\n",
+		"app.env":     "SECRETS=${glenv:file_dir}/secrets\nDB_PASSWORD_FILE=${SECRETS}/db\nAPI_KEY=@file:secrets/db\n",
+		"paths.env":   "LOG_FILE=${glenv:file_dir}/missing.log\nAPI_KEY=@file:secrets/db\n",
+	})
+	path := filepath.Join(dir, "app.env")
+
+	// The _FILE convention is off unless a suffix is given, so ordinary paths are left as they are
+	fileRefs := NewFileRefOptions()
+	env := NewVariableMap()
+	if err := ProcessEnvironmentFileWith(filepath.Join(dir, "paths.env"), env, ProcessOptions{FileRefs: fileRefs}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := env.Lookup("LOG"); ok || env.Get("LOG_FILE") != filepath.Join(dir, "missing.log") || env.Get("API_KEY") != "hunter2" {
+		t.Fatalf("want only API_KEY read from a file, got %v", env.Map())
+	}
+
+	fileRefs.Suffix = FILE_REF_SUFFIX
+	fileRefs.BaseDir = secrets
+	detector := NewSecretDetector()
+	env = NewVariableMap()
+	if err := ProcessEnvironmentFileWith(path, env, ProcessOptions{FileRefs: fileRefs, Secrets: detector}); err != nil {
+		t.Fatal(err)
+	}
+	if env.Get("DB_PASSWORD") != "hunter2" || env.Get("API_KEY") != "hunter2" {
+		t.Fatalf("want both values read from the file, got %v", env)
+	}
+	if !detector.IsSecret("API_KEY", "") {
+		t.Fatal("want values read from files marked as secret")
+	}
+
+	// Left alone without FileRefs
+	kept := NewVariableMap()
+	if err := ProcessEnvironmentFileWith(path, kept, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if kept.Get("API_KEY") != "@file:secrets/db" {
+		t.Fatalf("want the reference kept as written, got '%s'", kept.Get("API_KEY"))
+	}
+
+	fileRefs.MaxSize = 32
+	for value, want := range map[string]string{"@file:" + filepath.Join(secrets, "big"): "larger than", "@file:" + filepath.Join(dir, "outside"): "outside of"} {
+		err := ProcessEnvironmentWith(strings.NewReader("X="+value+"\n"), &VariableMap{}, ProcessOptions{FileRefs: fileRefs})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: want an error containing '%s', got %v", value, want, err)
+		}
+	}
+}
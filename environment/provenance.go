@@ -0,0 +1,124 @@
+package environment
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Where a variable was defined
+type Origin struct {
+	// File the definition is in. Empty when it wasn't read from a file
+	Path string
+	// Line the definition is on, from 1
+	Line int
+	// Include directive that brought Path in. nil if Path wasn't included by another file
+	IncludedFrom *Origin
+	// Is this where the variable was unset, rather than defined?
+	Unset bool
+}
+
+// Ex 'common.env:3, included from finances.mac.env:1'
+func (o Origin) String() string {
+	s := fmt.Sprintf("line %d", o.Line)
+	if len(o.Path) > 0 {
+		s = fmt.Sprintf("%s:%d", o.Path, o.Line)
+	}
+	if o.IncludedFrom != nil {
+		s += ", included from " + o.IncludedFrom.String()
+	}
+	return s
+}
+
+// Provides the files that included this one, from the outermost file in. Ex [finances.mac.env, common.env]
+func (o Origin) Chain() []string {
+	chain := []string{}
+	for from := o.IncludedFrom; from != nil; from = from.IncludedFrom {
+		chain = append([]string{from.Path}, chain...)
+	}
+	return chain
+}
+
+// A branch of a conditional block that was reached
+type Branch struct {
+	// Where the branch starts
+	Origin Origin
+	// DEFINITION_IF, DEFINITION_ELIF or DEFINITION_ELSE
+	Kind string
+	// Condition as written. Empty for else
+	Condition string
+	// Were the definitions in the branch used?
+	Taken bool
+}
+
+// Ex '@if OS == "darwin"'
+func (b Branch) String() string {
+	return strings.TrimSpace(fmt.Sprintf("@%s %s", b.Kind, b.Condition))
+}
+
+// Records where each variable was defined. Every definition is kept, so overridden ones can be seen too.
+// Also records which branch of each conditional block was used.
+type Provenance struct {
+	origins  map[string][]Origin
+	branches []Branch
+}
+
+// Creates an empty Provenance
+func NewProvenance() *Provenance {
+	return &Provenance{origins: make(map[string][]Origin)}
+}
+
+// Adds a definition of name. Later definitions override earlier ones. Does nothing if p is nil
+func (p *Provenance) Record(name string, origin Origin) {
+	if p == nil {
+		return
+	}
+	p.origins[name] = append(p.origins[name], origin)
+}
+
+// Adds a branch of a conditional block that was reached. Does nothing if p is nil
+func (p *Provenance) RecordBranch(branch Branch) {
+	if p == nil {
+		return
+	}
+	p.branches = append(p.branches, branch)
+}
+
+// Provides the branches of conditional blocks that were reached, in the order they were processed.
+// Branches in blocks that were skipped entirely aren't included
+func (p *Provenance) Branches() []Branch {
+	if p == nil {
+		return nil
+	}
+	return p.branches
+}
+
+// Provides every definition of name, in the order they were processed. The last one is the one in effect
+func (p *Provenance) Origins(name string) []Origin {
+	if p == nil {
+		return nil
+	}
+	return p.origins[name]
+}
+
+// Provides the definition of name that is in effect. ok is false if it was never defined
+func (p *Provenance) Last(name string) (origin Origin, ok bool) {
+	origins := p.Origins(name)
+	if len(origins) == 0 {
+		return Origin{}, false
+	}
+	return origins[len(origins)-1], true
+}
+
+// Provides the names of every variable that was defined, sorted
+func (p *Provenance) Names() []string {
+	if p == nil {
+		return nil
+	}
+	names := make([]string, 0, len(p.origins))
+	for n := range p.origins {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,103 @@
+package environment
+
+import (
+	"math"
+	"path"
+	"strings"
+)
+
+// Text shown in place of a secret value
+const SECRET_MASK = "****"
+
+// Name patterns that are treated as secret by default. Matching is done against the upper-cased name.
+var DefaultSecretNamePatterns = []string{
+	"*_PASSWORD", "*_PASSWD", "*_PASS", "*_TOKEN", "*_KEY", "*_SECRET",
+	"PASSWORD", "TOKEN", "SECRET",
+}
+
+// Decides which Environment variables hold secret values that shouldn't be displayed.
+// A variable is secret if it was explicitly marked, its name matches one of NamePatterns or its value looks randomly generated.
+type SecretDetector struct {
+	// Names of variables that were explicitly flagged as secret, such as any that were decrypted.
+	marked map[string]bool
+
+	// Glob patterns, as used by path.Match, for names that are always secret.
+	NamePatterns []string
+	// Minimum Shannon entropy, in bits per character, for a value to be considered randomly generated.
+	// 0 disables the check.
+	MinEntropy float64
+	// Values shorter than this are never considered randomly generated.
+	MinEntropyLength int
+}
+
+// Creates a SecretDetector that uses DefaultSecretNamePatterns and a conservative entropy check
+func NewSecretDetector() *SecretDetector {
+	return &SecretDetector{
+		marked:           make(map[string]bool),
+		NamePatterns:     DefaultSecretNamePatterns,
+		MinEntropy:       3.5,
+		MinEntropyLength: 20,
+	}
+}
+
+// Flags the given variable names as always being secret
+func (sd *SecretDetector) Mark(names ...string) {
+	if sd.marked == nil {
+		sd.marked = make(map[string]bool, len(names))
+	}
+	for _, n := range names {
+		sd.marked[n] = true
+	}
+}
+
+// Was the variable called name explicitly flagged as secret?
+func (sd *SecretDetector) IsMarked(name string) bool {
+	return sd.marked[name]
+}
+
+// Does the variable's name match one of the NamePatterns?
+func (sd *SecretDetector) IsSecretName(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, p := range sd.NamePatterns {
+		if ok, _ := path.Match(p, upper); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Does value look like a randomly generated token or password?
+// Values with whitespace, and those that look like paths or URLs, are never considered random.
+func (sd *SecretDetector) LooksRandom(value string) bool {
+	if sd.MinEntropy <= 0 || len(value) < sd.MinEntropyLength {
+		return false
+	}
+	if strings.ContainsAny(value, " \t\r\n") || strings.ContainsAny(value[:1], "/.~") || strings.Contains(value, "://") {
+		return false
+	}
+	return ShannonEntropy(value) >= sd.MinEntropy
+}
+
+// Should the variable with the given name and value be treated as secret?
+func (sd *SecretDetector) IsSecret(name string, value string) bool {
+	return sd.IsMarked(name) || sd.IsSecretName(name) || sd.LooksRandom(value)
+}
+
+// Calculates the Shannon entropy of value in bits per character
+func ShannonEntropy(value string) float64 {
+	if len(value) == 0 {
+		return 0
+	}
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range value {
+		counts[r]++
+		total++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
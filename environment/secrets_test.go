@@ -0,0 +1,67 @@
+package environment
+
+import (
+	"math"
+	"testing"
+)
+
+func TestShannonEntropy(t *testing.T) {
+	for value, want := range map[string]float64{
+		"":         0,
+		"aaaa":     0,
+		"abab":     1,
+		"abcd":     2,
+		"abcdefgh": 3,
+	} {
+		if got := ShannonEntropy(value); math.Abs(got-want) > 1e-9 {
+			t.Fatalf("'%s': want %f, got %f", value, want, got)
+		}
+	}
+	// Characters are counted rather than bytes
+	if got := ShannonEntropy("ééèè"); math.Abs(got-1) > 1e-9 {
+		t.Fatalf("want 1 bit per character, got %f", got)
+	}
+}
+
+func TestSecretDetector(t *testing.T) {
+	sd := NewSecretDetector()
+	tests := []struct {
+		name   string
+		value  string
+		secret bool
+	}{
+		{"DB_PASSWORD", "x", true},
+		{"db_password", "x", true},
+		{"API_TOKEN", "x", true},
+		{"TOKEN", "x", true},
+		{"TOKENS_DIR", "x", false},
+		{"LOG_LEVEL", "debug", false},
+		// Random looking values are secret whatever they're called
+		{"SESSION", "q8Zr2Lx9Wm4Tv7Kp1Ys6Bn3", true},
+		{"SHORT", "q8Zr2Lx9", false},
+		{"HOME_DIR", "/usr/local/share/q8Zr2Lx9Wm4Tv7Kp1Ys6Bn3", false},
+		{"SITE", "https://q8Zr2Lx9Wm4Tv7Kp1Ys6Bn3.example.com", false},
+		{"GREETING", "hello there q8Zr2Lx9Wm4Tv7Kp1Ys6Bn3", false},
+		{"REPEATED", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false},
+	}
+	for _, tt := range tests {
+		if got := sd.IsSecret(tt.name, tt.value); got != tt.secret {
+			t.Fatalf("%s='%s': want secret %t, got %t", tt.name, tt.value, tt.secret, got)
+		}
+	}
+
+	sd.Mark("LOG_LEVEL")
+	if !sd.IsMarked("LOG_LEVEL") || !sd.IsSecret("LOG_LEVEL", "debug") {
+		t.Fatal("want LOG_LEVEL secret once marked")
+	}
+
+	// The zero value only has what's been marked
+	var zero SecretDetector
+	if zero.IsSecret("DB_PASSWORD", "q8Zr2Lx9Wm4Tv7Kp1Ys6Bn3") {
+		t.Fatal("want nothing secret without patterns or an entropy check")
+	}
+	zero.Mark("PIN")
+	if !zero.IsSecret("PIN", "1234") {
+		t.Fatal("want PIN secret once marked")
+	}
+}
@@ -0,0 +1,104 @@
+package environment
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Somewhere that Environment variable declarations can be loaded from.
+type Source interface {
+	// Adds or updates each variable the source declares in envProcessed, the same as ProcessEnvironmentWith.
+	Load(envProcessed *VariableMap, opts ProcessOptions) error
+	// Paths to the files that were, or would be, read by Load
+	Paths() []string
+}
+
+// Source for a single env file. It must exist
+type FileSource struct {
+	Path string
+}
+
+func (fs FileSource) Load(envProcessed *VariableMap, opts ProcessOptions) error {
+	return ProcessEnvironmentFileWith(fs.Path, envProcessed, opts)
+}
+
+func (fs FileSource) Paths() []string {
+	return []string{fs.Path}
+}
+
+// Name of the stage where .local files are left out so tests run the same everywhere
+const STAGE_TEST = "test"
+
+// Source for the conventional cascade of env files in a directory, for a given stage. Ex 'production'
+// Files are loaded in this order, so later ones win:
+//
+//	.env
+//	.env.<stage>
+//	.env.local
+//	.env.<stage>.local
+//
+// Files that don't exist are skipped. The .local files are skipped for STAGE_TEST.
+type StageLoader struct {
+	// Directory the files are in
+	Dir string
+	// Name of the stage. Only .env and .env.local are used when empty
+	Stage string
+	// Name of the first file in the cascade, that the others are named after. Defaults to '.env'
+	BaseName string
+}
+
+// Creates a StageLoader for the cascade of .env files in dir
+func NewStageLoader(dir string, stage string) *StageLoader {
+	return &StageLoader{Dir: dir, Stage: stage, BaseName: ".env"}
+}
+
+// Provides the paths to every file in the cascade, in the order they are loaded, whether they exist or not
+func (sl *StageLoader) Candidates() []string {
+	base := sl.BaseName
+	if len(base) == 0 {
+		base = ".env"
+	}
+	names := []string{base}
+	if len(sl.Stage) > 0 {
+		names = append(names, fmt.Sprintf("%s.%s", base, sl.Stage))
+	}
+	if !strings.EqualFold(sl.Stage, STAGE_TEST) {
+		names = append(names, base+".local")
+		if len(sl.Stage) > 0 {
+			names = append(names, fmt.Sprintf("%s.%s.local", base, sl.Stage))
+		}
+	}
+
+	paths := make([]string, len(names))
+	for i, n := range names {
+		paths[i] = filepath.Join(sl.Dir, n)
+	}
+	return paths
+}
+
+// Provides the paths to the files in the cascade that exist, in the order they are loaded
+func (sl *StageLoader) Paths() []string {
+	paths := []string{}
+	for _, p := range sl.Candidates() {
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Loads every file in the cascade that exists. It's an error if none of them do.
+func (sl *StageLoader) Load(envProcessed *VariableMap, opts ProcessOptions) error {
+	paths := sl.Paths()
+	if len(paths) == 0 {
+		return fmt.Errorf("no env files found for stage '%s' in %s", sl.Stage, sl.Dir)
+	}
+	for _, p := range paths {
+		if err := ProcessEnvironmentFileWith(p, envProcessed, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
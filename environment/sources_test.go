@@ -0,0 +1,43 @@
+package environment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStageLoaderCascade(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".env":                  "NAME=base\nFROM_BASE=yes\n",
+		".env.production":       "NAME=production\n",
+		".env.local":            "NAME=local\nFROM_LOCAL=yes\n",
+		".env.production.local": "NAME=production-local\n",
+		".env.test":             "NAME=test\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for stage, want := range map[string]string{"production": "production-local", "test": "test", "staging": "local", "": "local"} {
+		env := NewVariableMap()
+		if err := NewStageLoader(dir, stage).Load(env, ProcessOptions{}); err != nil {
+			t.Fatalf("%s: %s", stage, err)
+		}
+		if env.Get("NAME") != want {
+			t.Fatalf("%s: want NAME '%s', got '%s'", stage, want, env.Get("NAME"))
+		}
+		if env.Get("FROM_BASE") != "yes" {
+			t.Fatalf("%s: .env wasn't loaded", stage)
+		}
+		if _, ok := env.Lookup("FROM_LOCAL"); ok == (stage == STAGE_TEST) {
+			t.Fatalf("%s: .env.local loaded is %t", stage, ok)
+		}
+	}
+
+	if err := NewStageLoader(t.TempDir(), "production").Load(&VariableMap{}, ProcessOptions{}); err == nil {
+		t.Fatal("expected an error when no files exist")
+	}
+}
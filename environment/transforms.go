@@ -0,0 +1,205 @@
+package environment
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// How Merge decides between two different values for the same name
+type MergeStrategy string
+
+const (
+	// The value already in the map is kept
+	MERGE_FIRST_WINS MergeStrategy = "first-wins"
+	// The value being merged in replaces it. The same as a later env file overriding an earlier one
+	MERGE_LAST_WINS MergeStrategy = "last-wins"
+	// Different values for the same name are an error
+	MERGE_ERROR MergeStrategy = "error"
+)
+
+// Provides the MergeStrategy named by s. Ex 'first-wins'
+func ParseMergeStrategy(s string) (MergeStrategy, error) {
+	switch strategy := MergeStrategy(s); strategy {
+	case MERGE_FIRST_WINS, MERGE_LAST_WINS, MERGE_ERROR:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown merge strategy '%s'. expecting %s, %s or %s", s, MERGE_FIRST_WINS, MERGE_LAST_WINS, MERGE_ERROR)
+}
+
+// The methods below never change the map they are called on. Each provides a new map, in the same order, so they
+// can be chained. Ex 'env.FilterGlob("LOGSTASH_*").StripPrefix("LOGSTASH_")'
+
+// Provides the variables that keep returns true for
+func (m *VariableMap) Filter(keep func(name string, value string) bool) *VariableMap {
+	filtered := NewVariableMap()
+	// Names are unchanged, so where they were defined still applies
+	filtered.provenance = m.Provenance()
+	m.Range(func(n, v string) bool {
+		if keep(n, v) {
+			filtered.Set(n, v)
+		}
+		return true
+	})
+	return filtered
+}
+
+// Provides the variables whose names match any of the glob patterns. Ex 'LOGSTASH_*'
+func (m *VariableMap) FilterGlob(patterns ...string) (*VariableMap, error) {
+	if err := checkGlobs(patterns); err != nil {
+		return nil, err
+	}
+	return m.Filter(func(n, _ string) bool { return matchesGlob(n, patterns) }), nil
+}
+
+// Provides the variables whose names don't match any of the glob patterns
+func (m *VariableMap) ExcludeGlob(patterns ...string) (*VariableMap, error) {
+	if err := checkGlobs(patterns); err != nil {
+		return nil, err
+	}
+	return m.Filter(func(n, _ string) bool { return !matchesGlob(n, patterns) }), nil
+}
+
+// Provides the variables whose names match re
+func (m *VariableMap) FilterRegex(re *regexp.Regexp) *VariableMap {
+	return m.Filter(func(n, _ string) bool { return re.MatchString(n) })
+}
+
+// Provides the variables with each name changed by fn. Variables are left out if fn gives an empty name.
+// If two names end up the same, the later one's value wins
+func (m *VariableMap) RenameFunc(fn func(name string) string) *VariableMap {
+	renamed := NewVariableMap()
+	m.Range(func(n, v string) bool {
+		if name := fn(n); len(name) > 0 {
+			renamed.Set(name, v)
+		}
+		return true
+	})
+	return renamed
+}
+
+// Provides the variables with prefix taken off the names that start with it. Ex 'LOGSTASH_HOME' becomes 'HOME'.
+// Other names are left as they are
+func (m *VariableMap) StripPrefix(prefix string) *VariableMap {
+	return m.RenameFunc(func(n string) string { return strings.TrimPrefix(n, prefix) })
+}
+
+// Provides the variables with prefix put in front of every name
+func (m *VariableMap) AddPrefix(prefix string) *VariableMap {
+	return m.RenameFunc(func(n string) string { return prefix + n })
+}
+
+// Provides the variables with each name in renames changed to its value there. Ex {'DB_HOST': 'ELASTIC_HOST'}
+func (m *VariableMap) Rename(renames map[string]string) *VariableMap {
+	return m.RenameFunc(func(n string) string {
+		if to, ok := renames[n]; ok {
+			return to
+		}
+		return n
+	})
+}
+
+// Provides the variables with the names that start with from starting with to instead. Ex 'DB_' to 'ELASTIC_'
+func (m *VariableMap) RenamePrefix(from string, to string) *VariableMap {
+	return m.RenameFunc(func(n string) string {
+		if strings.HasPrefix(n, from) {
+			return to + strings.TrimPrefix(n, from)
+		}
+		return n
+	})
+}
+
+// Provides the variables of both maps. New names from other go after those already here.
+// strategy decides which value is used when both have the same name with different values
+func (m *VariableMap) Merge(other *VariableMap, strategy MergeStrategy) (*VariableMap, error) {
+	if _, err := ParseMergeStrategy(string(strategy)); err != nil {
+		return nil, err
+	}
+	merged := m.Clone()
+	// Names whose value now comes from other, so where it was defined does too
+	fromOther := map[string]bool{}
+	var err error
+	other.Range(func(n, v string) bool {
+		current, ok := merged.Lookup(n)
+		switch {
+		case !ok:
+			merged.Set(n, v)
+			fromOther[n] = true
+		case current == v:
+		case strategy == MERGE_LAST_WINS:
+			merged.Set(n, v)
+			fromOther[n] = true
+		case strategy == MERGE_ERROR:
+			err = fmt.Errorf("'%s' is defined with different values", n)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	merged.provenance = mergeProvenance(m.Provenance(), other.Provenance(), fromOther)
+	return merged, nil
+}
+
+// Provides where the variables of a merge were defined. Names in fromOther were defined where other says, and the
+// rest where p says. nil if neither is known
+func mergeProvenance(p *Provenance, other *Provenance, fromOther map[string]bool) *Provenance {
+	if p == nil && other == nil {
+		return nil
+	}
+	merged := NewProvenance()
+	merged.branches = append(append(merged.branches, p.Branches()...), other.Branches()...)
+	for _, n := range p.Names() {
+		merged.origins[n] = p.Origins(n)
+	}
+	for _, n := range other.Names() {
+		if _, ok := merged.origins[n]; !ok || fromOther[n] {
+			merged.origins[n] = other.Origins(n)
+		}
+	}
+	for n := range fromOther {
+		if len(other.Origins(n)) == 0 {
+			// other doesn't know where it was defined, and what p knows is about another value
+			delete(merged.origins, n)
+		}
+	}
+	return merged
+}
+
+// Provides the variables whose names are also in other. Values are the ones from this map
+func (m *VariableMap) Intersect(other *VariableMap) *VariableMap {
+	return m.Filter(func(n, _ string) bool {
+		_, ok := other.Lookup(n)
+		return ok
+	})
+}
+
+// Provides the variables whose names aren't in other
+func (m *VariableMap) Subtract(other *VariableMap) *VariableMap {
+	return m.Filter(func(n, _ string) bool {
+		_, ok := other.Lookup(n)
+		return !ok
+	})
+}
+
+// Makes sure each of the glob patterns can be used
+func checkGlobs(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", p, err)
+		}
+	}
+	return nil
+}
+
+// Does name match any of the patterns? They must already have been checked
+func matchesGlob(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package environment
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestVariableTransforms(t *testing.T) {
+	env := NewVariableMap()
+	input := "LOGSTASH_HOME=/opt/ls\nDB_HOST=db\nLOGSTASH_HEAP=1g\nDB_PORT=5432\nOTHER=x\n"
+	if err := ProcessEnvironmentWith(strings.NewReader(input), env, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	only, err := env.FilterGlob("LOGSTASH_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := only.StripPrefix("LOGSTASH_")
+	if got := strings.Join(stripped.Names(), ","); got != "HOME,HEAP" {
+		t.Fatalf("want HOME,HEAP got %s", got)
+	}
+	if stripped.Get("HOME") != "/opt/ls" || env.Len() != 5 {
+		t.Fatal("want the values kept and the original untouched")
+	}
+
+	renamed := env.RenamePrefix("DB_", "ELASTIC_").Rename(map[string]string{"OTHER": "ANOTHER"}).FilterRegex(regexp.MustCompile(`^(ELASTIC|ANOTHER)`))
+	if got := strings.Join(renamed.Names(), ","); got != "ELASTIC_HOST,ELASTIC_PORT,ANOTHER" {
+		t.Fatalf("want ELASTIC_HOST,ELASTIC_PORT,ANOTHER got %s", got)
+	}
+	if got := strings.Join(renamed.AddPrefix("X_").Names(), ","); got != "X_ELASTIC_HOST,X_ELASTIC_PORT,X_ANOTHER" {
+		t.Fatalf("want prefixed names, got %s", got)
+	}
+	if _, err := env.ExcludeGlob("["); err == nil {
+		t.Fatal("want an error for a bad pattern")
+	}
+
+	other := VariableMapOf(map[string]string{"OTHER": "y", "NEW": "z", "DB_PORT": "5432"})
+	for strategy, want := range map[MergeStrategy]string{MERGE_FIRST_WINS: "x", MERGE_LAST_WINS: "y"} {
+		merged, err := env.Merge(other, strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if merged.Get("OTHER") != want || merged.Get("NEW") != "z" || merged.Len() != 6 {
+			t.Fatalf("%s: want OTHER '%s' and NEW added, got %v", strategy, want, merged.Map())
+		}
+	}
+	if _, err := env.Merge(other, MERGE_ERROR); err == nil || !strings.Contains(err.Error(), "OTHER") {
+		t.Fatalf("want an error naming OTHER, got %v", err)
+	}
+	if _, err := ParseMergeStrategy("random"); err == nil {
+		t.Fatal("want an error for an unknown strategy")
+	}
+
+	// Merged in names say where they came from
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"a.env": "PORT=80a\nSHARED=1\n", "b.env": "\nHOST=x\nSHARED=2\nPORT=80b\n"})
+	a, b := NewVariableMap(), NewVariableMap()
+	if err := ProcessEnvironmentFileWith(filepath.Join(dir, "a.env"), a, ProcessOptions{Provenance: NewProvenance()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProcessEnvironmentFileWith(filepath.Join(dir, "b.env"), b, ProcessOptions{Provenance: NewProvenance()}); err != nil {
+		t.Fatal(err)
+	}
+	for strategy, want := range map[MergeStrategy]string{MERGE_FIRST_WINS: "a.env:1", MERGE_LAST_WINS: "b.env:4"} {
+		merged, _ := a.Merge(b, strategy)
+		if _, err := merged.GetInt("PORT"); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: want PORT from %s, got %v", strategy, want, err)
+		}
+		if origin, ok := merged.Provenance().Last("HOST"); !ok || origin.Line != 2 || filepath.Base(origin.Path) != "b.env" {
+			t.Fatalf("%s: want HOST from b.env:2, got %v", strategy, origin)
+		}
+	}
+	if merged, _ := a.Merge(VariableMapOf(map[string]string{"PORT": "1"}), MERGE_LAST_WINS); merged.Provenance().Origins("PORT") != nil {
+		t.Fatal("want no origin for a value from a map that doesn't know where it was set")
+	}
+
+	if got := strings.Join(env.Intersect(other).Names(), ","); got != "DB_PORT,OTHER" {
+		t.Fatalf("want DB_PORT,OTHER got %s", got)
+	}
+	if got := strings.Join(env.Subtract(other).Names(), ","); got != "LOGSTASH_HOME,DB_HOST,LOGSTASH_HEAP" {
+		t.Fatalf("want LOGSTASH_HOME,DB_HOST,LOGSTASH_HEAP got %s", got)
+	}
+}
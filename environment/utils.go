@@ -1,25 +1,62 @@
 package environment
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
 
+// Settings that control how Environment variable declarations are processed.
+type ProcessOptions struct {
+	// If true then detailed debugging information will be printed through the process of reading envData.
+	DoPrint bool
+	// Key used to decrypt values that were encrypted with EncryptValue.
+	// If empty then encrypted values are kept exactly as they were written.
+	Key []byte
+	// Decides which values are secret. Any variables that get decrypted are marked as secret in it.
+	// Secret values are masked in debugging output unless ShowSecrets is true.
+	Secrets *SecretDetector
+	// Should secret values be shown in debugging output anyway?
+	ShowSecrets bool
+	// Records where each variable was defined, through any includes. Nothing is recorded if nil
+	Provenance *Provenance
+	// Collects the names of variables that were unset and not defined again afterwards. Nothing is collected if nil
+	Unset UnsetNames
+	// Builtins and functions that values can use. Ex '${glenv:file_dir}'. DefaultExpansions is used if nil
+	Expansions *ExpansionRegistry
+	// Settings for values read from files. Ex 'KEY=@file:/run/secrets/key'
+	// If nil then such values are kept exactly as they were written
+	FileRefs *FileRefOptions
+	// Runs the commands in values such as 'VERSION=$(git rev-parse HEAD)'.
+	// If nil then commands are never run, and are kept exactly as they were written
+	Commands *CommandSubstitution
+}
+
+// Provides the value as it should appear in debugging output. Secret values are masked.
+func (opts *ProcessOptions) displayValue(name string, value string) string {
+	if !opts.ShowSecrets && opts.Secrets != nil && opts.Secrets.IsSecret(name, value) {
+		return SECRET_MASK
+	}
+	return value
+}
+
 // Reads in the file at the given path for all Environment variable declarations within.
 // Each variable found is added to or updated with the latest version in envProcessed.
 // Values that contain a known Environment variable will be expanded to contain the variable's value.
 // If doPrint == true then detailed debugging information will be printed through the process of reading envData.
 func ProcessEnvironmentFile(path string, envProcessed *VariableMap, doPrint bool) {
-	file, err := os.Open(path)
-	check(err)
-	defer file.Close()
+	check(ProcessEnvironmentFileWith(path, envProcessed, ProcessOptions{DoPrint: doPrint}))
+}
 
-	check(ProcessEnvironment(file, envProcessed, doPrint))
+// Reads in the file at the given path for all Environment variable declarations within.
+// Works the same as ProcessEnvironmentFile, but with the behaviour controlled by opts.
+// Files it includes are processed where the include directive is, relative to the file's directory.
+func ProcessEnvironmentFileWith(path string, envProcessed *VariableMap, opts ProcessOptions) error {
+	return processEnvironmentFile(path, nil, false, envProcessed, opts, nil)
 }
 
 // Reads in the file at the given path for all Environment variable declarations within.
@@ -27,75 +64,273 @@ func ProcessEnvironmentFile(path string, envProcessed *VariableMap, doPrint bool
 // Values that contain a known Environment variable will be expanded to contain the variable's value.
 // If doPrint == true then detailed debugging information will be printed through the process of reading envData.
 func ProcessEnvironment(r io.Reader, envProcessed *VariableMap, doPrint bool) (err error) {
-	rVars := regexp.MustCompile(`\$\{?([\w-]+)\}?`)
+	return ProcessEnvironmentWith(r, envProcessed, ProcessOptions{DoPrint: doPrint})
+}
 
-	if fileEntries, err := ReadVariables(r); err != nil {
+// Reads in all Environment variable declarations within r.
+// Works the same as ProcessEnvironment, but with the behaviour controlled by opts.
+// Encrypted values are decrypted when opts.Key is provided. Decrypted values are used as-is and never expanded.
+// Files that are included are found relative to the working directory.
+func ProcessEnvironmentWith(r io.Reader, envProcessed *VariableMap, opts ProcessOptions) (err error) {
+	defs, err := ReadDefinitions(r)
+	if err != nil {
 		return err
-	} else {
-		for _, entry := range fileEntries {
-			if doPrint {
-				fmt.Printf("## '%s'\n", entry.Name)
-			}
+	}
+	return processDefinitions(defs, "", nil, envProcessed, opts, nil)
+}
 
-			varsFound := rVars.FindAllString(entry.Value, -1)
-			if len(varsFound) > 0 {
-				if doPrint {
-					fmt.Printf("Found %d variables\n", len(varsFound))
-					fmt.Println(varsFound)
-					fmt.Printf("Expanding: `%s`\n", entry.Value)
-				}
-				// Attempt to "expand" the found variables
-				if expandAttempt, done, neededKeys := ExpandVarString(entry.Value, envProcessed); done {
-					// If all were successfully expanded then put the fully expanded value into the envProcessed map under the "name" given.
-					//TODO: Duplicate. May need a function?
-					if v, ok := (*envProcessed)[entry.Name]; ok {
-						// Already exists. Overwrite, but log that fact
-						fmt.Printf("-=\t '%s'\n", v)
-					}
-					// Fully expanded. We can track it as it's "done"
-					if doPrint {
-						fmt.Printf("+=\t '%s'\n", expandAttempt)
-					}
-					(*envProcessed)[entry.Name] = expandAttempt
-				} else {
-					return fmt.Errorf("found %d environment variables referenced that aren't known:\nmissing:\n%v", len(neededKeys), neededKeys)
-				}
-			} else {
-				//TODO: Duplicate! Function?
-				if v, ok := (*envProcessed)[entry.Name]; ok {
-					// Already exists. Overwrite, but log that fact
-					if doPrint {
-						fmt.Printf("-=\t '%s'\n", v)
-					}
+// Processes the file at path. includedFrom is the include directive that brought it in, if any.
+// chain holds the absolute paths of the files that are part way through being processed, so include cycles are caught.
+func processEnvironmentFile(path string, includedFrom *Origin, optional bool, envProcessed *VariableMap, opts ProcessOptions, chain []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, c := range chain {
+		if c == abs {
+			return fmt.Errorf("%s: include cycle: %s", includedFrom, strings.Join(append(chain[i:], abs), " -> "))
+		}
+	}
+
+	file, err := os.Open(path)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		if opts.DoPrint {
+			fmt.Printf("Skipping optional include: %s\n", path)
+		}
+		return nil
+	} else if err != nil {
+		if includedFrom != nil {
+			return fmt.Errorf("%s: %w", includedFrom, err)
+		}
+		return err
+	}
+	defer file.Close()
+
+	defs, err := ReadDefinitions(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return processDefinitions(defs, path, includedFrom, envProcessed, opts, append(chain, abs))
+}
+
+// Applies each definition in order. path is the file they were read from, if any.
+// Definitions in conditional branches that aren't taken are skipped.
+func processDefinitions(defs []Definition, path string, includedFrom *Origin, envProcessed *VariableMap, opts ProcessOptions, chain []string) error {
+	if opts.Provenance != nil {
+		envProcessed.SetProvenance(opts.Provenance)
+	}
+	conditions := conditionalState{}
+	for _, d := range defs {
+		origin := Origin{Path: path, Line: d.Line, IncludedFrom: includedFrom}
+		switch d.Kind {
+		case DEFINITION_IF, DEFINITION_ELIF, DEFINITION_ELSE, DEFINITION_ENDIF:
+			branch, reached, err := conditions.Apply(d, origin, envProcessed)
+			if err != nil {
+				return fmt.Errorf("%s: %w", origin, err)
+			}
+			if reached {
+				if opts.DoPrint {
+					fmt.Printf("%s: %t\n", branch, branch.Taken)
 				}
-				// There's nothing to expand. Just track it.
-				if doPrint {
-					fmt.Printf("+=\t '%s'\n", entry.Value)
+				opts.Provenance.RecordBranch(branch)
+			}
+			continue
+		}
+		if !conditions.Active() {
+			continue
+		}
+
+		switch d.Kind {
+		case DEFINITION_INCLUDE:
+			target := resolveInclude(path, d.Path)
+			if opts.DoPrint {
+				fmt.Printf("Including: %s\n", target)
+			}
+			if err := processEnvironmentFile(target, &origin, d.Optional, envProcessed, opts, chain); err != nil {
+				return err
+			}
+		case DEFINITION_VARIABLE:
+			if err := processVariable(d.Variable(), path, envProcessed, opts); err != nil {
+				return fmt.Errorf("%s: %w", origin, err)
+			}
+			opts.Provenance.Record(d.Name, origin)
+			if opts.FileRefs != nil {
+				if target, ok := opts.FileRefs.Target(d.Name); ok {
+					opts.Provenance.Record(target, origin)
 				}
-				(*envProcessed)[entry.Name] = entry.Value
 			}
+		case DEFINITION_UNSET:
+			UnsetVariable(d.Name, envProcessed, opts)
+			origin.Unset = true
+			opts.Provenance.Record(d.Name, origin)
 		}
 	}
 	return nil
 }
 
+// Removes the named variable from envProcessed, the same as an 'unset NAME' line does.
+// The name is added to opts.Unset so it can be removed from inherited environments too.
+func UnsetVariable(name string, envProcessed *VariableMap, opts ProcessOptions) {
+	if opts.DoPrint {
+		fmt.Printf("## '%s'\n", name)
+		if v, ok := envProcessed.Lookup(name); ok {
+			fmt.Printf("-=\t '%s'\n", opts.displayValue(name, v))
+		}
+		fmt.Println("unset")
+	}
+	envProcessed.Unset(name)
+	opts.Unset.Add(name)
+}
+
+// Adds or updates entry in envProcessed, decrypting or expanding its value as needed.
+// Undefined entries are unset instead. path is the file the entry was read from, if any
+func processVariable(entry Variable, path string, envProcessed *VariableMap, opts ProcessOptions) error {
+	if entry.Undefined {
+		UnsetVariable(entry.Name, envProcessed, opts)
+		return nil
+	}
+	// Defined again. Any earlier unset no longer applies
+	opts.Unset.Remove(entry.Name)
+
+	rVars := regexp.MustCompile(`\$\{?([\w-]+)\}?`)
+	doPrint := opts.DoPrint
+
+	if doPrint {
+		fmt.Printf("## '%s'\n", entry.Name)
+	}
+
+	if IsEncryptedValue(entry.Value) && len(opts.Key) > 0 {
+		plain, err := DecryptValue(entry.Name, entry.Value, opts.Key)
+		if err != nil {
+			return err
+		}
+		if opts.Secrets != nil {
+			opts.Secrets.Mark(entry.Name)
+		}
+		if doPrint {
+			fmt.Printf("+=\t '%s' (decrypted)\n", entry.Value)
+		}
+		envProcessed.Set(entry.Name, plain)
+		return nil
+	}
+
+	varsFound := rVars.FindAllString(entry.Value, -1)
+	if _, _, hasCommand := findCommandSubstitution(entry.Value); len(varsFound) > 0 || hasCommand {
+		if doPrint {
+			fmt.Printf("Found %d variables\n", len(varsFound))
+			fmt.Println(varsFound)
+			fmt.Printf("Expanding: `%s`\n", opts.displayValue(entry.Name, entry.Value))
+		}
+		// Attempt to "expand" the found variables
+		ctx := ExpansionContext{File: path, Name: entry.Name, Variables: envProcessed, Registry: opts.Expansions}
+		if expandAttempt, done, neededKeys, err := expandValue(entry.Value, ctx, opts.Commands); err != nil {
+			return err
+		} else if done {
+			// If all were successfully expanded then put the fully expanded value into the envProcessed map under the "name" given.
+			//TODO: Duplicate. May need a function?
+			if v, ok := envProcessed.Lookup(entry.Name); ok && doPrint {
+				// Already exists. Overwrite, but log that fact
+				fmt.Printf("-=\t '%s'\n", opts.displayValue(entry.Name, v))
+			}
+			// Fully expanded. We can track it as it's "done"
+			if doPrint {
+				fmt.Printf("+=\t '%s'\n", opts.displayValue(entry.Name, expandAttempt))
+			}
+			envProcessed.Set(entry.Name, expandAttempt)
+		} else {
+			return fmt.Errorf("found %d environment variables referenced that aren't known:\nmissing:\n%v", len(neededKeys), neededKeys)
+		}
+	} else {
+		//TODO: Duplicate! Function?
+		if v, ok := envProcessed.Lookup(entry.Name); ok {
+			// Already exists. Overwrite, but log that fact
+			if doPrint {
+				fmt.Printf("-=\t '%s'\n", opts.displayValue(entry.Name, v))
+			}
+		}
+		// There's nothing to expand. Just track it.
+		if doPrint {
+			fmt.Printf("+=\t '%s'\n", opts.displayValue(entry.Name, entry.Value))
+		}
+		envProcessed.Set(entry.Name, entry.Value)
+	}
+	return resolveFileRef(entry, path, envProcessed, opts)
+}
+
+// Reads the value for entry from a file if it refers to one, once its own value has been processed. See FileRefOptions
+func resolveFileRef(entry Variable, path string, envProcessed *VariableMap, opts ProcessOptions) error {
+	fo := opts.FileRefs
+	if fo == nil {
+		return nil
+	}
+	value := envProcessed.Get(entry.Name)
+	target := entry.Name
+	if strings.HasPrefix(entry.Value, FILE_REF_PREFIX) && strings.HasPrefix(value, FILE_REF_PREFIX) {
+		value = strings.TrimPrefix(value, FILE_REF_PREFIX)
+	} else if t, ok := fo.Target(entry.Name); ok {
+		target = t
+	} else {
+		return nil
+	}
+
+	contents, err := fo.Read(value, path)
+	if err != nil {
+		return err
+	}
+	if fo.MarkSecret && opts.Secrets != nil {
+		opts.Secrets.Mark(target)
+	}
+	if opts.DoPrint {
+		fmt.Printf("+=\t '%s' '%s' (read from %s)\n", target, opts.displayValue(target, contents), value)
+	}
+	envProcessed.Set(target, contents)
+	opts.Unset.Remove(target)
+	return nil
+}
+
 // ExpandVarString replaces sections of varString that are formatted like environment variables with any matching entries in the given lookup.
 // Lookup's keys are expected to be the variable's name, the matching value is what the variable will be replaced with.
 // Returns the updated string, whether any replacements were made and an array of variable names that were in varString but don't have values provided in lookup.
+// Builtins and functions from DefaultExpansions are expanded too. Any that fail are listed with the missing names. Ex 'glenv:nope'
 func ExpandVarString(varString string, lookup *VariableMap) (replaced string, allTranslated bool, neededKeys []string) {
+	replaced, allTranslated, neededKeys, _ = ExpandVarStringWith(varString, ExpansionContext{Variables: lookup})
+	return replaced, allTranslated, neededKeys
+}
+
+// Works the same as ExpandVarString, with variables looked up in ctx.Variables.
+// References like '${<namespace>:<arg>}' are given to the function registered for namespace in ctx.Registry.
+// err is the first error from those functions.
+func ExpandVarStringWith(varString string, ctx ExpansionContext) (replaced string, allTranslated bool, neededKeys []string, err error) {
 	// rVars := regexp.MustCompile(`\$\{([\w-]+)\}|\$([\w-]+)`)
-	rVars := regexp.MustCompile(`\$\{([A-Za-z]{1}[A-Za-z0-9_-]+)\}|\$([A-Za-z]{1}[A-Za-z0-9_-]+)`)
+	rVars := regexp.MustCompile(`\$\{(` + REGEX_EXPANSION_NAMESPACE + `):([^}]*)\}|\$\{([A-Za-z]{1}[A-Za-z0-9_-]+)\}|\$([A-Za-z]{1}[A-Za-z0-9_-]+)`)
 	neededKeys = []string{}
+	registry := ctx.Registry
+	if registry == nil {
+		registry = DefaultExpansions
+	}
+	lookup := ctx.Variables
 
 	missCount := 0
 	replaced = rVars.ReplaceAllStringFunc(varString, func(s string) string {
 		subs := rVars.FindStringSubmatch(s)
-		// k := len(subs[1]) > 0 ? subs[1] : subs[2]
-		k := subs[1]
-		if len(subs[1]) == 0 {
-			k = subs[2]
+		if len(subs[1]) > 0 {
+			value, fnErr := registry.Expand(subs[1], subs[2], ctx)
+			if fnErr != nil {
+				if err == nil {
+					err = fmt.Errorf("%s: %w", s, fnErr)
+				}
+				missCount++
+				neededKeys = append(neededKeys, subs[1]+":"+subs[2])
+				return s
+			}
+			return value
+		}
+		// k := len(subs[3]) > 0 ? subs[3] : subs[4]
+		k := subs[3]
+		if len(subs[3]) == 0 {
+			k = subs[4]
 		}
-		if xp, ok := (*lookup)[k]; ok {
+		if xp, ok := lookup.Lookup(k); ok {
 			return CleanVarValue(xp)
 		} else {
 			missCount++
@@ -104,7 +339,7 @@ func ExpandVarString(varString string, lookup *VariableMap) (replaced string, al
 		}
 	})
 
-	return replaced, missCount == 0, neededKeys
+	return replaced, missCount == 0, neededKeys, err
 }
 
 func FindEndingPartialIndex(target string) (indexOfPartial int, err error) {
@@ -130,27 +365,35 @@ func CleanVarValue(varValue string) string {
 
 // NOTE: Named groups for expanding strings...
 // const ENV_LINE_REGEX string = `^[ \t]*(?:export)?[ \t]?(?P<key>[A-Z]+[A-Z0-9-_]+)=(?P<value>(?:\"?(?:(?:[\.\w\-:\/\\]*(?:\${[\w-]*\})*)*)\"?)|(?:(?:[\.\w\-:\/\\]*(?:\${[\w-]*\})*)*))$`
-const ENV_LINE_REGEX string = `^[ \t]*(?:export)?[ \t]*([A-Za-z][\w-]*)=\"?((?:\\\")*(?:\\\$)*(?:[^\r\n\$\"]*)*(?:(?:\$\{[A-Za-z][\w-]*\})?|(?:\$[A-Za-z][\w-]*)?)*)+\"?$`
+const ENV_LINE_REGEX string = `^[ \t]*(?:export)?[ \t]*([A-Za-z][\w-]*)=\"?((?:\\\")*(?:\\\$)*(?:[^\r\n\$\"]*)*(?:(?:\$\{[A-Za-z][\w-]*(?::[^}\r\n\"]*)?\})?|(?:\$\([^\r\n\"]*\))?|(?:\$[A-Za-z][\w-]*)?)*)+\"?$`
+
+// Finds the start and end of the value within a definition line.
+// nameEnd is the index just after the variable's name and lineEnd is the end of the matched definition.
+// Any double-quotes wrapping the value are not included.
+func definitionValueSpan(line string, nameEnd int, lineEnd int) (start int, end int) {
+	// Skip past the '='
+	start, end = nameEnd+1, lineEnd
+	if start < end && line[start] == '"' {
+		start++
+	}
+	if end > start && line[end-1] == '"' && line[end-2] != '\\' {
+		end--
+	}
+	return start, end
+}
 
+// Reads every variable definition in rIn, in order. Unset lines give Undefined variables.
+// Other directives, such as includes, are skipped. See ReadDefinitions
 func ReadVariables(rIn io.Reader) (envVars Variables, err error) {
 	envVars = make([]Variable, 0, 10)
 
-	scanner := bufio.NewScanner(rIn)
-	r := regexp.MustCompile(ENV_LINE_REGEX)
-	for scanner.Scan() {
-		matches := r.FindStringSubmatch(scanner.Text())
-		if len(matches) == 3 {
-			envVars = append(envVars, Variable{Name: matches[1], Value: matches[2]})
-		} else if len(matches) > 1 {
-			return envVars, fmt.Errorf("unexpected matches %d", len(matches))
+	defs, err := ReadDefinitions(rIn)
+	for _, d := range defs {
+		if d.Kind == DEFINITION_VARIABLE || d.Kind == DEFINITION_UNSET {
+			envVars = append(envVars, d.Variable())
 		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		return envVars, err
-	}
-
-	return envVars, nil
+	return envVars, err
 }
 
 // Attempts to read in environment variable key/value pairs from envData.
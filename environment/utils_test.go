@@ -1,6 +1,9 @@
 package environment
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -28,15 +31,29 @@ func checkNamesAndValues(t *testing.T, expectedKeys Variables, envString string)
 	}
 }
 
+// Creates each of the files under dir, along with the directories they are in
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestReadEnvironmentMultipleNoQuotes(t *testing.T) {
 	expectedKeys := Variables{
-		{"VAR01", "standard"},
-		{"VAR02", "slight-variation_with+stuff^\\&@#%()_in~it"},
-		{"VAR03", "/noexport/absolute-path"},
-		{"VAR04", "../relative-path"},
-		{"VAR05", "./local-path"},
-		{"VAR06", "./globs/**/path/*.env"},
-		{"VAR07", "escaped\\$variablestart"},
+		{Name: "VAR01", Value: "standard"},
+		{Name: "VAR02", Value: "slight-variation_with+stuff^\\&@#%()_in~it"},
+		{Name: "VAR03", Value: "/noexport/absolute-path"},
+		{Name: "VAR04", Value: "../relative-path"},
+		{Name: "VAR05", Value: "./local-path"},
+		{Name: "VAR06", Value: "./globs/**/path/*.env"},
+		{Name: "VAR07", Value: "escaped\\$variablestart"},
 	}
 
 	// Default assembly
@@ -70,3 +87,184 @@ func TestReadEnvironmentSingle(t *testing.T) {
 		}
 	}
 }
+
+func TestShellDefinitionBuilders(t *testing.T) {
+	vars := Variables{
+		{Name: "PLAIN", Value: "value"},
+		{Name: "TRICKY", Value: `it's $HOME \ "quoted"`},
+	}
+	expected := map[string]string{
+		"bash":     "export PLAIN='value'\nexport TRICKY='it'\\''s $HOME \\ \"quoted\"'\n",
+		"fish":     "set -gx PLAIN 'value'\nset -gx TRICKY 'it\\'s $HOME \\\\ \"quoted\"'\n",
+		"pwsh.exe": "$env:PLAIN = 'value'\n$env:TRICKY = 'it''s $HOME \\ \"quoted\"'\n",
+	}
+	for shell, want := range expected {
+		builder, err := NewShellDefinitionBuilder(shell)
+		if err != nil {
+			t.Fatalf("%s: %s", shell, err)
+		}
+		if got := builder.BuildString(vars); got != want {
+			t.Fatalf("%s: want\n%s\ngot\n%s", shell, want, got)
+		}
+	}
+
+	unset, err := NewShellUnsetBuilder("/usr/bin/powershell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := unset.BuildString(vars), "Remove-Item Env:PLAIN\nRemove-Item Env:TRICKY\n"; got != want {
+		t.Fatalf("want\n%s\ngot\n%s", want, got)
+	}
+	if _, err := NewShellDefinitionBuilder("cmd.exe"); err == nil {
+		t.Fatal("expected cmd to be unsupported")
+	}
+}
+
+func TestShellDefinitionBuildersSkipInvalidNames(t *testing.T) {
+	vars := Variables{
+		{Name: "A-B", Value: "x"},
+		{Name: "1ST", Value: "x"},
+		{Name: "_OK_1", Value: "x"},
+		{Name: "GONE-TOO", Undefined: true},
+		{Name: "GONE", Undefined: true},
+	}
+	expected := map[string]string{
+		"bash":       "export _OK_1='x'\nunset GONE\n",
+		"fish":       "set -gx _OK_1 'x'\nset -e GONE\n",
+		"powershell": "$env:_OK_1 = 'x'\nRemove-Item Env:GONE\n",
+	}
+	for shell, want := range expected {
+		builder, _ := NewShellDefinitionBuilder(shell)
+		if got := builder.BuildString(vars); got != want {
+			t.Fatalf("%s: want\n%s\ngot\n%s", shell, want, got)
+		}
+	}
+
+	// The plain .env format writes every name
+	if got := NewDefinitionBuilder().BuildString(vars[:1]); got != "export A-B=x\n" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestProcessIncludes(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"finances.mac.env":  "# @include ./shared/common.env\n# @include? ./missing.env\nHOST=mac\nURL=\"http://${HOST}:${PORT}/api\"\n",
+		"shared/common.env": "HOST=common\nsource \"./ports.env\"\n",
+		"shared/ports.env":  "PORT=8080\n",
+		"loop.env":          "# @include ./shared/loop.env\n",
+		"shared/loop.env":   "# @include ../loop.env\n",
+		"broken.env":        "# @include ./missing.env\n",
+	}
+	writeTestFiles(t, dir, files)
+
+	env := NewVariableMap()
+	provenance := NewProvenance()
+	if err := ProcessEnvironmentFileWith(filepath.Join(dir, "finances.mac.env"), env, ProcessOptions{Provenance: provenance}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://mac:8080/api"; env.Get("URL") != want {
+		t.Fatalf("want URL '%s', got '%s'", want, env.Get("URL"))
+	}
+	origin, _ := provenance.Last("PORT")
+	if want := filepath.Join(dir, "shared/ports.env") + ":1, included from " + filepath.Join(dir, "shared/common.env") + ":2, included from " + filepath.Join(dir, "finances.mac.env") + ":1"; origin.String() != want {
+		t.Fatalf("want origin\n%s\ngot\n%s", want, origin)
+	}
+	if origins := provenance.Origins("HOST"); len(origins) != 2 || origins[1].IncludedFrom != nil {
+		t.Fatalf("want HOST defined in common.env then overridden, got %v", origins)
+	}
+
+	if err := ProcessEnvironmentFileWith(filepath.Join(dir, "loop.env"), &VariableMap{}, ProcessOptions{}); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Fatalf("want an include cycle error, got %v", err)
+	}
+	if err := ProcessEnvironmentFileWith(filepath.Join(dir, "broken.env"), &VariableMap{}, ProcessOptions{}); err == nil {
+		t.Fatal("want an error for a missing include")
+	}
+
+	included, err := IncludedFiles(filepath.Join(dir, "finances.mac.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(included) != 3 {
+		t.Fatalf("want 3 files, got %v", included)
+	}
+}
+
+func TestProcessUnset(t *testing.T) {
+	env := VariableMapOf(map[string]string{"INHERITED": "yes"})
+	unset := UnsetNames{}
+	input := "A=1\nEMPTY=\nunset A INHERITED MISSING\nMISSING=back\n"
+	if err := ProcessEnvironmentWith(strings.NewReader(input), env, ProcessOptions{Unset: unset}); err != nil {
+		t.Fatal(err)
+	}
+	if _, defined := env.Lookup("A"); defined {
+		t.Fatal("want A undefined")
+	}
+	if v, defined := env.Lookup("EMPTY"); !defined || v != "" {
+		t.Fatalf("want EMPTY defined and empty, got '%s' defined %t", v, defined)
+	}
+	if len(unset) != 2 || !unset["A"] || !unset["INHERITED"] {
+		t.Fatalf("want A and INHERITED unset, got %v", unset)
+	}
+
+	// Undefined variables are written as unset lines, and read back the same way
+	vars := Variables{{Name: "KEPT", Value: ""}, {Name: "GONE", Undefined: true}}
+	written := NewDefinitionBuilder().BuildString(vars)
+	if want := "export KEPT=\nunset GONE\n"; written != want {
+		t.Fatalf("want\n%s\ngot\n%s", want, written)
+	}
+	read, err := ReadVariables(strings.NewReader(written))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[0].Undefined || !read[1].Undefined {
+		t.Fatalf("want KEPT defined and GONE undefined, got %v", read)
+	}
+}
+
+func TestConditionalBlocks(t *testing.T) {
+	input := `MODE=prod
+# @if OS == "plan9"
+HOME_DIR=/usr/glenda
+# @elif MODE == 'prod' && !DEBUG
+HOME_DIR=/srv
+# @if $MODE != "prod"
+NEVER=1
+# @else
+NESTED=yes
+# @endif
+# @else
+HOME_DIR=/home
+# @endif
+`
+	env := NewVariableMap()
+	provenance := NewProvenance()
+	if err := ProcessEnvironmentWith(strings.NewReader(input), env, ProcessOptions{Provenance: provenance}); err != nil {
+		t.Fatal(err)
+	}
+	if env.Get("HOME_DIR") != "/srv" || env.Get("NESTED") != "yes" {
+		t.Fatalf("wrong branches taken: %v", env)
+	}
+	if _, ok := env.Lookup("NEVER"); ok {
+		t.Fatal("NEVER shouldn't be defined")
+	}
+	taken := []string{}
+	for _, b := range provenance.Branches() {
+		taken = append(taken, fmt.Sprintf("%d:%t", b.Origin.Line, b.Taken))
+	}
+	if got, want := strings.Join(taken, " "), "2:false 4:true 6:false 8:true 11:false"; got != want {
+		t.Fatalf("want branches %s, got %s", want, got)
+	}
+
+	for input, want := range map[string]string{
+		"# @if OS == \"linux\"\nA=1\n":           "never closed",
+		"# @endif\n":                             "without @if",
+		"# @if OS\n# @else\n# @else\n# @endif\n": "after @else",
+		"# @if NOPE == \"x\"\n# @endif\n":        "unknown variable 'NOPE'",
+	} {
+		err := ProcessEnvironmentWith(strings.NewReader(input), &VariableMap{}, ProcessOptions{})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%q: want an error containing '%s', got %v", input, want, err)
+		}
+	}
+}